@@ -36,13 +36,14 @@ func (u *UserInfo) NeedsRefresh() bool {
 }
 
 type OpenIDConfig struct {
-	Issuer           string   `json:"issuer"`
-	AuthEndpoint     string   `json:"authorization_endpoint"`
-	TokenEndpoint    string   `json:"token_endpoint"`
-	JWKSEndpoint     string   `json:"jwks_uri"`
-	Scopes           []string `json:"scopes_supported"`
-	Claims           []string `json:"claims_supported"`
-	UserInfoEndpoint string   `json:"userinfo_endpoint"`
+	Issuer             string   `json:"issuer"`
+	AuthEndpoint       string   `json:"authorization_endpoint"`
+	TokenEndpoint      string   `json:"token_endpoint"`
+	DeviceAuthEndpoint string   `json:"device_authorization_endpoint"`
+	JWKSEndpoint       string   `json:"jwks_uri"`
+	Scopes             []string `json:"scopes_supported"`
+	Claims             []string `json:"claims_supported"`
+	UserInfoEndpoint   string   `json:"userinfo_endpoint"`
 }
 
 type TokenValidator struct {
@@ -205,10 +206,11 @@ func validateAudience(audience string, token *jwt.Token) error {
 
 func (t *TokenValidator) GetPKCEAuthInfo() *ctrlv1.GetPKCEAuthInfoResponse {
 	return &ctrlv1.GetPKCEAuthInfoResponse{
-		ClientId:      t.clientID,
-		AuthEndpoint:  t.config.AuthEndpoint,
-		TokenEndpoint: t.config.TokenEndpoint,
-		RedirectUri:   t.redirectUri,
-		Audience:      t.audience,
+		ClientId:           t.clientID,
+		AuthEndpoint:       t.config.AuthEndpoint,
+		TokenEndpoint:      t.config.TokenEndpoint,
+		RedirectUri:        t.redirectUri,
+		Audience:           t.audience,
+		DeviceAuthEndpoint: t.config.DeviceAuthEndpoint,
 	}
 }
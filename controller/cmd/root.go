@@ -25,6 +25,7 @@ import (
 	"github.com/caldog20/zeronet/controller/auth"
 	"github.com/caldog20/zeronet/controller/db"
 	"github.com/caldog20/zeronet/controller/middleware"
+	"github.com/caldog20/zeronet/pkg/relay"
 	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
 	"github.com/caldog20/zeronet/third_party"
 )
@@ -35,9 +36,24 @@ var (
 	autoCert  bool
 	grpcPort  uint16
 	httpPort  uint16
+	relayPort uint16
+	relayURL  string
+	turnPort  uint16
+	turnHost  string
+	turnIP    string
+	turnTTL   time.Duration
 	// discoveryPort uint16
 	debug bool
 
+	// Network settings pushed to nodes
+	nodeMTU      uint32
+	stunServers  []string
+	turnServers  []string
+	turnUsername string
+	turnPassword string
+	dnsServers   []string
+	nodeLogLevel string
+
 	// TODO: Refactor: Many components should have the basic setup done in separate functions part of their type
 	rootCmd = &cobra.Command{
 		Use:   "controller",
@@ -72,7 +88,55 @@ var (
 				log.Fatalf("error parsing prefix: %s", err)
 			}
 
-			ctrl := controller.NewController(db, pfix)
+			settings := &controller.NetworkSettings{
+				MTU:         nodeMTU,
+				StunServers: stunServers,
+				DNSServers:  dnsServers,
+				LogLevel:    nodeLogLevel,
+				RelayURL:    relayURL,
+			}
+			// Without an explicit URL nodes reach the relay on the controller host
+			if settings.RelayURL == "" && relayPort != 0 {
+				settings.RelayURL = fmt.Sprintf("tcp://:%d", relayPort)
+			}
+			for _, t := range turnServers {
+				settings.TurnServers = append(settings.TurnServers, controller.TurnServer{
+					URL:        t,
+					Username:   turnUsername,
+					Credential: turnPassword,
+				})
+			}
+			if err := settings.Validate(); err != nil {
+				log.Fatalf("invalid network settings: %s", err)
+			}
+
+			ctrl := controller.NewController(db, pfix, settings)
+
+			// Embedded STUN/TURN server with credentials issued to nodes on login
+			var turnService *controller.TurnService
+			if turnPort != 0 {
+				relayIP := net.ParseIP(turnIP)
+				if relayIP == nil {
+					if turnIP != "" {
+						log.Fatalf("invalid turn relay ip: %s", turnIP)
+					}
+					relayIP, err = controller.DefaultRelayIP()
+					if err != nil {
+						log.Fatalf("error finding turn relay ip: %s", err)
+					}
+				}
+
+				log.Printf("starting stun/turn server on port: %d", turnPort)
+				conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", turnPort))
+				if err != nil {
+					log.Fatalf("error listening for stun/turn: %s", err)
+				}
+				turnService, err = controller.NewTurnService(conn, turnHost, relayIP, turnTTL)
+				if err != nil {
+					log.Fatalf("error starting stun/turn server: %s", err)
+				}
+				ctrl.SetTurnService(turnService)
+			}
 
 			var tokenValidator *auth.TokenValidator = nil
 
@@ -91,6 +155,20 @@ var (
 
 			eg, egCtx := errgroup.WithContext(ctx)
 
+			// Relay for nodes that can't establish a direct path
+			relayServer := relay.NewServer(ctrl.AuthenticateRelayPeer, ctrl.AllowRelayPeers)
+			relayServer.Logf = log.Debugf
+			if relayPort != 0 {
+				eg.Go(func() error {
+					log.Printf("starting relay server on port: %d", relayPort)
+					conn, err := net.Listen("tcp", fmt.Sprintf(":%d", relayPort))
+					if err != nil {
+						return err
+					}
+					return relayServer.Serve(conn)
+				})
+			}
+
 			eg.Go(func() error {
 				log.Printf("starting grpc server on port: %d", grpcPort)
 				conn, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
@@ -119,6 +197,10 @@ var (
 			gwServer := &http.Server{
 				Addr: fmt.Sprintf(":%d", httpPort),
 				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/relay" {
+						relayServer.ServeHTTP(w, r)
+						return
+					}
 					if strings.HasPrefix(r.URL.Path, "/api") {
 						mux.ServeHTTP(w, r)
 						return
@@ -139,6 +221,10 @@ var (
 				<-egCtx.Done()
 				StopGRPCServer(server)
 				StopHTTPServer(gwServer)
+				relayServer.Close()
+				if turnService != nil {
+					turnService.Close()
+				}
 				return err
 			})
 
@@ -192,6 +278,32 @@ func init() {
 		BoolVar(&debug, "debug", false, "enable debug logging")
 	rootCmd.PersistentFlags().
 		Uint16Var(&httpPort, "httpport", 8080, "port to listen for http connections")
+	rootCmd.PersistentFlags().
+		Uint16Var(&relayPort, "relayport", 50001, "port to listen for relay connections - 0 disables the tcp relay")
+	rootCmd.PersistentFlags().
+		StringVar(&relayURL, "relayurl", "", "relay url pushed to nodes, tcp://host:port or ws(s)://host/relay - defaults to the relay port on the controller host")
+	rootCmd.PersistentFlags().
+		Uint16Var(&turnPort, "turnport", 3478, "udp port for the embedded stun/turn server - 0 disables it")
+	rootCmd.PersistentFlags().
+		StringVar(&turnHost, "turnhost", "", "stun/turn host pushed to nodes - defaults to the host nodes use to reach the controller")
+	rootCmd.PersistentFlags().
+		StringVar(&turnIP, "turnrelayip", "", "ip address advertised for turn relay allocations - defaults to the first global ipv4 address")
+	rootCmd.PersistentFlags().
+		DurationVar(&turnTTL, "turnttl", controller.DefaultTurnCredentialsTTL, "lifetime of turn credentials issued to nodes")
+	rootCmd.PersistentFlags().
+		Uint32Var(&nodeMTU, "mtu", 0, "tunnel mtu pushed to nodes, between 576 and 1568 - defaults to 0 for the node default")
+	rootCmd.PersistentFlags().
+		StringSliceVar(&stunServers, "stun", nil, "stun server uris pushed to nodes")
+	rootCmd.PersistentFlags().
+		StringSliceVar(&turnServers, "turn", nil, "turn server uris pushed to nodes")
+	rootCmd.PersistentFlags().
+		StringVar(&turnUsername, "turnusername", "", "username for turn servers")
+	rootCmd.PersistentFlags().
+		StringVar(&turnPassword, "turnpassword", "", "password for turn servers")
+	rootCmd.PersistentFlags().
+		StringSliceVar(&dnsServers, "dns", nil, "dns servers pushed to nodes")
+	rootCmd.PersistentFlags().
+		StringVar(&nodeLogLevel, "nodeloglevel", "", "log level pushed to nodes (debug, info)")
 }
 
 // TODO handle signals and contextual things here
@@ -16,16 +16,32 @@ type Controller struct {
 	db *db.Store
 
 	// Config Related Items
-	prefix netip.Prefix
+	prefix   netip.Prefix
+	settings *NetworkSettings
+	turn     *TurnService
 	// currentPeers sync.Map
 	peerChannels sync.Map
+	// ICE signaling held for peers that are briefly unreachable
+	signals *signalQueues
+	// Signaling rate limit for each peer with an update stream
+	signalLimiters sync.Map
+	policy         PeerPolicy
 }
 
 func NewController(
 	db *db.Store,
 	prefix netip.Prefix,
+	settings *NetworkSettings,
 ) *Controller {
-	return &Controller{db: db, prefix: prefix}
+	c := &Controller{db: db, prefix: prefix, settings: settings, policy: DefaultPeerPolicy}
+	c.signals = newSignalQueues(c.sendPeerUpdate)
+	return c
+}
+
+// SetTurnService enables the embedded STUN/TURN server, which is then
+// pushed to nodes along with the network settings
+func (c *Controller) SetTurnService(turn *TurnService) {
+	c.turn = turn
 }
 
 func (c *Controller) ProcessPeerLogin(peer *types.Peer, req *ctrlv1.LoginPeerRequest) error {
@@ -83,6 +99,23 @@ func (c *Controller) LogoutPeer(peer *types.Peer) error {
 	return nil
 }
 
+// UpdatePeerKey stores a rotated noise public key for the peer and notifies
+// other connected peers so they can re-handshake using the new key
+func (c *Controller) UpdatePeerKey(peer *types.Peer, key string) error {
+	if peer.NoisePublicKey == key {
+		return nil
+	}
+
+	peer.NoisePublicKey = key
+	err := c.db.UpdatePeer(peer)
+	if err != nil {
+		return err
+	}
+
+	go c.PeerKeyUpdateEvent(peer.ID)
+	return nil
+}
+
 func (c *Controller) DeletePeer(peerID uint32) error {
 	peer := c.db.GetPeerbyID(peerID)
 	if peer == nil {
@@ -100,6 +133,8 @@ func (c *Controller) DeletePeer(peerID uint32) error {
 	if err != nil {
 		return err
 	}
+	// Other peers only mark a disconnected peer offline, tell them to remove it
+	c.PeerDeletedEvent(peer)
 
 	fmt.Println(err)
 
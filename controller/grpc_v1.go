@@ -54,15 +54,17 @@ func (s *GRPCServer) LoginPeer(
 			log.Debugf("peer %s is disabled", peer.MachineID)
 			return nil, status.Error(codes.PermissionDenied, "peer is disabled")
 		}
-		// Check peer auth hasn't expired
-		if peer.IsAuthExpired() {
-			log.Debugf("peer %s auth is expired", peer.MachineID)
+		// Check peer auth hasn't expired. A peer sending an access token
+		// reauthenticates early to extend its auth before it expires
+		expired := peer.IsAuthExpired()
+		if expired || req.GetAccessToken() != "" {
+			log.Debugf("peer %s reauthenticating, auth expired: %t", peer.MachineID, expired)
 
 			// Validate Access Token for reauthenticating peer
 			user, err := s.validateAccessToken(req.GetAccessToken())
 			if err != nil {
 				log.Debugf("peer %s access token is invalid", peer.MachineID)
-				if peer.IsLoggedIn() {
+				if expired && peer.IsLoggedIn() {
 					s.controller.LogoutPeer(peer)
 				}
 				return nil, err
@@ -100,7 +102,11 @@ func (s *GRPCServer) LoginPeer(
 		}
 	}
 	log.Debugf("LoginPeer method completed")
-	return &ctrlv1.LoginPeerResponse{Config: peer.ProtoConfig()}, nil
+	return &ctrlv1.LoginPeerResponse{
+		Config:      peer.ProtoConfig(),
+		Settings:    s.controller.PeerSettings(peer.ID, extractDialedHost(ctx)),
+		AuthExpires: peer.AuthExpiry().Unix(),
+	}, nil
 }
 
 func (s *GRPCServer) UpdateStream(stream ctrlv1.ControllerService_UpdateStreamServer) error {
@@ -140,19 +146,23 @@ func (s *GRPCServer) UpdateStream(stream ctrlv1.ControllerService_UpdateStreamSe
 	s.controller.PeerConnectedEvent(peer.ID)
 
 	defer func() {
-		s.controller.DeletePeerUpdateChannel(peer.ID)
+		if !s.controller.releasePeerUpdateChannel(peer.ID, pc) {
+			// A newer stream from the same peer took over, it is still connected
+			return
+		}
+		s.controller.signalLimiters.Delete(peer.ID)
 		s.controller.db.SetPeerConnected(peer, false)
 		s.controller.PeerDisconnectedEvent(peer.ID)
 	}()
 
-	connectedPeers, err := s.controller.GetConnectedPeers(peer.ID)
+	networkPeers, err := s.controller.GetNetworkPeers(peer.ID)
 	if err != nil {
 		return status.Error(codes.Internal, err.Error())
 	}
 
 	initialPeerList := &ctrlv1.UpdateResponse{
 		UpdateType: ctrlv1.UpdateType_INIT,
-		PeerList:   connectedPeers,
+		PeerList:   networkPeers,
 	}
 
 	err = stream.Send(initialPeerList)
@@ -160,6 +170,8 @@ func (s *GRPCServer) UpdateStream(stream ctrlv1.ControllerService_UpdateStreamSe
 		log.Printf("peer %d error sending data on stream", peer.ID)
 		return status.Error(codes.Internal, "error sending data on stream")
 	}
+	// Deliver signaling held while the peer was reconnecting
+	s.controller.signals.Deliver(peer.ID)
 
 	go func() {
 		for {
@@ -186,7 +198,7 @@ func (s *GRPCServer) UpdateStream(stream ctrlv1.ControllerService_UpdateStreamSe
 			// Client disconnected, send event and cleanup
 			log.Printf("peer %d disconnected from update stream", peer.ID)
 			return nil
-		case update, ok := <-pc:
+		case update, ok := <-pc.ch:
 			if !ok {
 				// channel is closed, exit
 				log.Printf("peer %d channel closed, stopping stream", peer.ID)
@@ -201,6 +213,83 @@ func (s *GRPCServer) UpdateStream(stream ctrlv1.ControllerService_UpdateStreamSe
 	}
 }
 
+func (s *GRPCServer) UpdatePeerKey(
+	ctx context.Context,
+	req *ctrlv1.UpdatePeerKeyRequest,
+) (*ctrlv1.UpdatePeerKeyResponse, error) {
+	mid, err := extractTokenMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !validateMachineID(mid) || mid != req.GetMachineId() {
+		return nil, status.Error(codes.InvalidArgument, "invalid machine ID")
+	}
+
+	if !validatePublicKey(req.GetPublicKey()) {
+		return nil, status.Error(codes.InvalidArgument, "invalid public key")
+	}
+
+	peer := s.controller.db.GetPeerByMachineID(mid)
+	if peer == nil {
+		return nil, status.Error(codes.NotFound, "peer with machine id is not registered")
+	}
+
+	if peer.IsAuthExpired() {
+		return nil, status.Error(codes.Unauthenticated, "peer auth is expired, needs new login")
+	}
+
+	if peer.IsDisabled() {
+		return nil, status.Error(codes.PermissionDenied, "peer is currently disabled")
+	}
+
+	if !peer.IsLoggedIn() {
+		return nil, status.Error(codes.PermissionDenied, "peer requires login first")
+	}
+
+	err = s.controller.UpdatePeerKey(peer, req.GetPublicKey())
+	if err != nil {
+		log.Debugf("peer %d key update failed: %s", peer.ID, err)
+		return nil, status.Error(codes.Internal, "error updating peer key")
+	}
+
+	log.Printf("peer %d rotated noise public key", peer.ID)
+	return &ctrlv1.UpdatePeerKeyResponse{}, nil
+}
+
+func (s *GRPCServer) GetNetworkSettings(
+	ctx context.Context,
+	req *ctrlv1.GetNetworkSettingsRequest,
+) (*ctrlv1.GetNetworkSettingsResponse, error) {
+	mid, err := extractTokenMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !validateMachineID(mid) {
+		return nil, status.Error(codes.InvalidArgument, "invalid machine ID")
+	}
+
+	peer := s.controller.db.GetPeerByMachineID(mid)
+	if peer == nil {
+		return nil, status.Error(codes.NotFound, "peer with machine id is not registered")
+	}
+
+	if peer.IsAuthExpired() {
+		return nil, status.Error(codes.Unauthenticated, "peer auth is expired, needs new login")
+	}
+
+	if peer.IsDisabled() {
+		return nil, status.Error(codes.PermissionDenied, "peer is currently disabled")
+	}
+
+	if !peer.IsLoggedIn() {
+		return nil, status.Error(codes.PermissionDenied, "peer requires login first")
+	}
+
+	return &ctrlv1.GetNetworkSettingsResponse{
+		Settings: s.controller.PeerSettings(peer.ID, extractDialedHost(ctx)),
+	}, nil
+}
+
 func (s *GRPCServer) extractAndValidateToken(ctx context.Context) (string, error) {
 	if !s.authEnabled {
 		return "debug", nil
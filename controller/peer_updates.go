@@ -1,12 +1,75 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/caldog20/zeronet/controller/types"
 	ctrlv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
 	log "github.com/sirupsen/logrus"
 )
 
-func (c *Controller) GetPeerUpdateChannel(id uint32) chan *ctrlv1.UpdateResponse {
-	pc := make(chan *ctrlv1.UpdateResponse)
+// Updates buffered for a peer's update stream before it is considered too slow
+const PeerChannelSize = 128
+
+// peerChannel carries updates to a peer's update stream. Sends never block,
+// so a slow stream can't stall the controller or other peers
+type peerChannel struct {
+	id     uint32
+	mu     sync.Mutex
+	closed bool
+	ch     chan *ctrlv1.UpdateResponse
+}
+
+// send queues an update that can be lost, such as ICE signaling, dropping it
+// when the channel is full
+func (pc *peerChannel) send(update *ctrlv1.UpdateResponse) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return false
+	}
+	select {
+	case pc.ch <- update:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver queues an update the peer must not miss. When the channel is full
+// it is closed instead, which ends the peer's stream so it reconnects and
+// resyncs from a fresh INIT peer list
+func (pc *peerChannel) deliver(update *ctrlv1.UpdateResponse) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return
+	}
+	select {
+	case pc.ch <- update:
+	default:
+		log.Printf("peer %d update channel full, closing update stream to resync", pc.id)
+		pc.closeLocked()
+	}
+}
+
+func (pc *peerChannel) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.closeLocked()
+}
+
+func (pc *peerChannel) closeLocked() {
+	if !pc.closed {
+		pc.closed = true
+		close(pc.ch)
+	}
+}
+
+func (c *Controller) GetPeerUpdateChannel(id uint32) *peerChannel {
+	pc := &peerChannel{id: id, ch: make(chan *ctrlv1.UpdateResponse, PeerChannelSize)}
 	c.peerChannels.Store(id, pc)
 	return pc
 }
@@ -14,23 +77,46 @@ func (c *Controller) GetPeerUpdateChannel(id uint32) chan *ctrlv1.UpdateResponse
 func (c *Controller) DeletePeerUpdateChannel(id uint32) {
 	pc, ok := c.peerChannels.LoadAndDelete(id)
 	if ok {
-		close(pc.(chan *ctrlv1.UpdateResponse))
+		pc.(*peerChannel).close()
+	}
+}
+
+// releasePeerUpdateChannel closes a stream's channel, reporting false if the
+// peer has since connected a newer stream that replaced it
+func (c *Controller) releasePeerUpdateChannel(id uint32, pc *peerChannel) bool {
+	pc.close()
+	if c.peerChannels.CompareAndDelete(id, pc) {
+		return true
 	}
+	_, replaced := c.peerChannels.Load(id)
+	return !replaced
 }
 
 func (c *Controller) CloseAllPeerUpdateChannels() {
 	// Loop through map and close each existing channel
 	// Delete the channel from the map after closing
 	c.peerChannels.Range(func(k, v interface{}) bool {
-		pc := v.(chan *ctrlv1.UpdateResponse)
-		close(pc)
+		v.(*peerChannel).close()
 		c.peerChannels.Delete(k.(uint32))
 		return true
 	})
 }
 
-func (c *Controller) GetConnectedPeers(id uint32) (*ctrlv1.PeerList, error) {
-	peers, err := c.db.GetConnectedPeers()
+// broadcastPeerUpdate delivers an update to every connected peer except id
+func (c *Controller) broadcastPeerUpdate(id uint32, update *ctrlv1.UpdateResponse) {
+	c.peerChannels.Range(func(k, v interface{}) bool {
+		if k.(uint32) != id {
+			v.(*peerChannel).deliver(update)
+		}
+		return true
+	})
+}
+
+// GetNetworkPeers lists every peer in the network except id. Peers without an
+// update stream are included with connected unset, so nodes can tell a peer
+// that is offline from one that was deleted
+func (c *Controller) GetNetworkPeers(id uint32) (*ctrlv1.PeerList, error) {
+	peers, err := c.db.GetPeers()
 	if err != nil {
 		return nil, err
 	}
@@ -65,14 +151,7 @@ func (c *Controller) PeerConnectedEvent(id uint32) {
 		},
 	}
 
-	c.peerChannels.Range(func(k, v interface{}) bool {
-		peerID := k.(uint32)
-		pc := v.(chan *ctrlv1.UpdateResponse)
-		if peerID != id {
-			pc <- update
-		}
-		return true
-	})
+	c.broadcastPeerUpdate(id, update)
 }
 
 func (c *Controller) PeerDisconnectedEvent(id uint32) {
@@ -88,14 +167,36 @@ func (c *Controller) PeerDisconnectedEvent(id uint32) {
 		},
 	}
 
-	c.peerChannels.Range(func(k, v interface{}) bool {
-		peerID := k.(uint32)
-		pc := v.(chan *ctrlv1.UpdateResponse)
-		if peerID != id {
-			pc <- update
-		}
-		return true
-	})
+	c.broadcastPeerUpdate(id, update)
+}
+
+// PeerDeletedEvent tells other peers to remove a peer deleted from the network
+func (c *Controller) PeerDeletedEvent(peer *types.Peer) {
+	update := &ctrlv1.UpdateResponse{
+		UpdateType: ctrlv1.UpdateType_DELETE,
+		PeerList: &ctrlv1.PeerList{
+			Count: 1,
+			Peers: []*ctrlv1.Peer{peer.Proto()},
+		},
+	}
+
+	c.broadcastPeerUpdate(peer.ID, update)
+}
+
+func (c *Controller) PeerKeyUpdateEvent(id uint32) {
+	peer := c.db.GetPeerbyID(id)
+	if peer == nil {
+		return
+	}
+	update := &ctrlv1.UpdateResponse{
+		UpdateType: ctrlv1.UpdateType_KEY_UPDATE,
+		PeerList: &ctrlv1.PeerList{
+			Count: 1,
+			Peers: []*ctrlv1.Peer{peer.Proto()},
+		},
+	}
+
+	c.broadcastPeerUpdate(id, update)
 }
 
 func (c *Controller) PeerForcedLogoutEvent(id uint32) {
@@ -103,10 +204,7 @@ func (c *Controller) PeerForcedLogoutEvent(id uint32) {
 		UpdateType: ctrlv1.UpdateType_LOGOUT,
 	}
 
-	pc, ok := c.peerChannels.Load(id)
-	if ok {
-		pc.(chan *ctrlv1.UpdateResponse) <- update
-	}
+	c.deliverPeerUpdate(id, update)
 }
 
 func (c *Controller) handleUpdateRequest(reqId uint32, msg *ctrlv1.UpdateRequest) {
@@ -115,10 +213,31 @@ func (c *Controller) handleUpdateRequest(reqId uint32, msg *ctrlv1.UpdateRequest
 		c.handleIceUpdateRequest(reqId, msg.GetIceUpdate())
 	default:
 		log.Printf("unknown update request type %d from peer %d", msg.UpdateType, reqId)
+		c.sendPeerUpdate(reqId, &ctrlv1.UpdateResponse{
+			UpdateType: ctrlv1.UpdateType_ERROR,
+			Error: &ctrlv1.UpdateError{
+				Message: fmt.Sprintf("unknown update type %s", msg.GetUpdateType()),
+			},
+		})
 	}
 }
 
 func (c *Controller) handleIceUpdateRequest(reqId uint32, msg *ctrlv1.IceUpdate) {
+	allowed, first := c.allowSignaling(reqId)
+	if !allowed {
+		if first {
+			log.Printf("peer %d exceeded the signaling rate limit, dropping messages", reqId)
+			c.sendPeerUpdate(reqId, iceUpdateError(msg, errors.New("signaling rate limit exceeded")))
+		}
+		return
+	}
+
+	if err := c.authorizeIceUpdate(reqId, msg); err != nil {
+		log.Debugf("rejected ice update from peer %d: %s", reqId, err)
+		c.sendPeerUpdate(reqId, iceUpdateError(msg, err))
+		return
+	}
+
 	switch msg.UpdateType {
 	// Ice Offer to Send to remote peer
 	case ctrlv1.IceUpdateType_OFFER:
@@ -131,7 +250,7 @@ func (c *Controller) handleIceUpdateRequest(reqId uint32, msg *ctrlv1.IceUpdate)
 				Pwd:        msg.GetPwd(),
 			},
 		}
-		c.sendPeerUpdate(msg.GetPeerId(), update)
+		c.signals.Send(reqId, msg.GetPeerId(), update)
 	case ctrlv1.IceUpdateType_ANSWER:
 		update := &ctrlv1.UpdateResponse{
 			UpdateType: ctrlv1.UpdateType_ICE,
@@ -142,7 +261,7 @@ func (c *Controller) handleIceUpdateRequest(reqId uint32, msg *ctrlv1.IceUpdate)
 				Pwd:        msg.GetPwd(),
 			},
 		}
-		c.sendPeerUpdate(msg.GetPeerId(), update)
+		c.signals.Send(reqId, msg.GetPeerId(), update)
 	case ctrlv1.IceUpdateType_CANDIDATE:
 		update := &ctrlv1.UpdateResponse{
 			UpdateType: ctrlv1.UpdateType_ICE,
@@ -152,15 +271,62 @@ func (c *Controller) handleIceUpdateRequest(reqId uint32, msg *ctrlv1.IceUpdate)
 				Candidate:  msg.GetCandidate(),
 			},
 		}
-		c.sendPeerUpdate(msg.GetPeerId(), update)
+		c.signals.Send(reqId, msg.GetPeerId(), update)
+	// Remote peer's network changed, its ICE session must be restarted
+	case ctrlv1.IceUpdateType_RESET:
+		update := &ctrlv1.UpdateResponse{
+			UpdateType: ctrlv1.UpdateType_ICE,
+			IceUpdate: &ctrlv1.IceUpdate{
+				UpdateType: ctrlv1.IceUpdateType_RESET,
+				PeerId:     reqId,
+			},
+		}
+		c.signals.Send(reqId, msg.GetPeerId(), update)
 	default:
 	}
 }
 
-// TODO error checking on updates when sending on peer channel
-func (c *Controller) sendPeerUpdate(id uint32, update *ctrlv1.UpdateResponse) {
+// authorizeIceUpdate checks that the sender may signal the target peer and
+// that the message is well formed
+func (c *Controller) authorizeIceUpdate(reqId uint32, msg *ctrlv1.IceUpdate) error {
+	if msg == nil {
+		return errors.New("missing ice update")
+	}
+	if msg.GetPeerId() == reqId {
+		return errors.New("cannot signal self")
+	}
+	if err := c.authorizePeerConnection(reqId, msg.GetPeerId()); err != nil {
+		return err
+	}
+
+	return validateIceUpdate(msg)
+}
+
+func iceUpdateError(msg *ctrlv1.IceUpdate, err error) *ctrlv1.UpdateResponse {
+	return &ctrlv1.UpdateResponse{
+		UpdateType: ctrlv1.UpdateType_ERROR,
+		Error: &ctrlv1.UpdateError{
+			IceUpdateType: msg.GetUpdateType(),
+			PeerId:        msg.GetPeerId(),
+			Message:       err.Error(),
+		},
+	}
+}
+
+// deliverPeerUpdate delivers an update the peer must not miss, closing its
+// update stream if the channel is full
+func (c *Controller) deliverPeerUpdate(id uint32, update *ctrlv1.UpdateResponse) {
+	if pc, ok := c.peerChannels.Load(id); ok {
+		pc.(*peerChannel).deliver(update)
+	}
+}
+
+// sendPeerUpdate delivers an update to a peer without blocking, reporting
+// false if the peer has no update stream or its channel is full
+func (c *Controller) sendPeerUpdate(id uint32, update *ctrlv1.UpdateResponse) bool {
 	pc, ok := c.peerChannels.Load(id)
-	if ok {
-		pc.(chan *ctrlv1.UpdateResponse) <- update
+	if !ok {
+		return false
 	}
+	return pc.(*peerChannel).send(update)
 }
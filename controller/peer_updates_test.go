@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"testing"
+
+	ctrlv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+)
+
+func fillPeerChannel(t *testing.T, pc *peerChannel) {
+	for range cap(pc.ch) {
+		if !pc.send(&ctrlv1.UpdateResponse{UpdateType: ctrlv1.UpdateType_ICE}) {
+			t.Fatal("send failed before the channel was full")
+		}
+	}
+}
+
+func TestPeerChannelDropsSignaling(t *testing.T) {
+	pc := &peerChannel{ch: make(chan *ctrlv1.UpdateResponse, 4)}
+	fillPeerChannel(t, pc)
+
+	if pc.send(&ctrlv1.UpdateResponse{UpdateType: ctrlv1.UpdateType_ICE}) {
+		t.Fatal("signaling was queued on a full channel")
+	}
+	if pc.closed {
+		t.Fatal("dropping signaling closed the channel")
+	}
+}
+
+func TestPeerChannelClosesWhenFull(t *testing.T) {
+	c := &Controller{}
+	pc := c.GetPeerUpdateChannel(2)
+	fillPeerChannel(t, pc)
+
+	c.broadcastPeerUpdate(1, &ctrlv1.UpdateResponse{UpdateType: ctrlv1.UpdateType_DISCONNECT})
+
+	// The stream drains what was queued, then ends so the peer resyncs
+	for range cap(pc.ch) {
+		if update := <-pc.ch; update.GetUpdateType() != ctrlv1.UpdateType_ICE {
+			t.Fatalf("queued update = %s, want ICE", update.GetUpdateType())
+		}
+	}
+	if _, ok := <-pc.ch; ok {
+		t.Fatal("update channel of a slow peer was not closed")
+	}
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/caldog20/zeronet/controller/types"
+)
+
+// PeerPolicy decides whether a peer may connect to another. Signaling and
+// relayed packets between peers the policy rejects are not forwarded
+type PeerPolicy func(from, to *types.Peer) error
+
+// DefaultPeerPolicy allows peers on the same overlay network to connect
+func DefaultPeerPolicy(from, to *types.Peer) error {
+	if from.Prefix != to.Prefix {
+		return errors.New("peers are on different networks")
+	}
+	return nil
+}
+
+// SetPeerPolicy replaces the policy used to authorize connections between peers
+func (c *Controller) SetPeerPolicy(policy PeerPolicy) {
+	c.policy = policy
+}
+
+// authorizePeerConnection checks that both peers are active and the policy
+// allows the sender to reach the target
+func (c *Controller) authorizePeerConnection(fromID, toID uint32) error {
+	sender := c.db.GetPeerbyID(fromID)
+	if sender == nil || sender.IsDisabled() || !sender.IsLoggedIn() {
+		return errors.New("sender is not allowed to connect")
+	}
+
+	target := c.db.GetPeerbyID(toID)
+	if target == nil {
+		return fmt.Errorf("peer %d does not exist", toID)
+	}
+	if target.IsDisabled() {
+		return fmt.Errorf("peer %d is disabled", target.ID)
+	}
+	if !target.IsLoggedIn() {
+		return fmt.Errorf("peer %d is not logged in", target.ID)
+	}
+	if err := c.policy(sender, target); err != nil {
+		return fmt.Errorf("peer %d is not allowed: %w", target.ID, err)
+	}
+	return nil
+}
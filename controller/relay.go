@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuthenticateRelayPeer authorizes a relay client by its machine ID with the
+// same checks as the update stream and returns its peer ID
+func (c *Controller) AuthenticateRelayPeer(machineID string) (uint32, error) {
+	if !validateMachineID(machineID) {
+		return 0, errors.New("invalid machine ID")
+	}
+
+	peer := c.db.GetPeerByMachineID(machineID)
+	if peer == nil {
+		return 0, errors.New("peer with machine id is not registered")
+	}
+	if peer.IsAuthExpired() {
+		return 0, errors.New("peer auth is expired, needs new login")
+	}
+	if peer.IsDisabled() {
+		return 0, errors.New("peer is currently disabled")
+	}
+	if !peer.IsLoggedIn() {
+		return 0, errors.New("peer requires login first")
+	}
+
+	return peer.ID, nil
+}
+
+// AllowRelayPeers applies the peer policy to packets relayed from src to dst,
+// so the relay can't reach peers that signaling would refuse
+func (c *Controller) AllowRelayPeers(src, dst uint32) bool {
+	if err := c.authorizePeerConnection(src, dst); err != nil {
+		log.Debugf("denied relaying from peer %d: %s", src, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	ctrlv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+)
+
+type TurnServer struct {
+	URL        string
+	Username   string
+	Credential string
+	// Expires is when the credentials stop being valid, zero for static credentials
+	Expires time.Time
+}
+
+// NetworkSettings are network wide defaults pushed to nodes on login.
+// Nodes may override any of these in their local config
+type NetworkSettings struct {
+	MTU         uint32
+	StunServers []string
+	TurnServers []TurnServer
+	DNSServers  []string
+	LogLevel    string
+	RelayURL    string
+}
+
+// MTU limits accepted by nodes, larger packets don't fit in their buffers once sealed
+const (
+	MinMTU = 576
+	MaxMTU = 1568
+)
+
+// Validate checks the settings are usable by nodes
+func (s *NetworkSettings) Validate() error {
+	if s.MTU != 0 && (s.MTU < MinMTU || s.MTU > MaxMTU) {
+		return fmt.Errorf("mtu %d must be between %d and %d", s.MTU, MinMTU, MaxMTU)
+	}
+	return nil
+}
+
+func (s *NetworkSettings) Proto() *ctrlv1.NetworkSettings {
+	if s == nil {
+		return nil
+	}
+
+	settings := &ctrlv1.NetworkSettings{
+		Mtu:         s.MTU,
+		StunServers: s.StunServers,
+		DnsServers:  s.DNSServers,
+		LogLevel:    s.LogLevel,
+		RelayUrl:    s.RelayURL,
+	}
+	for _, t := range s.TurnServers {
+		ts := &ctrlv1.TurnServer{
+			Url:        t.URL,
+			Username:   t.Username,
+			Credential: t.Credential,
+		}
+		if !t.Expires.IsZero() {
+			ts.Expires = t.Expires.Unix()
+		}
+		settings.TurnServers = append(settings.TurnServers, ts)
+	}
+
+	return settings
+}
+
+// PeerSettings returns the network settings for a peer, adding the embedded
+// STUN/TURN servers with credentials issued to the peer when enabled.
+// dialedHost is the controller host the peer connected to
+func (c *Controller) PeerSettings(peerID uint32, dialedHost string) *ctrlv1.NetworkSettings {
+	if c.turn == nil {
+		return c.settings.Proto()
+	}
+
+	settings := NetworkSettings{}
+	if c.settings != nil {
+		settings = *c.settings
+	}
+
+	stun, turns, err := c.turn.Servers(peerID, dialedHost)
+	if err != nil {
+		log.Errorf("error issuing turn credentials for peer %d: %s", peerID, err)
+		return settings.Proto()
+	}
+	// Embedded servers are preferred over any configured externally
+	settings.StunServers = append(stun, settings.StunServers...)
+	settings.TurnServers = append(turns, settings.TurnServers...)
+
+	return settings.Proto()
+}
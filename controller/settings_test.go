@@ -0,0 +1,12 @@
+package controller
+
+import "testing"
+
+func TestNetworkSettingsValidateMTU(t *testing.T) {
+	for mtu, valid := range map[uint32]bool{0: true, MinMTU: true, 1400: true, MaxMTU: true, 100: false, MaxMTU + 1: false, 9000: false} {
+		err := (&NetworkSettings{MTU: mtu}).Validate()
+		if (err == nil) != valid {
+			t.Errorf("mtu %d: validate error = %v, want valid %t", mtu, err, valid)
+		}
+	}
+}
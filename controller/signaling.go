@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ctrlv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// How long ICE signaling is held for a peer that is not receiving updates
+	SignalingQueueTTL = time.Second * 10
+	// Maximum signaling messages held per peer, the oldest are dropped first
+	SignalingQueueSize = 64
+	// Interval held signaling is retried at
+	SignalingRetryInterval = time.Second
+	// Signaling messages per second accepted from a peer, bursts of up to
+	// SignalingRateBurst cover restarting ICE with many peers at once
+	SignalingRateLimit = 100
+	SignalingRateBurst = 500
+)
+
+// signalQueues holds ICE signaling for peers that are briefly unreachable, for
+// example while their update stream reconnects. Held messages are delivered in
+// order once the peer is reachable again. Senders of messages that expire are
+// told the peer is offline so they don't wait on an answer that won't come
+type signalQueues struct {
+	mu     sync.Mutex
+	queues map[uint32]*signalQueue
+	// Delivers an update to a peer without blocking, reporting false if it
+	// can't be delivered right now
+	send func(id uint32, update *ctrlv1.UpdateResponse) bool
+}
+
+type signalQueue struct {
+	signals []queuedSignal
+	timer   *time.Timer
+}
+
+type queuedSignal struct {
+	from   uint32
+	update *ctrlv1.UpdateResponse
+	queued time.Time
+}
+
+func newSignalQueues(send func(id uint32, update *ctrlv1.UpdateResponse) bool) *signalQueues {
+	return &signalQueues{
+		queues: make(map[uint32]*signalQueue),
+		send:   send,
+	}
+}
+
+// Send delivers a signaling update from one peer to another, holding it if
+// the target can't take it right now
+func (s *signalQueues) Send(from, to uint32, update *ctrlv1.UpdateResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queues[to]
+	// Nothing may overtake signaling that is already held
+	if q == nil && s.send(to, update) {
+		return
+	}
+
+	if q == nil {
+		q = &signalQueue{}
+		q.timer = time.AfterFunc(SignalingRetryInterval, func() {
+			s.Deliver(to)
+		})
+		s.queues[to] = q
+	}
+	if len(q.signals) >= SignalingQueueSize {
+		log.Debugf("signaling queue for peer %d full, dropping oldest message", to)
+		q.signals = q.signals[1:]
+	}
+	q.signals = append(q.signals, queuedSignal{from: from, update: update, queued: time.Now()})
+}
+
+// Deliver sends the signaling held for a peer and expires anything older than
+// SignalingQueueTTL that still can't be delivered
+func (s *signalQueues) Deliver(to uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queues[to]
+	if q == nil {
+		return
+	}
+
+	for len(q.signals) > 0 && s.send(to, q.signals[0].update) {
+		q.signals = q.signals[1:]
+	}
+
+	now := time.Now()
+	notified := make(map[uint32]bool)
+	for len(q.signals) > 0 && now.Sub(q.signals[0].queued) >= SignalingQueueTTL {
+		from := q.signals[0].from
+		q.signals = q.signals[1:]
+		if !notified[from] {
+			notified[from] = true
+			log.Debugf("signaling from peer %d to peer %d expired, peer is offline", from, to)
+			s.send(from, peerOfflineUpdate(to))
+		}
+	}
+
+	if len(q.signals) == 0 {
+		q.timer.Stop()
+		delete(s.queues, to)
+		return
+	}
+	q.timer.Reset(SignalingRetryInterval)
+}
+
+func peerOfflineUpdate(id uint32) *ctrlv1.UpdateResponse {
+	return &ctrlv1.UpdateResponse{
+		UpdateType: ctrlv1.UpdateType_ICE,
+		IceUpdate: &ctrlv1.IceUpdate{
+			UpdateType: ctrlv1.IceUpdateType_OFFLINE,
+			PeerId:     id,
+		},
+	}
+}
+
+// signalingLimiter rate limits the signaling sent by a single peer
+type signalingLimiter struct {
+	limiter *rate.Limiter
+	// Set while messages are dropped, so the sender is only told once
+	limited atomic.Bool
+}
+
+// allowSignaling reports whether a signaling message from the peer is within
+// its rate limit, and whether this is the first message dropped since the
+// peer was last within it
+func (c *Controller) allowSignaling(id uint32) (allowed bool, first bool) {
+	v, _ := c.signalLimiters.LoadOrStore(id, &signalingLimiter{
+		limiter: rate.NewLimiter(SignalingRateLimit, SignalingRateBurst),
+	})
+	l := v.(*signalingLimiter)
+
+	if l.limiter.Allow() {
+		l.limited.Store(false)
+		return true, false
+	}
+	return false, l.limited.CompareAndSwap(false, true)
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pion/turn/v3"
+)
+
+const (
+	DefaultTurnRealm          = "zeronet"
+	DefaultTurnCredentialsTTL = time.Hour
+)
+
+// TurnService is the STUN/TURN server embedded in the controller.
+// Nodes are issued short-lived TURN REST style credentials signed with a
+// secret generated at startup, so credentials don't outlive the controller process
+type TurnService struct {
+	server *turn.Server
+	secret string
+	port   int
+	// Host advertised to nodes, empty uses the host the node dialed the controller with
+	host string
+	ttl  time.Duration
+}
+
+// NewTurnService starts a STUN/TURN server on conn. Relayed allocations are
+// advertised to peers on relayIP
+func NewTurnService(conn net.PacketConn, host string, relayIP net.IP, ttl time.Duration) (*TurnService, error) {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("turn server requires a udp listener")
+	}
+	if relayIP == nil {
+		return nil, errors.New("turn relay ip is required")
+	}
+	if ttl <= 0 {
+		ttl = DefaultTurnCredentialsTTL
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secret := base64.StdEncoding.EncodeToString(key)
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       DefaultTurnRealm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: conn,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: relayIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TurnService{
+		server: server,
+		secret: secret,
+		port:   addr.Port,
+		host:   host,
+		ttl:    ttl,
+	}, nil
+}
+
+// Servers returns the STUN and TURN servers for a peer, with TURN credentials
+// bound to the peer ID. dialedHost is used when no host is advertised
+func (t *TurnService) Servers(peerID uint32, dialedHost string) ([]string, []TurnServer, error) {
+	host := t.host
+	if host == "" {
+		host = dialedHost
+	}
+	if host == "" {
+		return nil, nil, errors.New("no turn host to advertise")
+	}
+	hostport := net.JoinHostPort(host, strconv.Itoa(t.port))
+
+	expires := time.Now().Add(t.ttl)
+	username, password, err := turn.GenerateLongTermTURNRESTCredentials(
+		t.secret,
+		strconv.FormatUint(uint64(peerID), 10),
+		t.ttl,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stun := []string{fmt.Sprintf("stun:%s", hostport)}
+	turns := []TurnServer{{
+		URL:        fmt.Sprintf("turn:%s?transport=udp", hostport),
+		Username:   username,
+		Credential: password,
+		Expires:    expires,
+	}}
+	return stun, turns, nil
+}
+
+func (t *TurnService) Close() error {
+	return t.server.Close()
+}
+
+// DefaultRelayIP returns the first global unicast IPv4 address of the host,
+// used for TURN relay allocations when no address is configured
+func DefaultRelayIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil && ip.IsGlobalUnicast() {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no usable ipv4 address for turn relay")
+}
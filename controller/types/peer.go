@@ -106,16 +106,16 @@ func (p *Peer) IsDisabled() bool {
 // 	return true
 // }
 
-func (p *Peer) IsAuthExpired() bool {
-	now := time.Now()
-	// get duration passed since last auth until now
-	duration := now.Sub(p.LastAuth)
+// How long a peer's authentication is valid before it has to reauthenticate
+const AuthLifetime = time.Hour * 24 * 30
 
-	// Get days from duration
-	days := duration.Hours() / 24
+func (p *Peer) IsAuthExpired() bool {
+	return !time.Now().Before(p.AuthExpiry())
+}
 
-	// if 30+ days have passed, auth is expired
-	return days >= 30
+// AuthExpiry returns when the peer's authentication expires
+func (p *Peer) AuthExpiry() time.Time {
+	return p.LastAuth.Add(AuthLifetime)
 }
 
 func (p *Peer) UpdateAuth() {
@@ -2,15 +2,25 @@ package controller
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
 	"regexp"
 	"strings"
 
+	"github.com/pion/ice/v3"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+
+	ctrlv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
 )
 
-const MachineIDLen = 64
+const (
+	MachineIDLen = 64
+	PublicKeyLen = 32
+)
 
 var alphanumeric = regexp.MustCompile("^[a-zA-Z0-9_]*$")
 
@@ -25,6 +35,66 @@ func validateMachineID(id string) bool {
 	return true
 }
 
+func validatePublicKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return false
+	}
+
+	return len(decoded) == PublicKeyLen
+}
+
+var iceChars = regexp.MustCompile("^[a-zA-Z0-9+/]*$")
+
+const (
+	// Bounds from RFC 8445 section 5.3
+	iceUfragMinLen = 4
+	icePwdMinLen   = 22
+	iceCredsMaxLen = 256
+	// Longest candidate attribute accepted for forwarding
+	iceCandidateMaxLen = 512
+)
+
+func validateIceCredentials(ufrag, pwd string) bool {
+	if len(ufrag) < iceUfragMinLen || len(ufrag) > iceCredsMaxLen || !iceChars.MatchString(ufrag) {
+		return false
+	}
+	if len(pwd) < icePwdMinLen || len(pwd) > iceCredsMaxLen || !iceChars.MatchString(pwd) {
+		return false
+	}
+	return true
+}
+
+func validateCandidate(candidate string) error {
+	if len(candidate) > iceCandidateMaxLen {
+		return errors.New("candidate too long")
+	}
+	c, err := ice.UnmarshalCandidate(candidate)
+	if err != nil {
+		return fmt.Errorf("malformed candidate: %w", err)
+	}
+	if c.Port() == 0 || c.Address() == "" {
+		return errors.New("candidate has no usable address")
+	}
+	return nil
+}
+
+// validateIceUpdate checks the payload of a signaling message from a peer
+func validateIceUpdate(msg *ctrlv1.IceUpdate) error {
+	switch msg.GetUpdateType() {
+	case ctrlv1.IceUpdateType_OFFER, ctrlv1.IceUpdateType_ANSWER:
+		if !validateIceCredentials(msg.GetUfrag(), msg.GetPwd()) {
+			return errors.New("invalid ice credentials")
+		}
+	case ctrlv1.IceUpdateType_CANDIDATE:
+		return validateCandidate(msg.GetCandidate())
+	case ctrlv1.IceUpdateType_RESET:
+	default:
+		return fmt.Errorf("ice update type %s can't be sent by peers", msg.GetUpdateType())
+	}
+	return nil
+}
+
 func extractTokenMetadata(ctx context.Context) (string, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
@@ -43,3 +113,22 @@ func extractTokenMetadata(ctx context.Context) (string, error) {
 
 	return token[1], nil
 }
+
+// extractDialedHost returns the controller host the client used to connect,
+// taken from the request authority
+func extractDialedHost(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md[":authority"]
+	if len(values) == 0 {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(values[0])
+	if err != nil {
+		return values[0]
+	}
+	return host
+}
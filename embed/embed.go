@@ -0,0 +1,230 @@
+// Package embed lets a Go program join the network as its own node without a
+// system daemon or tun device. Traffic is handled by a userspace network stack
+// and exposed through the standard net interfaces
+//
+//	srv := embed.New(embed.Options{Hostname: "api", AccessToken: token})
+//	defer srv.Close()
+//	l, err := srv.Listen("tcp", ":8080")
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caldog20/machineid"
+	"github.com/caldog20/zeronet/node"
+	"github.com/caldog20/zeronet/node/tun"
+)
+
+// Options configures an embedded node. Zero values use the same defaults as the node daemon
+type Options struct {
+	// Controller address in <ip:port> format
+	Controller string
+	// Hostname of the node on the network, defaults to the program name
+	Hostname string
+	// StateDir stores the node keypair and login session, defaults to a
+	// per hostname directory under the user config directory
+	StateDir string
+	// AccessToken registers the node with the controller on first login.
+	// It isn't needed once the login session is stored in StateDir
+	AccessToken string
+
+	Port        uint16
+	MTU         int
+	KeyRotation time.Duration
+	StunServers []string
+	LogLevel    string
+}
+
+// Server is a node running inside the program
+type Server struct {
+	opts Options
+
+	mu      sync.Mutex
+	node    *node.Node
+	tun     *tun.NetTun
+	started bool
+	closed  bool
+}
+
+func New(opts Options) *Server {
+	return &Server{opts: opts}
+}
+
+// config builds the node config for the embedded node
+func (s *Server) config() (*node.Config, error) {
+	hostname := s.opts.Hostname
+	if hostname == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("error getting default hostname: %w", err)
+		}
+		hostname = filepath.Base(exe)
+	}
+
+	stateDir := s.opts.StateDir
+	if stateDir == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("error getting default state directory: %w", err)
+		}
+		stateDir = filepath.Join(dir, "zeronet", hostname)
+	}
+
+	// Each embedded node is a separate peer, so the machine ID is
+	// derived from the hostname as well as the host
+	machineID, err := machineid.ProtectedID("Zeronet/" + hostname)
+	if err != nil {
+		return nil, fmt.Errorf("error generating machine ID: %w", err)
+	}
+
+	config := node.DefaultConfig()
+	config.Controller = s.opts.Controller
+	config.Hostname = hostname
+	config.MachineID = machineID
+	config.StateDir = stateDir
+	config.Port = s.opts.Port
+	config.MTU = s.opts.MTU
+	config.KeyRotation = s.opts.KeyRotation
+	config.StunServers = s.opts.StunServers
+	config.LogLevel = s.opts.LogLevel
+	config.Userspace = true
+	return config, nil
+}
+
+// Start logs in to the controller and brings the node up.
+// Listen and Dial start the node if it isn't already running
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startLocked(ctx)
+}
+
+func (s *Server) startLocked(ctx context.Context) error {
+	if s.closed {
+		return net.ErrClosed
+	}
+	if s.started {
+		return nil
+	}
+
+	if s.node == nil {
+		config, err := s.config()
+		if err != nil {
+			return err
+		}
+		s.node, err = node.NewNode(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Resume a stored login session before falling back to the access token
+	if err := s.node.Resume(ctx); err != nil && s.opts.AccessToken == "" {
+		return err
+	}
+	if !s.node.LoggedIn() {
+		if s.opts.AccessToken == "" {
+			return errors.New("node is not logged in and no access token was provided")
+		}
+		if err := s.node.LoginWithToken(ctx, s.opts.AccessToken); err != nil {
+			return fmt.Errorf("error logging in: %w", err)
+		}
+	}
+
+	if err := s.node.Start(); err != nil {
+		return err
+	}
+
+	netTun, err := s.node.UserspaceTun()
+	if err != nil {
+		s.node.Stop()
+		return err
+	}
+
+	s.tun = netTun
+	s.started = true
+	return nil
+}
+
+func (s *Server) up() (*tun.NetTun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.startLocked(context.Background()); err != nil {
+		return nil, err
+	}
+	return s.tun, nil
+}
+
+// Listen announces on the node's overlay address. Only tcp networks are supported
+func (s *Server) Listen(network, address string) (net.Listener, error) {
+	t, err := s.up()
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(network, address)
+}
+
+// ListenPacket listens for udp packets on the node's overlay address
+func (s *Server) ListenPacket(network, address string) (net.PacketConn, error) {
+	t, err := s.up()
+	if err != nil {
+		return nil, err
+	}
+	return t.ListenPacket(network, address)
+}
+
+// Dial connects to address on the network. The host may be a peer IP,
+// hostname or ID
+func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	t, err := s.up()
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = netip.ParseAddr(host); err != nil {
+		ip, found := s.node.LookupPeerIP(host)
+		if !found {
+			return nil, fmt.Errorf("unknown peer %s", host)
+		}
+		address = net.JoinHostPort(ip.String(), port)
+	}
+
+	return t.DialContext(ctx, network, address)
+}
+
+// IP returns the node's overlay address once started
+func (s *Server) IP() netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.node == nil {
+		return netip.Addr{}
+	}
+	return s.node.IP()
+}
+
+// Close brings the node down and closes the controller connection
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.started = false
+	if s.node == nil {
+		return nil
+	}
+	return s.node.Close()
+}
@@ -0,0 +1,120 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caldog20/zeronet/controller"
+	"github.com/caldog20/zeronet/controller/db"
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// startController runs a controller with authentication disabled, so any
+// access token registers a peer
+func startController(t *testing.T) string {
+	store, err := db.New(filepath.Join(t.TempDir(), "store.db"), log.WithField("type", "gorm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No STUN servers so nodes only gather host candidates
+	ctrl := controller.NewController(store, netip.MustParsePrefix("100.70.0.0/24"), &controller.NetworkSettings{})
+	server := grpc.NewServer()
+	controllerv1.RegisterControllerServiceServer(server, controller.NewGRPCServer(ctrl, nil, false))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return l.Addr().String()
+}
+
+func newTestServer(t *testing.T, controller, hostname string) *Server {
+	srv := New(Options{
+		Controller:  controller,
+		Hostname:    hostname,
+		StateDir:    t.TempDir(),
+		AccessToken: "token",
+	})
+	t.Cleanup(func() { srv.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestServerListenDial(t *testing.T) {
+	addr := startController(t)
+	server := newTestServer(t, addr, "embed-server")
+	client := newTestServer(t, addr, "embed-client")
+
+	l, err := server.Listen("tcp", ":8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// The client learns about the server from the controller update stream
+	var c net.Conn
+	for {
+		c, err = client.Dial(ctx, "tcp", "embed-server:8080")
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("error dialing server: %s", err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	c.SetDeadline(time.Now().Add(time.Second * 10))
+
+	msg := []byte("hello over the overlay")
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != string(msg) {
+		t.Fatalf("reply = %q, want %q", reply, msg)
+	}
+	c.Close()
+
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Listen("tcp", ":8081"); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("listen after close = %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -2,12 +2,15 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"runtime"
 	"strings"
 
 	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
@@ -24,16 +27,64 @@ func cleanup(server *http.Server) {
 	go server.Close()
 }
 
-func AuthFlow(info *nodev1.LoginResponse) (string, error) {
-	conf := &oauth2.Config{
+func oauthConfig(info *nodev1.LoginResponse) *oauth2.Config {
+	return &oauth2.Config{
 		ClientID: info.GetClientId(),
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  info.GetAuthEndpoint(),
-			TokenURL: info.GetTokenEndpoint(),
+			AuthURL:       info.GetAuthEndpoint(),
+			TokenURL:      info.GetTokenEndpoint(),
+			DeviceAuthURL: info.GetDeviceAuthEndpoint(),
+			// Nodes are public clients without a secret, so the client ID
+			// goes in the form instead of probing for the auth style
+			AuthStyle: oauth2.AuthStyleInParams,
 		},
 		RedirectURL: info.GetRedirectUri(),
 		Scopes:      []string{"openid profile email offline_access"},
 	}
+}
+
+// CanOpenBrowser reports whether a browser can be opened for the redirect login
+// flow. SSH sessions and hosts without a graphical display can't open one
+func CanOpenBrowser() bool {
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		return false
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return true
+	default:
+		return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	}
+}
+
+// DeviceAuthFlow logs in with the OAuth 2.0 device authorization grant. The user
+// opens the verification URL on any device with a browser and enters the code
+// while the node polls the token endpoint until the login completes
+func DeviceAuthFlow(ctx context.Context, info *nodev1.LoginResponse, out io.Writer) (*oauth2.Token, error) {
+	if info.GetDeviceAuthEndpoint() == "" {
+		return nil, errors.New("identity provider doesn't support device login")
+	}
+	conf := oauthConfig(info)
+
+	da, err := conf.DeviceAuth(ctx, oauth2.SetAuthURLParam("audience", info.GetAudience()))
+	if err != nil {
+		return nil, fmt.Errorf("error requesting device code: %w", err)
+	}
+
+	fmt.Fprintf(out, "To log in, open %s and enter code: %s\n", da.VerificationURI, da.UserCode)
+	if da.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "Or open %s to log in without entering the code\n", da.VerificationURIComplete)
+	}
+
+	tok, err := conf.DeviceAccessToken(ctx, da)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for device login: %w", err)
+	}
+	return tok, nil
+}
+
+func AuthFlow(info *nodev1.LoginResponse) (*oauth2.Token, error) {
+	conf := oauthConfig(info)
 
 	verifier := oauth2.GenerateVerifier()
 	auth_url := conf.AuthCodeURL(
@@ -83,14 +134,14 @@ func AuthFlow(info *nodev1.LoginResponse) (string, error) {
 	// parse the redirect URL for the port number
 	u, err := url.Parse(info.GetRedirectUri())
 	if err != nil {
-		return "", fmt.Errorf("bad redirect URL: %s\n", err)
+		return nil, fmt.Errorf("bad redirect URL: %s\n", err)
 	}
 
 	// set up a listener on the redirect port
 	port := fmt.Sprintf(":%s", u.Port())
 	l, err := net.Listen("tcp", port)
 	if err != nil {
-		return "", fmt.Errorf("can't listen to port %s: %s\n", port, err)
+		return nil, fmt.Errorf("can't listen to port %s: %s\n", port, err)
 	}
 
 	// open a browser window to the authorizationURL
@@ -103,5 +154,8 @@ func AuthFlow(info *nodev1.LoginResponse) (string, error) {
 	// start the blocking web server loop
 	// this will exit when the handler gets fired and calls server.Close()
 	server.Serve(l)
-	return tok.AccessToken, nil
+	if tok == nil {
+		return nil, errors.New("login did not complete")
+	}
+	return tok, nil
 }
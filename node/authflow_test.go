@@ -0,0 +1,164 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+)
+
+// mockIdP implements the device authorization and token endpoints of an
+// OAuth 2.0 provider. The token endpoint reports the login as pending until
+// it has been polled pending times. Refresh tokens are rotated on every use
+type mockIdP struct {
+	*httptest.Server
+	pending  int32
+	polls    atomic.Int32
+	audience atomic.Value
+
+	mu      sync.Mutex
+	refresh string
+	issued  int
+}
+
+func newMockIdP(t *testing.T, pending int32) *mockIdP {
+	idp := &mockIdP{pending: pending}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/device/code", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "node" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		idp.audience.Store(r.Form.Get("audience"))
+		writeJSON(w, http.StatusOK, map[string]any{
+			"device_code":               "device-code",
+			"user_code":                 "ABCD-EFGH",
+			"verification_uri":          idp.URL + "/activate",
+			"verification_uri_complete": idp.URL + "/activate?user_code=ABCD-EFGH",
+			"expires_in":                60,
+			"interval":                  1,
+		})
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") == "refresh_token" {
+			idp.handleRefresh(w, r)
+			return
+		}
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" ||
+			r.Form.Get("device_code") != "device-code" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant"})
+			return
+		}
+		if idp.polls.Add(1) <= idp.pending {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "authorization_pending"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token":  "access-token",
+			"refresh_token": idp.rotateRefreshToken(),
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) rotateRefreshToken() string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.issued++
+	idp.refresh = fmt.Sprintf("refresh-%d", idp.issued)
+	return idp.refresh
+}
+
+func (idp *mockIdP) currentRefreshToken() string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.refresh
+}
+
+func (idp *mockIdP) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Form.Get("client_id") != "node" || r.Form.Get("refresh_token") != idp.currentRefreshToken() {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  "refreshed-token",
+		"refresh_token": idp.rotateRefreshToken(),
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (idp *mockIdP) loginInfo() *nodev1.LoginResponse {
+	return &nodev1.LoginResponse{
+		Status:             "need access token",
+		ClientId:           "node",
+		TokenEndpoint:      idp.URL + "/oauth/token",
+		DeviceAuthEndpoint: idp.URL + "/oauth/device/code",
+		Audience:           "zeronet",
+	}
+}
+
+func TestDeviceAuthFlow(t *testing.T) {
+	idp := newMockIdP(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var out strings.Builder
+	token, err := DeviceAuthFlow(ctx, idp.loginInfo(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access-token" || token.RefreshToken != "refresh-1" {
+		t.Fatalf("token = %q %q, want access-token refresh-1", token.AccessToken, token.RefreshToken)
+	}
+	if n := idp.polls.Load(); n != 2 {
+		t.Fatalf("token endpoint polled %d times, want 2", n)
+	}
+	if aud := idp.audience.Load(); aud != "zeronet" {
+		t.Fatalf("audience = %v, want zeronet", aud)
+	}
+	if !strings.Contains(out.String(), idp.URL+"/activate") || !strings.Contains(out.String(), "ABCD-EFGH") {
+		t.Fatalf("verification url and user code not printed: %q", out.String())
+	}
+}
+
+func TestDeviceAuthFlowCanceled(t *testing.T) {
+	// Login is never approved
+	idp := newMockIdP(t, 1<<30)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*1500)
+	defer cancel()
+
+	var out strings.Builder
+	if _, err := DeviceAuthFlow(ctx, idp.loginInfo(), &out); err == nil {
+		t.Fatal("expected an error when the login is not approved")
+	}
+}
+
+func TestDeviceAuthFlowUnsupported(t *testing.T) {
+	info := &nodev1.LoginResponse{ClientId: "node", TokenEndpoint: "http://127.0.0.1/oauth/token"}
+	if _, err := DeviceAuthFlow(context.Background(), info, &strings.Builder{}); err == nil {
+		t.Fatal("expected an error without a device authorization endpoint")
+	}
+}
@@ -0,0 +1,39 @@
+package node
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff produces exponentially growing delays with jitter so nodes that lost
+// the controller at the same moment don't reconnect in lockstep
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max}
+}
+
+// Next returns the delay before the next attempt. The delay doubles each
+// attempt up to max, and a random half of it is jittered away
+func (b *backoff) Next() time.Duration {
+	d := b.max
+	// Stop shifting before the duration overflows
+	if b.attempt < 32 {
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Reset starts the delays over from min
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
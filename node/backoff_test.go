@@ -0,0 +1,26 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	b := newBackoff(time.Second, time.Minute)
+
+	want := time.Second
+	for i := 0; i < 100; i++ {
+		d := b.Next()
+		if d < want/2 || d > want {
+			t.Fatalf("attempt %d: delay %s outside [%s, %s]", i, d, want/2, want)
+		}
+		if want < time.Minute {
+			want = min(want*2, time.Minute)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Fatalf("delay after reset = %s, want at most 1s", d)
+	}
+}
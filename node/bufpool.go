@@ -7,11 +7,19 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/caldog20/zeronet/noiseconn"
 	"github.com/caldog20/zeronet/pkg/header"
 )
 
 const BufferSize = 1600
 
+// Tunnel MTU limits. Sealed packets carry the header and a 16 byte
+// authentication tag, and must still fit in a buffer
+const (
+	MinMTU = 576
+	MaxMTU = BufferSize - header.HeaderLen - 16
+)
+
 type InboundBuffer struct {
 	in     []byte         // Raw data from UDP Socket
 	packet []byte         // Allocated for decrypted data
@@ -19,6 +27,13 @@ type InboundBuffer struct {
 	size   int            // size of data read from UDP socket
 	header *header.Header // preallocated header
 	//peer   *Peer          // Peer this index belongs to
+
+	// Pipeline state, lock is held until the buffer has been decrypted
+	lock      sync.Mutex
+	nc        *noiseconn.Conn
+	opener    noiseconn.Opener
+	plaintext []byte
+	err       error
 }
 
 type OutboundBuffer struct {
@@ -27,6 +42,13 @@ type OutboundBuffer struct {
 	size   int            // size of data read from tunnel interface
 	header *header.Header // preallocated header
 	//peer   *Peer          // Peer this index belongs to
+
+	// Pipeline state, lock is held until the buffer has been encrypted
+	lock   sync.Mutex
+	nc     *noiseconn.Conn
+	sealer noiseconn.Sealer
+	sealed []byte
+	err    error
 }
 
 var (
@@ -60,6 +82,10 @@ func PutInboundBuffer(buffer *InboundBuffer) {
 	buffer.raddr = nil
 	buffer.size = 0
 	buffer.header.Reset()
+	buffer.nc = nil
+	buffer.opener = noiseconn.Opener{}
+	buffer.plaintext = nil
+	buffer.err = nil
 	//buffer.peer = nil
 
 	InboundBuffers.Put(buffer)
@@ -89,6 +115,10 @@ func PutOutboundBuffer(buffer *OutboundBuffer) {
 	buffer.size = 0
 	//buffer.peer = nil
 	buffer.header.Reset()
+	buffer.nc = nil
+	buffer.sealer = noiseconn.Sealer{}
+	buffer.sealed = nil
+	buffer.err = nil
 
 	OutboundBuffers.Put(buffer)
 	OBuffersInUse.Add(^uint64(0))
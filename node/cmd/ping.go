@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func NewPingCommand() *cobra.Command {
+	var (
+		count    int
+		interval time.Duration
+		timeout  time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "ping <peer>",
+		Short: "send in-band probes to a peer by id, overlay ip or hostname",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, close := getManagementClient()
+			defer close()
+
+			return ping(client, args[0], count, interval, timeout)
+		},
+	}
+
+	cmd.Flags().IntVarP(&count, "count", "c", 4, "number of probes to send")
+	cmd.Flags().DurationVarP(&interval, "interval", "i", time.Second, "interval between probes")
+	cmd.Flags().DurationVarP(&timeout, "timeout", "t", time.Second*5, "time to wait for each reply")
+	return cmd
+}
+
+func ping(client nodev1.NodeServiceClient, peer string, count int, interval, timeout time.Duration) error {
+	received := 0
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := client.Ping(ctx, &nodev1.PingRequest{Peer: peer})
+		cancel()
+		if err != nil {
+			st, _ := status.FromError(err)
+			switch st.Code() {
+			case codes.DeadlineExceeded:
+				fmt.Printf("probe %d to %s: timeout\n", i+1, peer)
+				continue
+			default:
+				return fmt.Errorf("%s", st.Message())
+			}
+		}
+
+		received++
+		rtt := time.Duration(resp.GetRtt()) * time.Microsecond
+		path := resp.GetPathType()
+		if resp.GetLocalCandidateType() != "" {
+			path = fmt.Sprintf("%s (%s/%s)", path, resp.GetLocalCandidateType(), resp.GetRemoteCandidateType())
+		}
+
+		line := fmt.Sprintf(
+			"reply from %s (%s): probe=%d time=%s path=%s",
+			resp.GetHostname(),
+			resp.GetIp(),
+			i+1,
+			rtt,
+			path,
+		)
+		if resp.GetNewConnection() {
+			line += " new connection"
+		}
+		fmt.Println(line)
+	}
+
+	fmt.Printf("%d probes sent, %d replies received\n", count, received)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/caldog20/zeronet/node"
 	_ "github.com/kardianos/service"
 	"github.com/spf13/cobra"
 )
@@ -41,6 +42,9 @@ var (
 	}
 )
 
+// Overrides the management socket from the config file
+var managementSocket string
+
 func init() {
 	rootCmd.AddCommand(NewUpCommand())
 	rootCmd.AddCommand(NewDownCommand())
@@ -51,7 +55,15 @@ func init() {
 	rootCmd.AddCommand(NewStopCommand())
 	rootCmd.AddCommand(NewGenerateKeypairCommand())
 	rootCmd.AddCommand(NewLoginCommand())
+	rootCmd.AddCommand(NewLogoutCommand())
+	rootCmd.AddCommand(NewRotateKeyCommand())
+	rootCmd.AddCommand(NewStatusCommand())
+	rootCmd.AddCommand(NewPingCommand())
 
+	rootCmd.PersistentFlags().
+		StringVar(&configPath, "config", node.DefaultConfigPath(), "path to the node config file")
+	rootCmd.PersistentFlags().
+		StringVar(&managementSocket, "socket", "", "path to the management socket - defaults to "+node.DefaultManagementSocket())
 	//rootCmd.PersistentFlags().BoolVar(&profile, "profile", false, "enable pprof profile")
 }
 
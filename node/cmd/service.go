@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"runtime"
 	"time"
 
 	"github.com/caldog20/zeronet/node"
+	"github.com/caldog20/zeronet/node/tun"
 	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
 	"github.com/kardianos/service"
 	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
@@ -20,29 +23,103 @@ import (
 )
 
 var (
-	controller string
-	port       uint16
-	logger     service.Logger
+	configPath  string
+	controller  string
+	port        uint16
+	keyRotation time.Duration
+	stateDir    string
+	userspace   bool
+	socksProxy  string
+	httpProxy   string
+	forwards    []string
+	logger      service.Logger
 )
 
 type program struct {
 	node   *node.Node
 	server *grpc.Server
 	// done   chan struct{}
-	conn net.Listener
+	conn   net.Listener
+	config *node.Config
+}
+
+// loadConfig reads the node config file and applies any flags that were set
+// on the command line over it
+func loadConfig() (*node.Config, error) {
+	config, err := node.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if controller != "" {
+		config.Controller = controller
+	}
+	if port != 0 {
+		config.Port = port
+	}
+	if keyRotation != 0 {
+		config.KeyRotation = keyRotation
+	}
+	if stateDir != "" {
+		config.StateDir = stateDir
+	}
+	if userspace {
+		config.Userspace = true
+	}
+	if socksProxy != "" {
+		config.SocksProxy = socksProxy
+	}
+	if httpProxy != "" {
+		config.HTTPProxy = httpProxy
+	}
+	if managementSocket != "" {
+		config.ManagementSocket = managementSocket
+	}
+	for _, f := range forwards {
+		port, target, err := tun.ParseForward(f)
+		if err != nil {
+			return nil, err
+		}
+		if config.Forward == nil {
+			config.Forward = make(map[uint16]string)
+		}
+		config.Forward[port] = target
+	}
+
+	return config, nil
 }
 
 func (p *program) Start(s service.Service) error {
-	n, err := node.NewNode(controller, port)
+	config, err := loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := grpc.NewServer()
+	n, err := node.NewNode(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Resume the previous login session in the background so the service
+	// doesn't block on the controller during startup
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+		if err := n.Resume(ctx); err != nil {
+			log.Printf("error resuming node: %s", err)
+		}
+	}()
+
+	authorizer, err := node.NewManagementAuthorizer(config.ManagementGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := grpc.NewServer(authorizer.ServerOptions()...)
 	nodev1.RegisterNodeServiceServer(server, n)
 
 	p.server = server
 	p.node = n
+	p.config = config
 	// p.done = make(chan struct{})
 
 	go p.run()
@@ -55,14 +132,25 @@ func (p *program) Stop(s service.Service) error {
 	return err
 }
 
+// run serves the management API on the unix socket, and on TCP if opted in
 func (p *program) run() {
-	conn, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", 55000))
+	sock, err := node.ListenManagementSocket(p.config.ManagementSocket, p.config.ManagementGroup)
 	if err != nil {
-		//logger.Error(err)
 		log.Fatal(err)
-		return
 	}
-	if err := p.server.Serve(conn); !errors.Is(err, grpc.ErrServerStopped) {
+
+	if p.config.ManagementTCP {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.config.ManagementPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go p.serve(l)
+	}
+	p.serve(sock)
+}
+
+func (p *program) serve(l net.Listener) {
+	if err := p.server.Serve(l); !errors.Is(err, grpc.ErrServerStopped) {
 		logger.Error(err)
 	}
 }
@@ -88,11 +176,28 @@ func NewStartCommand() *cobra.Command {
 		},
 	}
 
+	addServiceFlags(cmd)
+	return cmd
+}
+
+// addServiceFlags adds the flags shared by the commands that start the node service
+func addServiceFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().
-		StringVar(&controller, "controller", "127.0.0.1:50000", "controller address in <ip:port> format")
+		StringVar(&controller, "controller", "", "controller address in <ip:port> format - defaults to the last used controller or 127.0.0.1:50000")
 	cmd.PersistentFlags().
 		Uint16Var(&port, "port", 0, "listen port for udp socket - defaults to 0 for randomly selected port")
-	return cmd
+	cmd.PersistentFlags().
+		DurationVar(&keyRotation, "keyrotation", 0, "interval to rotate the node keypair - defaults to 0 for no scheduled rotation")
+	cmd.PersistentFlags().
+		StringVar(&stateDir, "statedir", "", "directory to store node keypair and login state - defaults to "+node.DefaultStateDir())
+	cmd.PersistentFlags().
+		BoolVar(&userspace, "userspace", false, "use a userspace network stack instead of a tun device, no root required")
+	cmd.PersistentFlags().
+		StringVar(&socksProxy, "socks5", "", "listen address for the socks5 proxy into the network in userspace mode")
+	cmd.PersistentFlags().
+		StringVar(&httpProxy, "http-proxy", "", "listen address for the http connect proxy into the network in userspace mode")
+	cmd.PersistentFlags().
+		StringSliceVar(&forwards, "forward", nil, "forward inbound tcp connections in userspace mode in <port>:<host:port> format")
 }
 
 // TODO Fix arguments for service when providing argument for controller address
@@ -110,10 +215,29 @@ func NewService(program service.Interface) (service.Service, error) {
 		Option:      options,
 		Arguments: []string{
 			"run",
+			"--config",
+			configPath,
 			"--controller",
 			controller,
+			"--keyrotation",
+			keyRotation.String(),
+			"--statedir",
+			stateDir,
+			"--socks5",
+			socksProxy,
+			"--http-proxy",
+			httpProxy,
 		},
 	}
+	if userspace {
+		svcConfig.Arguments = append(svcConfig.Arguments, "--userspace")
+	}
+	for _, f := range forwards {
+		svcConfig.Arguments = append(svcConfig.Arguments, "--forward", f)
+	}
+	if managementSocket != "" {
+		svcConfig.Arguments = append(svcConfig.Arguments, "--socket", managementSocket)
+	}
 
 	s, err := service.New(program, svcConfig)
 	return s, err
@@ -136,6 +260,8 @@ func NewUpCommand() *cobra.Command {
 }
 
 func NewLoginCommand() *cobra.Command {
+	var device bool
+
 	cmd := &cobra.Command{
 		Use:   "login",
 		Short: "login",
@@ -143,7 +269,25 @@ func NewLoginCommand() *cobra.Command {
 			client, close := getManagementClient()
 			defer close()
 
-			if err := login(client); err != nil {
+			if err := login(client, device); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVar(&device, "device", false, "log in with a code entered on another device, the default without a display")
+	return cmd
+}
+
+func NewLogoutCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logout",
+		Short: "stops the node and forgets the login session",
+		Run: func(cmd *cobra.Command, args []string) {
+			client, close := getManagementClient()
+			defer close()
+
+			if err := logout(client); err != nil {
 				log.Fatal(err)
 			}
 		},
@@ -167,10 +311,7 @@ func NewRunCommand() *cobra.Command {
 			}
 		},
 	}
-	cmd.PersistentFlags().
-		StringVar(&controller, "controller", "127.0.0.1:50000", "controller address in <ip:port> format")
-	cmd.PersistentFlags().
-		Uint16Var(&port, "port", 0, "listen port for udp socket - defaults to 0 for randomly selected port")
+	addServiceFlags(cmd)
 
 	return cmd
 }
@@ -191,10 +332,7 @@ func NewInstallCommand() *cobra.Command {
 		},
 	}
 
-	cmd.PersistentFlags().
-		StringVar(&controller, "controller", "127.0.0.1:50000", "controller address in <ip:port> format")
-	cmd.PersistentFlags().
-		Uint16Var(&port, "port", 0, "listen port for udp socket - defaults to 0 for randomly selected port")
+	addServiceFlags(cmd)
 	return cmd
 }
 
@@ -249,9 +387,41 @@ func NewDownCommand() *cobra.Command {
 	return cmd
 }
 
+func NewRotateKeyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "rotates the node keypair and propagates the new public key to peers",
+		Run: func(cmd *cobra.Command, args []string) {
+			client, close := getManagementClient()
+			defer close()
+
+			if err := rotateKey(client); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	return cmd
+}
+
+// getManagementClient connects to the node service over the management socket,
+// falling back to the TCP listener if it's enabled and the socket isn't there
 func getManagementClient() (nodev1.NodeServiceClient, func()) {
+	config, err := node.LoadConfig(configPath)
+	if err != nil {
+		config = node.DefaultConfig()
+	}
+	if managementSocket != "" {
+		config.ManagementSocket = managementSocket
+	}
+
+	target := "unix:" + config.ManagementSocket
+	if _, err := os.Stat(config.ManagementSocket); err != nil && config.ManagementTCP {
+		target = fmt.Sprintf("127.0.0.1:%d", config.ManagementPort)
+	}
+
 	conn, err := grpc.NewClient(
-		"127.0.0.1:55000",
+		target,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 	)
 	if err != nil {
@@ -276,7 +446,7 @@ func up(client nodev1.NodeServiceClient) error {
 			return err
 		}
 		if st.Code() == codes.PermissionDenied {
-			if err := login(client); err != nil {
+			if err := login(client, false); err != nil {
 				return err
 			}
 			up, err = client.Up(ctx, &nodev1.UpRequest{})
@@ -303,7 +473,36 @@ func down(client nodev1.NodeServiceClient) error {
 	return nil
 }
 
-func login(client nodev1.NodeServiceClient) error {
+func logout(client nodev1.NodeServiceClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	logout, err := client.Logout(ctx, &nodev1.LogoutRequest{})
+	if err != nil {
+		return err
+	}
+	log.Println(logout.GetStatus())
+
+	return nil
+}
+
+func rotateKey(client nodev1.NodeServiceClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	rotate, err := client.RotateKey(ctx, &nodev1.RotateKeyRequest{})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s - new public key: %s", rotate.GetStatus(), rotate.GetPublicKey())
+
+	return nil
+}
+
+// login logs the node in, authenticating with the identity provider if the node
+// isn't registered. Device login is used when requested or when no browser
+// can be opened and the provider supports it
+func login(client nodev1.NodeServiceClient, device bool) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
@@ -316,14 +515,27 @@ func login(client nodev1.NodeServiceClient) error {
 	if st == "login successful" {
 		log.Println("node login successful")
 	} else if st == "need access token" {
-		token, err := node.AuthFlow(login)
+		var token *oauth2.Token
+		if device || (!node.CanOpenBrowser() && login.GetDeviceAuthEndpoint() != "") {
+			token, err = node.DeviceAuthFlow(context.Background(), login, os.Stdout)
+		} else {
+			token, err = node.AuthFlow(login)
+		}
 		if err != nil {
 			return err
 		}
-		login, err = client.Login(ctx, &nodev1.LoginRequest{AccessToken: token})
+
+		// Authenticating can outlast the first request's timeout
+		tokenCtx, tokenCancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer tokenCancel()
+		login, err = client.Login(tokenCtx, &nodev1.LoginRequest{
+			AccessToken:  token.AccessToken,
+			RefreshToken: token.RefreshToken,
+		})
 		if err != nil {
 			return err
 		}
+		log.Println(login.GetStatus())
 	}
 	return nil
 }
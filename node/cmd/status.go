@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func NewStatusCommand() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "show node and peer connection status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, close := getManagementClient()
+			defer close()
+
+			return showStatus(client, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "output status as json")
+	return cmd
+}
+
+func showStatus(client nodev1.NodeServiceClient, jsonOutput bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	st, err := client.Status(ctx, &nodev1.StatusRequest{})
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		out, err := protojson.MarshalOptions{Multiline: true, EmitUnpopulated: true}.Marshal(st)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	printStatus(st)
+	return nil
+}
+
+func printStatus(st *nodev1.StatusResponse) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Logged in:\t%t\n", st.GetLoggedIn())
+	fmt.Fprintf(w, "Running:\t%t\n", st.GetRunning())
+	fmt.Fprintf(w, "Hostname:\t%s\n", st.GetHostname())
+	fmt.Fprintf(w, "Peer ID:\t%d\n", st.GetPeerId())
+	fmt.Fprintf(w, "Tunnel IP:\t%s\n", valueOrNone(st.GetTunnelIp()))
+	fmt.Fprintf(w, "Public key:\t%s\n", st.GetPublicKey())
+	fmt.Fprintf(w, "Controller:\t%s (%s)\n", st.GetController(), controllerState(st))
+	if st.GetControllerError() != "" {
+		fmt.Fprintf(w, "Controller error:\t%s\n", st.GetControllerError())
+	}
+	w.Flush()
+
+	if len(st.GetPeers()) == 0 {
+		fmt.Println("\nNo peers")
+		return
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "ID\tHOSTNAME\tIP\tICE\tPATH\tHANDSHAKE\tLAST RX\tLAST TX\tRX\tTX")
+	for _, p := range st.GetPeers() {
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			p.GetId(),
+			p.GetHostname(),
+			p.GetIp(),
+			p.GetIceState(),
+			pathType(p),
+			since(p.GetLastHandshake()),
+			since(p.GetLastRx()),
+			since(p.GetLastTx()),
+			formatBytes(p.GetRxBytes()),
+			formatBytes(p.GetTxBytes()),
+		)
+	}
+	w.Flush()
+}
+
+// pathType describes the selected candidate pair, relay if either side is relayed
+func pathType(p *nodev1.PeerStatus) string {
+	if p.GetRelayed() {
+		return "controller relay"
+	}
+	local, remote := p.GetLocalCandidateType(), p.GetRemoteCandidateType()
+	if local == "" || remote == "" {
+		return "-"
+	}
+	if local == "relay" || remote == "relay" {
+		return "relay"
+	}
+	return fmt.Sprintf("%s/%s", local, remote)
+}
+
+// controllerState describes the update stream state and how long it has lasted
+func controllerState(st *nodev1.StatusResponse) string {
+	state := st.GetControllerState()
+	if retry := st.GetControllerRetryAt(); retry != 0 {
+		if wait := time.Until(time.Unix(retry, 0)); wait > 0 {
+			return fmt.Sprintf("%s in %s", state, wait.Round(time.Second))
+		}
+		return state
+	}
+	if changed := st.GetControllerStateSince(); changed != 0 && state == "connected" {
+		return fmt.Sprintf("%s for %s", state, time.Since(time.Unix(changed, 0)).Round(time.Second))
+	}
+	return state
+}
+
+func since(unix int64) string {
+	if unix == 0 {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(time.Unix(unix, 0)).Round(time.Second))
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func valueOrNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
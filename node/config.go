@@ -0,0 +1,109 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultController     = "127.0.0.1:50000"
+	DefaultManagementPort = 55000
+	ConfigFileName        = "node.yaml"
+)
+
+var DefaultStunServers = []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+	"stun:stun.services.mozilla.com:3478",
+	"stun:stun.siptraffic.com:3478",
+}
+
+// Config holds local node settings loaded from the node config file.
+// MTU, StunServers and LogLevel left unset fall back to the network defaults
+// pushed by the controller, then to the built-in defaults
+type Config struct {
+	Controller     string        `yaml:"Controller"`
+	Port           uint16        `yaml:"Port"`
+	ManagementPort uint16        `yaml:"ManagementPort"`
+	StateDir       string        `yaml:"StateDir"`
+	KeyRotation    time.Duration `yaml:"KeyRotation"`
+	MTU            int           `yaml:"MTU"`
+	StunServers    []string      `yaml:"StunServers"`
+	LogLevel       string        `yaml:"LogLevel"`
+	// The management API is served on a unix socket. Members of
+	// ManagementGroup may use privileged operations like the service user.
+	// ManagementTCP also serves it on 127.0.0.1:ManagementPort, where clients
+	// can't be identified and are limited to read-only operations. On Windows
+	// the socket's directory is restricted to SYSTEM and Administrators
+	ManagementSocket string `yaml:"ManagementSocket"`
+	ManagementGroup  string `yaml:"ManagementGroup"`
+	ManagementTCP    bool   `yaml:"ManagementTCP"`
+	// Hostname and MachineID override the OS hostname and the machine ID
+	// derived from the host, so several nodes can run on the same machine
+	Hostname  string `yaml:"Hostname"`
+	MachineID string `yaml:"MachineID"`
+	// Relay overrides the relay URL pushed by the controller
+	Relay string `yaml:"Relay"`
+
+	// Userspace runs the tunnel on a userspace network stack, which needs no
+	// tun device or root. The overlay is then reached through the local proxies
+	Userspace  bool   `yaml:"Userspace"`
+	SocksProxy string `yaml:"SocksProxy"`
+	HTTPProxy  string `yaml:"HTTPProxy"`
+	// Inbound TCP ports on the overlay IP forwarded to local addresses in userspace mode
+	Forward map[uint16]string `yaml:"Forward"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ManagementPort:   DefaultManagementPort,
+		ManagementSocket: DefaultManagementSocket(),
+		StateDir:         DefaultStateDir(),
+	}
+}
+
+// DefaultConfigPath returns the OS specific path of the node config file
+func DefaultConfigPath() string {
+	switch runtime.GOOS {
+	case "linux":
+		return filepath.Join("/etc/zeronet", ConfigFileName)
+	default:
+		return filepath.Join(DefaultStateDir(), ConfigFileName)
+	}
+}
+
+// LoadConfig reads the config file at path over the defaults.
+// A missing config file is not an error and returns the defaults
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("error opening config file: %w", err)
+	}
+	defer f.Close()
+
+	err = yaml.NewDecoder(f).Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding config file: %w", err)
+	}
+
+	if config.ManagementPort == 0 {
+		config.ManagementPort = DefaultManagementPort
+	}
+	if config.ManagementSocket == "" {
+		config.ManagementSocket = DefaultManagementSocket()
+	}
+
+	return config, nil
+}
@@ -0,0 +1,169 @@
+package conn
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// BatchSize is the maximum number of datagrams read or written per syscall
+	BatchSize = 64
+	// Largest datagram the ICE mux reads, matching its receive MTU
+	muxReceiveMTU = 8192
+)
+
+// Message is a single datagram in a batch
+type Message struct {
+	// Buffer holds the datagram. For reads its length is the capacity available
+	Buffer []byte
+	// Number of bytes in Buffer
+	N    int
+	Addr *net.UDPAddr
+}
+
+// ReadBatch reads up to len(msgs) datagrams, blocking until at least one is
+// available. It uses recvmmsg and UDP GRO on Linux and a single read elsewhere
+func (conn *Conn) ReadBatch(msgs []Message) (int, error) {
+	return conn.readBatch(msgs)
+}
+
+// WriteBatch writes msgs, returning the number written. On Linux the batch is
+// sent with sendmmsg, and runs of equal sized datagrams to the same address
+// are coalesced with UDP GSO
+func (conn *Conn) WriteBatch(msgs []Message) (int, error) {
+	return conn.writeBatch(msgs)
+}
+
+// PacketConn returns a net.PacketConn for the ICE UDP mux. Reads are served from
+// batches and writes are queued and flushed in batches by a writer goroutine, so
+// the mux and every peer sending through it share syscalls
+func (conn *Conn) PacketConn() net.PacketConn {
+	bc := &batchConn{
+		Conn:   conn,
+		tx:     make(chan *Message, BatchSize*4),
+		closed: make(chan struct{}),
+	}
+	bc.rx.msgs = make([]Message, BatchSize)
+	for i := range bc.rx.msgs {
+		bc.rx.msgs[i].Buffer = make([]byte, muxReceiveMTU)
+	}
+	go bc.writeRoutine()
+	return bc
+}
+
+var messagePool = sync.Pool{New: func() any {
+	return &Message{Buffer: make([]byte, 0, 2048)}
+}}
+
+type batchConn struct {
+	*Conn
+
+	rx struct {
+		l    sync.Mutex
+		msgs []Message
+		n, i int
+	}
+
+	tx        chan *Message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (bc *batchConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	bc.rx.l.Lock()
+	defer bc.rx.l.Unlock()
+
+	if bc.rx.i >= bc.rx.n {
+		n, err := bc.ReadBatch(bc.rx.msgs)
+		if err != nil {
+			return 0, nil, err
+		}
+		bc.rx.n, bc.rx.i = n, 0
+	}
+
+	msg := &bc.rx.msgs[bc.rx.i]
+	bc.rx.i++
+	return copy(p, msg.Buffer[:msg.N]), msg.Addr, nil
+}
+
+// WriteTo queues p for the writer goroutine. UDP is unreliable anyway, so send
+// errors are not reported back to the caller
+func (bc *batchConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, net.InvalidAddrError("not a udp address")
+	}
+
+	msg := messagePool.Get().(*Message)
+	msg.Buffer = append(msg.Buffer[:0], p...)
+	msg.N = len(p)
+	msg.Addr = udpAddr
+
+	select {
+	case bc.tx <- msg:
+		return len(p), nil
+	case <-bc.closed:
+		messagePool.Put(msg)
+		return 0, net.ErrClosed
+	}
+}
+
+func (bc *batchConn) writeRoutine() {
+	pending := make([]*Message, 0, BatchSize)
+	batch := make([]Message, 0, BatchSize)
+
+	for {
+		select {
+		case msg := <-bc.tx:
+			pending = append(pending, msg)
+		case <-bc.closed:
+			return
+		}
+
+		// Take whatever else is already queued without waiting
+	drain:
+		for len(pending) < BatchSize {
+			select {
+			case msg := <-bc.tx:
+				pending = append(pending, msg)
+			default:
+				break drain
+			}
+		}
+
+		for _, msg := range pending {
+			batch = append(batch, *msg)
+		}
+		for sent := 0; sent < len(batch); {
+			n, err := bc.WriteBatch(batch[sent:])
+			if err != nil {
+				// Skip the datagram that failed and carry on with the rest
+				n++
+			}
+			sent += n
+		}
+
+		for i, msg := range pending {
+			msg.Addr = nil
+			messagePool.Put(msg)
+			pending[i] = nil
+		}
+		pending = pending[:0]
+		clear(batch)
+		batch = batch[:0]
+	}
+}
+
+func (bc *batchConn) Close() error {
+	bc.closeOnce.Do(func() { close(bc.closed) })
+	return bc.Conn.Close()
+}
+
+func (bc *batchConn) SetDeadline(t time.Time) error {
+	return bc.uc.SetDeadline(t)
+}
+
+func (bc *batchConn) SetWriteDeadline(t time.Time) error {
+	return bc.uc.SetWriteDeadline(t)
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package conn
+
+func (conn *Conn) setupOffload() {}
+
+// readBatch reads a single datagram, batching syscalls is only supported on Linux
+func (conn *Conn) readBatch(msgs []Message) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	n, addr, err := conn.uc.ReadFromUDP(msgs[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N = n
+	msgs[0].Addr = addr
+	return 1, nil
+}
+
+func (conn *Conn) writeBatch(msgs []Message) (int, error) {
+	for i := range msgs {
+		_, err := conn.uc.WriteToUDP(msgs[i].Buffer[:msgs[i].N], msgs[i].Addr)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
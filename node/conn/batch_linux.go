@@ -0,0 +1,253 @@
+package conn
+
+import (
+	"errors"
+	"log"
+	"net"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Kernel limits for a single UDP GSO send
+	maxGSOSegments = 64
+	maxGSOSize     = 65507
+	// Number of coalesced datagrams read per recvmmsg when GRO is enabled
+	groBatchSize = 16
+	groBufSize   = 65535
+)
+
+// setupOffload enables UDP GRO and checks for UDP GSO support. Either can be
+// missing on older kernels, in which case plain recvmmsg/sendmmsg are used
+func (conn *Conn) setupOffload() {
+	rc, err := conn.uc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var groErr, gsoErr error
+	err = rc.Control(func(fd uintptr) {
+		groErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+		_, gsoErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+	})
+	if err != nil {
+		return
+	}
+
+	conn.gro = groErr == nil
+	conn.gso.Store(gsoErr == nil)
+}
+
+func (conn *Conn) readBatch(msgs []Message) (int, error) {
+	conn.rx.l.Lock()
+	defer conn.rx.l.Unlock()
+
+	if !conn.gro {
+		return conn.readDirect(msgs)
+	}
+
+	// Refill from the socket once all datagrams from the last read are handed out
+	if conn.rx.i >= conn.rx.n {
+		if conn.rx.msgs == nil {
+			conn.rx.msgs = make([]ipv4.Message, groBatchSize)
+			conn.rx.seg = make([]int, groBatchSize)
+			for i := range conn.rx.msgs {
+				conn.rx.msgs[i].Buffers = [][]byte{make([]byte, groBufSize)}
+				conn.rx.msgs[i].OOB = make([]byte, unix.CmsgSpace(4))
+			}
+		}
+
+		n, err := conn.pc.ReadBatch(conn.rx.msgs, 0)
+		if err != nil {
+			return 0, err
+		}
+		for i := range n {
+			conn.rx.seg[i] = groSegmentSize(conn.rx.msgs[i].OOB[:conn.rx.msgs[i].NN])
+		}
+		conn.rx.n, conn.rx.i, conn.rx.off = n, 0, 0
+	}
+
+	// Split coalesced datagrams into the caller's messages
+	count := 0
+	for count < len(msgs) && conn.rx.i < conn.rx.n {
+		m := &conn.rx.msgs[conn.rx.i]
+		seg := conn.rx.seg[conn.rx.i]
+		if seg <= 0 {
+			seg = m.N
+		}
+		end := min(conn.rx.off+seg, m.N)
+
+		msgs[count].N = copy(msgs[count].Buffer, m.Buffers[0][conn.rx.off:end])
+		msgs[count].Addr, _ = m.Addr.(*net.UDPAddr)
+		count++
+
+		conn.rx.off = end
+		if conn.rx.off >= m.N {
+			conn.rx.i++
+			conn.rx.off = 0
+		}
+	}
+
+	return count, nil
+}
+
+// readDirect reads straight into the caller's buffers with recvmmsg
+func (conn *Conn) readDirect(msgs []Message) (int, error) {
+	if cap(conn.rx.msgs) < len(msgs) {
+		conn.rx.msgs = make([]ipv4.Message, len(msgs))
+		for i := range conn.rx.msgs {
+			conn.rx.msgs[i].Buffers = make([][]byte, 1)
+		}
+	}
+	batch := conn.rx.msgs[:len(msgs)]
+	for i := range msgs {
+		batch[i].Buffers[0] = msgs[i].Buffer
+	}
+
+	n, err := conn.pc.ReadBatch(batch, 0)
+	for i := range n {
+		msgs[i].N = batch[i].N
+		msgs[i].Addr, _ = batch[i].Addr.(*net.UDPAddr)
+	}
+	for i := range batch {
+		batch[i].Buffers[0] = nil
+		batch[i].Addr = nil
+	}
+	return n, err
+}
+
+func groSegmentSize(oob []byte) int {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level == unix.SOL_UDP && cmsg.Header.Type == unix.UDP_GRO && len(cmsg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&cmsg.Data[0])))
+		}
+	}
+	return 0
+}
+
+func (conn *Conn) writeBatch(msgs []Message) (int, error) {
+	conn.tx.l.Lock()
+	defer conn.tx.l.Unlock()
+
+	gso := conn.gso.Load()
+	n, err := conn.writeBatchLocked(msgs, gso)
+	// EIO means the device can't segment, fall back to plain sendmmsg
+	if err != nil && gso && errors.Is(err, unix.EIO) {
+		log.Printf("udp gso failed, disabling: %s", err)
+		conn.gso.Store(false)
+		var m int
+		m, err = conn.writeBatchLocked(msgs[n:], false)
+		n += m
+	}
+	return n, err
+}
+
+// writeBatchLocked returns the number of msgs sent before any error
+func (conn *Conn) writeBatchLocked(msgs []Message, gso bool) (int, error) {
+	conn.buildWriteBatch(msgs, gso)
+	defer conn.resetWriteBatch()
+
+	sent := 0
+	for sent < len(conn.tx.msgs) {
+		n, err := conn.pc.WriteBatch(conn.tx.msgs[sent:], 0)
+		if err != nil {
+			return conn.tx.ranges[sent][0], err
+		}
+		sent += n
+	}
+	return len(msgs), nil
+}
+
+// buildWriteBatch fills conn.tx.msgs from msgs. With GSO, consecutive datagrams to
+// the same address where all but the last have equal size are sent as one
+func (conn *Conn) buildWriteBatch(msgs []Message, gso bool) {
+	if conn.tx.oob == nil {
+		conn.tx.oob = make([]byte, 0, maxGSOSegments*unix.CmsgSpace(2))
+	}
+
+	coalesced := 0
+	for i := 0; i < len(msgs); {
+		m := &msgs[i]
+		j := i + 1
+		if gso && m.N > 0 {
+			size := m.N
+			for j < len(msgs) && j-i < maxGSOSegments {
+				next := &msgs[j]
+				if next.N > m.N || size+next.N > maxGSOSize || !sameAddr(next.Addr, m.Addr) {
+					break
+				}
+				size += next.N
+				j++
+				if next.N < m.N {
+					break
+				}
+			}
+		}
+
+		msg := ipv4.Message{Addr: m.Addr}
+		if j-i == 1 {
+			msg.Buffers = [][]byte{m.Buffer[:m.N]}
+		} else {
+			if coalesced == len(conn.tx.bufs) {
+				conn.tx.bufs = append(conn.tx.bufs, make([]byte, 0, groBufSize))
+			}
+			buf := conn.tx.bufs[coalesced][:0]
+			for k := i; k < j; k++ {
+				buf = append(buf, msgs[k].Buffer[:msgs[k].N]...)
+			}
+			conn.tx.bufs[coalesced] = buf
+			coalesced++
+
+			msg.Buffers = [][]byte{buf}
+			msg.OOB = conn.appendSegmentSize(m.N)
+		}
+
+		conn.tx.msgs = append(conn.tx.msgs, msg)
+		conn.tx.ranges = append(conn.tx.ranges, [2]int{i, j})
+		i = j
+	}
+}
+
+// appendSegmentSize appends a UDP_SEGMENT control message to the shared oob buffer
+func (conn *Conn) appendSegmentSize(size int) []byte {
+	start := len(conn.tx.oob)
+	if start+unix.CmsgSpace(2) > cap(conn.tx.oob) {
+		// Earlier messages keep the old backing array
+		conn.tx.oob = make([]byte, 0, 2*cap(conn.tx.oob))
+		start = 0
+	}
+	conn.tx.oob = conn.tx.oob[:start+unix.CmsgSpace(2)]
+	oob := conn.tx.oob[start:]
+	clear(oob)
+
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	hdr.Level = unix.SOL_UDP
+	hdr.Type = unix.UDP_SEGMENT
+	hdr.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(size)
+
+	return oob
+}
+
+func (conn *Conn) resetWriteBatch() {
+	clear(conn.tx.msgs)
+	conn.tx.msgs = conn.tx.msgs[:0]
+	conn.tx.ranges = conn.tx.ranges[:0]
+	conn.tx.oob = conn.tx.oob[:0]
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,102 @@
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newLoopbackPair(t *testing.T) (*Conn, *Conn, *net.UDPAddr) {
+	t.Helper()
+	c1, err := NewConn(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewConn(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	port := c2.LocalAddr().(*net.UDPAddr).Port
+	return c1, c2, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func testDatagram(i, size int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, size)
+}
+
+func TestConnBatch(t *testing.T) {
+	c1, c2, addr := newLoopbackPair(t)
+	t.Logf("gro: %v gso: %v", c2.gro, c1.gso.Load())
+
+	// Equal sized datagrams followed by a short one exercise GSO coalescing and GRO splitting
+	var sent []Message
+	for i := range 40 {
+		sent = append(sent, Message{Buffer: testDatagram(i, 1200), N: 1200, Addr: addr})
+	}
+	sent = append(sent, Message{Buffer: testDatagram(40, 100), N: 100, Addr: addr})
+
+	n, err := c1.WriteBatch(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(sent) {
+		t.Fatalf("wrote %d messages, expected %d", n, len(sent))
+	}
+
+	recv := make([]Message, BatchSize)
+	for i := range recv {
+		recv[i].Buffer = make([]byte, 2048)
+	}
+
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := 0
+	for received < len(sent) {
+		n, err := c2.ReadBatch(recv)
+		if err != nil {
+			t.Fatalf("read batch after %d datagrams: %s", received, err)
+		}
+		for _, msg := range recv[:n] {
+			want := sent[received]
+			if !bytes.Equal(msg.Buffer[:msg.N], want.Buffer[:want.N]) {
+				t.Fatalf("datagram %d mismatch: got %d bytes", received, msg.N)
+			}
+			if msg.Addr.Port != c1.LocalAddr().(*net.UDPAddr).Port {
+				t.Fatalf("unexpected source address %s", msg.Addr)
+			}
+			received++
+		}
+	}
+}
+
+func TestConnPacketConn(t *testing.T) {
+	c1, c2, addr := newLoopbackPair(t)
+	pc1 := c1.PacketConn()
+	pc2 := c2.PacketConn()
+	defer pc1.Close()
+	defer pc2.Close()
+
+	const count = 64
+	go func() {
+		for i := range count {
+			pc1.WriteTo(testDatagram(i, 1000), addr)
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	pc2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := range count {
+		n, _, err := pc2.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read %d: %s", i, err)
+		}
+		if !bytes.Equal(buf[:n], testDatagram(i, 1000)) {
+			t.Fatalf("datagram %d out of order or corrupt", i)
+		}
+	}
+}
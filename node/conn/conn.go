@@ -2,7 +2,11 @@ package conn
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/ipv4"
 )
 
 const (
@@ -11,6 +15,39 @@ const (
 
 type Conn struct {
 	uc *net.UDPConn
+	pc *ipv4.PacketConn
+
+	// UDP offloads, only enabled on Linux when supported by the kernel
+	gro bool
+	gso atomic.Bool
+
+	rx struct {
+		l sync.Mutex
+		// Scratch messages handed to recvmmsg
+		msgs []ipv4.Message
+		// Coalesced GRO datagrams not yet returned to the caller
+		seg       []int
+		n, i, off int
+	}
+
+	tx struct {
+		l    sync.Mutex
+		msgs []ipv4.Message
+		// Message index ranges covered by each entry in msgs
+		ranges [][2]int
+		// Buffers for coalescing GSO datagrams
+		bufs [][]byte
+		oob  []byte
+	}
+}
+
+func newConn(uc *net.UDPConn) *Conn {
+	conn := &Conn{
+		uc: uc,
+		pc: ipv4.NewPacketConn(uc),
+	}
+	conn.setupOffload()
+	return conn
 }
 
 func (conn *Conn) GetConn() *net.UDPConn {
@@ -22,9 +59,15 @@ func (conn *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	return n, err
 }
 
+// ReadFromUDP reads a single datagram. It goes through the batch path so
+// coalesced GRO datagrams are split correctly
 func (conn *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
-	n, raddr, err := conn.uc.ReadFromUDP(b)
-	return n, raddr, err
+	msgs := [1]Message{{Buffer: b}}
+	_, err := conn.ReadBatch(msgs[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	return msgs[0].N, msgs[0].Addr, nil
 }
 
 func (conn *Conn) LocalAddr() net.Addr {
@@ -19,7 +19,5 @@ func NewConn(port uint16) (*Conn, error) {
 		return nil, err
 	}
 
-	conn := &Conn{uc: udpconn}
-
-	return conn, nil
+	return newConn(udpconn), nil
 }
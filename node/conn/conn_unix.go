@@ -36,9 +36,5 @@ func NewConn(port uint16) (*Conn, error) {
 		return nil, errors.New("error casting ListenPacket into UDP Conn")
 	}
 
-	conn := &Conn{
-		uc: udpconn,
-	}
-
-	return conn, nil
+	return newConn(udpconn), nil
 }
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
@@ -18,69 +21,170 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// Backoff between update stream attempts, a stream that stayed connected for
+// StreamStableDuration starts over from StreamBackoffMin
+const (
+	StreamBackoffMin     = time.Second
+	StreamBackoffMax     = time.Minute
+	StreamStableDuration = time.Second * 30
+	StreamConnectTimeout = time.Second * 10
+)
+
+// ErrAuthExpired is returned when the controller rejects the node's auth
+var ErrAuthExpired = errors.New("controller auth expired")
+
+// StreamState is the state of the controller update stream
+type StreamState int32
+
+const (
+	// Node isn't running, no stream is wanted
+	StreamIdle StreamState = iota
+	// Waiting for the controller connection and the initial peer list
+	StreamConnecting
+	// Initial peer list received, updates are flowing
+	StreamConnected
+	// Stream failed, waiting to reconnect
+	StreamBackoff
+)
+
+func (s StreamState) String() string {
+	switch s {
+	case StreamIdle:
+		return "idle"
+	case StreamConnecting:
+		return "connecting"
+	case StreamConnected:
+		return "connected"
+	case StreamBackoff:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// StreamStatus is a snapshot of the update stream state
+type StreamStatus struct {
+	State StreamState
+	// When the stream entered the state
+	Since time.Time
+	// When the next attempt is made while backing off
+	RetryAt time.Time
+	// Error that ended the last stream, nil once connected again
+	Err error
+}
+
 type ControllerClient struct {
 	client    controllerv1.ControllerServiceClient
 	conn      *grpc.ClientConn
 	rxUpdates chan *controllerv1.UpdateResponse
 	txUpdates chan *controllerv1.UpdateRequest
+	// Closed by Close. The update channels stay open so routines still
+	// running during shutdown can't send on a closed channel
+	done      chan struct{}
+	closeOnce sync.Once
+
+	stream struct {
+		l      sync.Mutex
+		status StreamStatus
+	}
+	// Renews the node's auth when the controller rejects the stream, nil
+	// if the node can't reauthenticate on its own
+	reauth func(ctx context.Context) error
 }
 
+// NewControllerClient creates a client for the controller at address. The
+// connection is made lazily, so the node can start and resume its last
+// session while the controller is unreachable
 func NewControllerClient(address string) (*ControllerClient, error) {
-	dialCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	conn, err := grpc.DialContext(
-		dialCtx,
+	conn, err := grpc.NewClient(
 		address,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
 	)
 	if err != nil {
-		return nil, errors.New("error connecting to controller grpc server at: " + address)
+		return nil, fmt.Errorf("error creating controller grpc client for %s: %w", address, err)
 	}
 	rxUpdates := make(chan *controllerv1.UpdateResponse, 5)
 	txUpdates := make(chan *controllerv1.UpdateRequest, 5)
 	client := controllerv1.NewControllerServiceClient(conn)
-	return &ControllerClient{client, conn, rxUpdates, txUpdates}, nil
+	return &ControllerClient{
+		client:    client,
+		conn:      conn,
+		rxUpdates: rxUpdates,
+		txUpdates: txUpdates,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// StreamStatus returns the update stream state for status reporting
+func (c *ControllerClient) StreamStatus() StreamStatus {
+	c.stream.l.Lock()
+	defer c.stream.l.Unlock()
+	return c.stream.status
+}
+
+func (c *ControllerClient) setStreamState(state StreamState, err error, retryAt time.Time) {
+	c.stream.l.Lock()
+	defer c.stream.l.Unlock()
+	c.stream.status = StreamStatus{
+		State:   state,
+		Since:   time.Now(),
+		RetryAt: retryAt,
+		Err:     err,
+	}
 }
 
 func (c *ControllerClient) Close() error {
-	close(c.rxUpdates)
-	close(c.txUpdates)
-	return c.conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+	})
+	return err
 }
 
-func (c *ControllerClient) waitForConnectivityReady(ctx context.Context) bool {
-	if c.conn.GetState() == connectivity.Ready {
+func (c *ControllerClient) closed() bool {
+	select {
+	case <-c.done:
 		return true
-	} else {
+	default:
+		return false
+	}
+}
+
+// waitForConnectivityReady blocks until the controller connection is ready or
+// the context is done. gRPC reconnects the underlying connection on its own
+func (c *ControllerClient) waitForConnectivityReady(ctx context.Context) error {
+	for {
 		state := c.conn.GetState()
-		if state != connectivity.Connecting {
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return errors.New("controller connection is closed")
+		case connectivity.Idle:
 			c.conn.Connect()
 		}
-		return c.conn.WaitForStateChange(ctx, c.conn.GetState())
+		if !c.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("controller connection not ready: %s", strings.ToLower(state.String()))
+		}
 	}
 }
 
+// ConnectStream opens the update stream once the controller connection is
+// ready, giving up after StreamConnectTimeout
 func (c *ControllerClient) ConnectStream(
 	ctx context.Context,
 ) (controllerv1.ControllerService_UpdateStreamClient, error) {
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, nil
-		default:
-			ready := c.waitForConnectivityReady(ctx)
-			if !ready {
-				log.Println("error connecting to controller grpc server, trying again")
-				continue
-			}
-			stream, err := c.client.UpdateStream(ctx)
-			if err != nil {
-				return nil, err
-			}
-			return stream, nil
+	waitCtx, cancel := context.WithTimeout(ctx, StreamConnectTimeout)
+	defer cancel()
+
+	if err := c.waitForConnectivityReady(waitCtx); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		return nil, err
 	}
+	return c.client.UpdateStream(ctx)
 }
 
 //func (c *ControllerClient) UpdateEndpoint(id string, endpoint string) {
@@ -90,70 +194,155 @@ func (c *ControllerClient) ConnectStream(
 //	}
 //}
 
+// RunUpdateStream keeps the update stream to the controller open until the
+// context is done or the client is closed, reconnecting with backoff whenever it fails. Every new
+// stream starts with an INIT peer list that the node reconciles against
 func (c *ControllerClient) RunUpdateStream(ctx context.Context) {
+	defer c.setStreamState(StreamIdle, nil, time.Time{})
+
+	b := newBackoff(StreamBackoffMin, StreamBackoffMax)
 	for {
+		c.setStreamState(StreamConnecting, nil, time.Time{})
+		connected, err := c.runStream(ctx)
+		if ctx.Err() != nil || c.closed() {
+			return
+		}
+		if connected >= StreamStableDuration {
+			b.Reset()
+		}
+		if errors.Is(err, ErrAuthExpired) && c.reauth != nil {
+			rerr := c.reauth(ctx)
+			if rerr == nil {
+				b.Reset()
+				continue
+			}
+			log.Printf("error reauthenticating with controller: %s", rerr)
+		}
+
+		delay := b.Next()
+		log.Printf("controller update stream failed: %v, reconnecting in %s", err, delay.Round(time.Millisecond))
+		c.setStreamState(StreamBackoff, err, time.Now().Add(delay))
+
+		timer := time.NewTimer(delay)
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return
-		default:
-			stream, err := c.ConnectStream(ctx)
-			if err != nil {
-				log.Printf("error connecting to update stream: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// runStream runs a single update stream until it fails, returning how long it
+// was connected for
+func (c *ControllerClient) runStream(ctx context.Context) (time.Duration, error) {
+	// Either side failing cancels the stream so the other side returns too
+	eg, egCtx := errgroup.WithContext(ctx)
+	stream, err := c.ConnectStream(egCtx)
+	if err != nil {
+		return 0, err
+	}
+
+	eg.Go(func() error {
+		defer stream.CloseSend()
+		for {
+			select {
+			case <-egCtx.Done():
+				return egCtx.Err()
+			case <-c.done:
+				return errors.New("controller client closed")
+			case msg := <-c.txUpdates:
+				if err := stream.Send(msg); err != nil {
+					return fmt.Errorf("error sending update: %w", err)
+				}
 			}
-			eg, egCtx := errgroup.WithContext(ctx)
-
-			eg.Go(func() error {
-				for {
-					select {
-					case <-egCtx.Done():
-						stream.CloseSend()
-						return egCtx.Err()
-					case msg, ok := <-c.txUpdates:
-						if !ok {
-							log.Println("outbound updates channel closed")
-							stream.CloseSend()
-							return errors.New("outbound updates channel closed")
-						}
-						if err := stream.Send(msg); err != nil {
-							log.Printf("error sending stream update response: %v", err)
-							stream.CloseSend()
-							return err
-						}
-					}
+		}
+	})
+
+	// Only read by the receiving routine until Wait returns
+	var connectedAt time.Time
+	eg.Go(func() error {
+		for {
+			response, err := stream.Recv()
+			if err != nil {
+				if egCtx.Err() != nil {
+					return egCtx.Err()
+				}
+				if err == io.EOF {
+					return errors.New("stream closed by controller")
 				}
-			})
-
-			eg.Go(func() error {
-				for {
-					select {
-					case <-egCtx.Done():
-						return egCtx.Err()
-					default:
-						response, err := stream.Recv()
-						// TODO properly handle error
-						if err != nil {
-							code, msg := getErrorFromStatus(err)
-							if code == codes.Canceled {
-								return err
-							} else {
-								log.Printf("error receiving stream update response: %v", msg)
-								return err
-							}
-						}
-						c.rxUpdates <- response
-					}
+				code, msg := getErrorFromStatus(err)
+				if code == codes.Unauthenticated {
+					return fmt.Errorf("%w: %s", ErrAuthExpired, msg)
 				}
-			})
+				return fmt.Errorf("%s: %s", strings.ToLower(code.String()), msg)
+			}
+
+			// The controller sends the INIT peer list first
+			if connectedAt.IsZero() {
+				connectedAt = time.Now()
+				log.Println("connected to controller update stream")
+				c.setStreamState(StreamConnected, nil, time.Time{})
+			}
 
-			eg.Wait()
+			select {
+			case c.rxUpdates <- response:
+			case <-egCtx.Done():
+				return egCtx.Err()
+			case <-c.done:
+				return errors.New("controller client closed")
+			}
 		}
+	})
+
+	err = eg.Wait()
+	if connectedAt.IsZero() {
+		return 0, err
 	}
+	return time.Since(connectedAt), err
 }
 
+// UpdatePeerKey reports a rotated noise public key to the controller
+func (c *ControllerClient) UpdatePeerKey(ctx context.Context, machineID, publicKey string) error {
+	ctx = metadata.AppendToOutgoingContext(
+		ctx,
+		"authorization",
+		fmt.Sprintf("Bearer %s", machineID),
+	)
+
+	_, err := c.client.UpdatePeerKey(ctx, &controllerv1.UpdatePeerKeyRequest{
+		MachineId: machineID,
+		PublicKey: publicKey,
+	})
+	return err
+}
+
+// GetNetworkSettings fetches the current network settings for the node, including
+// newly issued TURN credentials
+func (c *ControllerClient) GetNetworkSettings(ctx context.Context, machineID string) (*controllerv1.NetworkSettings, error) {
+	ctx = metadata.AppendToOutgoingContext(
+		ctx,
+		"authorization",
+		fmt.Sprintf("Bearer %s", machineID),
+	)
+
+	resp, err := c.client.GetNetworkSettings(ctx, &controllerv1.GetNetworkSettingsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetSettings(), nil
+}
+
+// SubmitUpdate queues an update for the controller, dropping it once the
+// client is closed
 func (c *ControllerClient) SubmitUpdate(update *controllerv1.UpdateRequest) {
-	c.txUpdates <- update
+	select {
+	case c.txUpdates <- update:
+	case <-c.done:
+	}
 }
 
 func getErrorFromStatus(err error) (codes.Code, string) {
@@ -165,6 +354,20 @@ func getErrorFromStatus(err error) (codes.Code, string) {
 	}
 }
 
+// controllerUnreachable reports whether err means the controller couldn't be
+// reached in time, rather than that it rejected the request
+func controllerUnreachable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	default:
+		return false
+	}
+}
+
 // TODO: Fix stream auth
 func (node *Node) StartUpdateStream(ctx context.Context) {
 	sCtx := metadata.AppendToOutgoingContext(
@@ -177,26 +380,35 @@ func (node *Node) StartUpdateStream(ctx context.Context) {
 }
 
 func (node *Node) HandleUpdates(ctx context.Context) {
-	for update := range node.grpcClient.rxUpdates {
+	for {
+		var update *controllerv1.UpdateResponse
 		select {
 		case <-ctx.Done():
 			return
-		default:
+		case <-node.grpcClient.done:
+			return
+		case update = <-node.grpcClient.rxUpdates:
 		}
+
 		switch update.UpdateType {
 		case controllerv1.UpdateType_INIT:
 			node.handleInitialSync(update)
 		case controllerv1.UpdateType_CONNECT:
 			node.handlePeerConnectUpdate(update)
 		case controllerv1.UpdateType_DISCONNECT:
-			// node.handlePeerDisconnectUpdate(update)
+			node.handlePeerDisconnectUpdate(update)
+		case controllerv1.UpdateType_DELETE:
+			node.handlePeerDeleteUpdate(update)
 		case controllerv1.UpdateType_LOGOUT:
 			node.handleLogout()
 		case controllerv1.UpdateType_ICE:
 			node.handleIceUpdate(update.GetIceUpdate())
+		case controllerv1.UpdateType_KEY_UPDATE:
+			node.handlePeerKeyUpdate(update)
+		case controllerv1.UpdateType_ERROR:
+			node.handleUpdateError(update.GetError())
 		default:
-			log.Println("unmatched update message type")
-			return
+			log.Printf("unmatched update message type %s", update.UpdateType)
 		}
 	}
 }
@@ -239,6 +451,19 @@ func (node *Node) sendPeerIceAnswer(id uint32, ufrag, pwd string) {
 	node.grpcClient.SubmitUpdate(update)
 }
 
+// sendPeerIceReset tells the remote peer to drop its ICE session, used when
+// the local underlay changed and the current candidate pair is dead
+func (node *Node) sendPeerIceReset(id uint32) {
+	update := &controllerv1.UpdateRequest{
+		UpdateType: controllerv1.UpdateType_ICE,
+		IceUpdate: &controllerv1.IceUpdate{
+			UpdateType: controllerv1.IceUpdateType_RESET,
+			PeerId:     id,
+		},
+	}
+	node.grpcClient.SubmitUpdate(update)
+}
+
 func (node *Node) handleIceUpdate(update *controllerv1.IceUpdate) {
 	peer, found := node.lookupPeer(update.GetPeerId())
 	if !found {
@@ -260,10 +485,50 @@ func (node *Node) handleIceUpdate(update *controllerv1.IceUpdate) {
 			return
 		}
 		peer.iceCandidates <- cand
+	case controllerv1.IceUpdateType_RESET:
+		// Remote underlay changed, it will offer a new connection
+		log.Printf("peer %d reset its ice session", peer.ID)
+		peer.ResetState()
+	case controllerv1.IceUpdateType_OFFLINE:
+		peer.abandonConnectAttempt("peer is offline")
 	default:
 	}
 }
 
+// handleUpdateError handles an update rejected by the controller. A rejected
+// offer or answer means the connection attempt can't succeed
+func (node *Node) handleUpdateError(updateErr *controllerv1.UpdateError) {
+	log.Printf("controller rejected update for peer %d: %s", updateErr.GetPeerId(), updateErr.GetMessage())
+
+	switch updateErr.GetIceUpdateType() {
+	case controllerv1.IceUpdateType_OFFER, controllerv1.IceUpdateType_ANSWER:
+		peer, found := node.lookupPeer(updateErr.GetPeerId())
+		if !found {
+			return
+		}
+		peer.abandonConnectAttempt("signaling rejected by controller")
+	default:
+	}
+}
+
+func (node *Node) handlePeerKeyUpdate(update *controllerv1.UpdateResponse) {
+	for _, rp := range update.GetPeerList().GetPeers() {
+		peer, found := node.lookupPeer(rp.GetId())
+		if !found {
+			log.Printf("peer %d not found for key update", rp.GetId())
+			continue
+		}
+
+		key, err := DecodeBase64Key(rp.GetPublicKey())
+		if err != nil {
+			log.Printf("error decoding updated public key for peer %d: %s", rp.GetId(), err)
+			continue
+		}
+
+		go peer.UpdateRemoteKey(key)
+	}
+}
+
 // TODO Controller is forcing peer to log out
 // Node grpc service should still run, and requires a login/up to start again
 func (node *Node) handleLogout() {
@@ -272,49 +537,108 @@ func (node *Node) handleLogout() {
 		log.Println("error stopping node during logout")
 	}
 	node.loggedIn.Store(false)
+
+	err = node.state.Update(func(s *State) {
+		s.LoggedIn = false
+		s.Running = false
+	})
+	if err != nil {
+		log.Printf("error persisting logout: %s", err)
+	}
 }
 
+// handleInitialSync reconciles known peers against the INIT peer list sent at
+// the start of every update stream. The list holds every peer in the network,
+// peers missing from it were deleted while the stream was down. Peers may also
+// have come, gone offline or changed, and peers stopped by a previous Stop are
+// started again
 func (node *Node) handleInitialSync(update *controllerv1.UpdateResponse) {
-	for _, peer := range update.PeerList.Peers {
-		p, err := node.AddPeer(peer)
-		if err != nil {
-			panic(err)
+	current := make(map[uint32]bool)
+	for _, rp := range update.GetPeerList().GetPeers() {
+		current[rp.GetId()] = true
+		if rp.GetConnected() {
+			node.syncPeer(rp)
 			continue
 		}
-		err = p.Start()
-		if err != nil {
-			panic(err)
+		// Offline peers are only added once they connect
+		if _, found := node.lookupPeer(rp.GetId()); found {
+			node.syncPeer(rp)
+			node.markPeerOffline(rp.GetId())
 		}
 	}
+
+	node.maps.l.RLock()
+	var gone []uint32
+	for id := range node.maps.id {
+		if !current[id] {
+			gone = append(gone, id)
+		}
+	}
+	node.maps.l.RUnlock()
+
+	// Deletes that happened while the stream was down
+	for _, id := range gone {
+		node.RemovePeer(id)
+	}
 }
 
 func (node *Node) handlePeerConnectUpdate(update *controllerv1.UpdateResponse) {
-	if update.PeerList.Count < 1 {
-		return
+	for _, rp := range update.GetPeerList().GetPeers() {
+		node.syncPeer(rp)
 	}
+}
 
-	rp := update.PeerList.Peers[0]
-
-	node.maps.l.RLock()
-	_, found := node.maps.id[rp.Id]
-	node.maps.l.RUnlock()
-	if !found {
-		peer, err := node.AddPeer(rp)
-		if err != nil {
+// syncPeer adds and starts a peer announced by the controller, or applies
+// changed attributes if the peer is already known
+func (node *Node) syncPeer(rp *controllerv1.Peer) {
+	peer, found := node.lookupPeer(rp.GetId())
+	if found {
+		// Peer reconnected, possibly after logging in with new attributes
+		if err := node.UpdatePeer(rp); err != nil {
+			log.Printf("error updating peer %d: %s", rp.GetId(), err)
 			return
 		}
-		err = peer.Start()
+	} else {
+		var err error
+		peer, err = node.AddPeer(rp)
 		if err != nil {
-			panic(err)
+			log.Printf("error adding peer %d: %s", rp.GetId(), err)
+			return
 		}
+	}
+
+	if peer.running.Load() {
+		return
+	}
+	if err := peer.Start(); err != nil {
+		log.Printf("error starting peer %d: %s", rp.GetId(), err)
+	}
+}
+
+// handlePeerDisconnectUpdate marks peers that lost their update stream offline
+func (node *Node) handlePeerDisconnectUpdate(update *controllerv1.UpdateResponse) {
+	for _, rp := range update.GetPeerList().GetPeers() {
+		node.markPeerOffline(rp.GetId())
+	}
+}
+
+// handlePeerDeleteUpdate removes peers deleted from the network
+func (node *Node) handlePeerDeleteUpdate(update *controllerv1.UpdateResponse) {
+	for _, rp := range update.GetPeerList().GetPeers() {
+		node.RemovePeer(rp.GetId())
+	}
+}
+
+// markPeerOffline handles a peer without an update stream. The peer is still in
+// the network and an established session is kept, the data path doesn't depend
+// on the controller. Only a connection attempt in progress is abandoned as it
+// can't be signaled
+func (node *Node) markPeerOffline(id uint32) {
+	peer, found := node.lookupPeer(id)
+	if !found {
 		return
 	}
-	log.Println("skipping peer update TODO")
-	// Peer already found, update
-	//err := p.Update(rp)
-	//if err != nil {
-	//	panic(err)
-	//}
+	peer.abandonConnectAttempt("peer is offline")
 }
 
 // // TODO Fix variable naming and compares
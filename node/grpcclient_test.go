@@ -0,0 +1,150 @@
+package node
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyController fails the first update stream and serves the rest
+type flakyController struct {
+	controllerv1.UnimplementedControllerServiceServer
+	streams atomic.Int32
+}
+
+func (s *flakyController) UpdateStream(stream controllerv1.ControllerService_UpdateStreamServer) error {
+	if s.streams.Add(1) == 1 {
+		return status.Error(codes.Unavailable, "controller restarting")
+	}
+	err := stream.Send(&controllerv1.UpdateResponse{
+		UpdateType: controllerv1.UpdateType_INIT,
+		PeerList:   &controllerv1.PeerList{},
+	})
+	if err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestUpdateStreamReconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	controller := &flakyController{}
+	controllerv1.RegisterControllerServiceServer(server, controller)
+	go server.Serve(l)
+	defer server.Stop()
+
+	client, err := NewControllerClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.RunUpdateStream(ctx)
+		close(done)
+	}()
+
+	select {
+	case update := <-client.rxUpdates:
+		if update.GetUpdateType() != controllerv1.UpdateType_INIT {
+			t.Fatalf("first update = %s, want INIT", update.GetUpdateType())
+		}
+	case <-time.After(StreamBackoffMin + time.Second*5):
+		t.Fatal("update stream did not reconnect")
+	}
+
+	if n := controller.streams.Load(); n != 2 {
+		t.Fatalf("opened %d streams, want 2", n)
+	}
+	if st := client.StreamStatus(); st.State != StreamConnected || st.Err != nil {
+		t.Fatalf("stream status = %s %v, want connected", st.State, st.Err)
+	}
+
+	cancel()
+	<-done
+	if st := client.StreamStatus(); st.State != StreamIdle {
+		t.Fatalf("stream state after cancel = %s, want idle", st.State)
+	}
+}
+
+// burstController sends more updates than the client buffers, then holds the
+// stream open
+type burstController struct {
+	controllerv1.UnimplementedControllerServiceServer
+}
+
+func (s *burstController) UpdateStream(stream controllerv1.ControllerService_UpdateStreamServer) error {
+	for range 20 {
+		err := stream.Send(&controllerv1.UpdateResponse{
+			UpdateType: controllerv1.UpdateType_INIT,
+			PeerList:   &controllerv1.PeerList{},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestControllerClientCloseWhileStreaming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	controllerv1.RegisterControllerServiceServer(server, &burstController{})
+	go server.Serve(l)
+	defer server.Stop()
+
+	client, err := NewControllerClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.RunUpdateStream(context.Background())
+		close(done)
+	}()
+
+	// Nothing reads the updates, so the stream blocks once the buffer is full
+	deadline := time.Now().Add(time.Second * 5)
+	for len(client.rxUpdates) < cap(client.rxUpdates) {
+		if time.Now().After(deadline) {
+			t.Fatal("update buffer never filled")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("update stream kept running after close")
+	}
+
+	// Updates from routines still shutting down are dropped
+	for range cap(client.txUpdates) + 1 {
+		client.SubmitUpdate(&controllerv1.UpdateRequest{})
+	}
+	if err = client.Close(); err != nil {
+		t.Fatalf("second close = %v", err)
+	}
+}
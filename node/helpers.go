@@ -41,14 +41,15 @@ func GenerateNewKeypair() (noise.DHKey, error) {
 	return keypair, nil
 }
 
-func LoadKeyFromDisk() (noise.DHKey, error) {
+func LoadKeyFromDisk(path string) (noise.DHKey, error) {
 	var key Key
 	var noise noise.DHKey
 
-	keyfile, err := os.Open(os.ExpandEnv("$HOME/overlay.keypair"))
+	keyfile, err := os.Open(path)
 	if err != nil {
 		return noise, errors.New("File not found")
 	}
+	defer keyfile.Close()
 
 	err = yaml.NewDecoder(keyfile).Decode(&key)
 	if err != nil {
@@ -70,24 +71,19 @@ func LoadKeyFromDisk() (noise.DHKey, error) {
 	return noise, nil
 }
 
-func StoreKeyToDisk(keyPair noise.DHKey) error {
+// StoreKeyToDisk writes the keypair to path readable only by the owner
+func StoreKeyToDisk(path string, keyPair noise.DHKey) error {
 	var key Key
 
-	keyfile, err := os.Create(os.ExpandEnv("$HOME/overlay.keypair"))
-	if err != nil {
-		return err
-	}
-	keyfile.Seek(0, 0)
-
 	key.Private = base64.StdEncoding.EncodeToString(keyPair.Private)
 	key.Public = base64.StdEncoding.EncodeToString(keyPair.Public)
 
-	err = yaml.NewEncoder(keyfile).Encode(key)
+	data, err := yaml.Marshal(key)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return writeFileAtomic(path, data)
 }
 
 func CompareAddrPort(p1, p2 netip.AddrPort) int {
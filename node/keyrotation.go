@@ -0,0 +1,67 @@
+package node
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RotateKeypair generates a new noise keypair and reports the public key to the controller.
+// Once the controller accepts the new key, it is persisted and swapped in for the
+// node, and all peer sessions are torn down to re-handshake using the new key.
+// The controller broadcasts the new key so remote peers do the same
+func (node *Node) RotateKeypair(ctx context.Context) (string, error) {
+	if !node.loggedIn.Load() {
+		return "", errors.New("node is not logged in")
+	}
+
+	keypair, err := GenerateNewKeypair()
+	if err != nil {
+		return "", fmt.Errorf("error generating new keypair: %w", err)
+	}
+
+	pubkey := base64.StdEncoding.EncodeToString(keypair.Public)
+	err = node.grpcClient.UpdatePeerKey(ctx, node.machineID, pubkey)
+	if err != nil {
+		return "", fmt.Errorf("error updating public key with controller: %w", err)
+	}
+
+	node.noise.l.Lock()
+	node.noise.keyPair = keypair
+	node.noise.l.Unlock()
+
+	if err = StoreKeyToDisk(node.state.KeyPath(), keypair); err != nil {
+		log.Printf("error storing rotated keypair to disk: %s", err)
+	}
+
+	node.maps.l.RLock()
+	for _, peer := range node.maps.id {
+		go peer.Reconnect()
+	}
+	node.maps.l.RUnlock()
+
+	log.Println("noise keypair rotated")
+	return pubkey, nil
+}
+
+func (node *Node) keyRotationRoutine(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+			_, err := node.RotateKeypair(rCtx)
+			cancel()
+			if err != nil {
+				log.Printf("scheduled key rotation failed: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"time"
+
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const ManagementSocketName = "node.sock"
+
+// Management operations that change the node. Everything else only reads
+// state and is open to any local user that can reach the management API
+var privilegedMethods = map[string]bool{
+	nodev1.NodeService_Login_FullMethodName:     true,
+	nodev1.NodeService_Logout_FullMethodName:    true,
+	nodev1.NodeService_Up_FullMethodName:        true,
+	nodev1.NodeService_Down_FullMethodName:      true,
+	nodev1.NodeService_RotateKey_FullMethodName: true,
+}
+
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on " + runtime.GOOS)
+
+// DefaultManagementSocket returns the OS specific path of the management socket
+func DefaultManagementSocket() string {
+	switch runtime.GOOS {
+	case "linux":
+		return filepath.Join("/run/zeronet", ManagementSocketName)
+	case "windows":
+		// Its own directory, as ListenManagementSocket replaces the directory ACL
+		return filepath.Join(DefaultStateDir(), "run", ManagementSocketName)
+	default:
+		return filepath.Join("/var/run/zeronet", ManagementSocketName)
+	}
+}
+
+// PeerCred identifies the local process on the other end of a unix socket
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// managementAuthInfo is attached to every management connection and carries
+// the client's credentials when the connection is a unix socket on an OS that
+// reports them
+type managementAuthInfo struct {
+	credentials.CommonAuthInfo
+	network string
+	cred    *PeerCred
+}
+
+func (managementAuthInfo) AuthType() string {
+	return "management"
+}
+
+// managementCredentials are the transport credentials of the management
+// server. Traffic is local and unencrypted, the handshake only looks up who
+// is connecting so requests can be authorized
+type managementCredentials struct{}
+
+func (managementCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	info := managementAuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		network:        conn.LocalAddr().Network(),
+	}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		cred, err := peerCred(uc)
+		if err != nil && !errors.Is(err, errPeerCredUnsupported) {
+			return nil, nil, fmt.Errorf("error reading peer credentials: %w", err)
+		}
+		info.cred = cred
+	}
+	return conn, info, nil
+}
+
+func (managementCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("management credentials are server only")
+}
+
+func (managementCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "management"}
+}
+
+func (c managementCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (managementCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+// ManagementAuthorizer decides which management clients may use privileged
+// operations
+type ManagementAuthorizer struct {
+	// Unix socket clients running as this uid or root are privileged
+	uid uint32
+	// Members of this group are privileged too, -1 if there is none
+	gid int64
+	// Resolves a uid to its group ids, replaced in tests
+	groupIDs func(uid uint32) ([]string, error)
+}
+
+// NewManagementAuthorizer creates an authorizer for the user the service runs
+// as and members of group, which may be empty
+func NewManagementAuthorizer(group string) (*ManagementAuthorizer, error) {
+	a := &ManagementAuthorizer{
+		uid:      uint32(os.Geteuid()),
+		gid:      -1,
+		groupIDs: lookupGroupIDs,
+	}
+	if group == "" {
+		return a, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up management group: %w", err)
+	}
+	a.gid, err = strconv.ParseInt(g.Gid, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("management group %s has no numeric gid", group)
+	}
+	return a, nil
+}
+
+func lookupGroupIDs(uid uint32) ([]string, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	return u.GroupIds()
+}
+
+// authorize checks that the client calling method may do so. Read-only
+// methods are always allowed. Privileged methods need a unix socket client
+// running as root, the service user or a member of the management group, as
+// reported by the peer credentials on Linux, macOS and FreeBSD. Elsewhere
+// ListenManagementSocket restricts who can connect at all, and TCP clients
+// can't be identified so they are read-only
+func (a *ManagementAuthorizer) authorize(ctx context.Context, method string) error {
+	if !privilegedMethods[method] {
+		return nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "unknown management client")
+	}
+	info, ok := p.AuthInfo.(managementAuthInfo)
+	if !ok || info.network != "unix" {
+		return status.Error(codes.PermissionDenied, "privileged operations require the management socket")
+	}
+	if info.cred == nil {
+		// Only privileged users can open the socket without peer credentials
+		return nil
+	}
+
+	cred := info.cred
+	if cred.UID == 0 || cred.UID == a.uid {
+		return nil
+	}
+	if a.gid >= 0 {
+		if int64(cred.GID) == a.gid {
+			return nil
+		}
+		groups, err := a.groupIDs(cred.UID)
+		if err == nil && slices.Contains(groups, strconv.FormatInt(a.gid, 10)) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "uid %d is not allowed to %s", cred.UID, filepath.Base(method))
+}
+
+func (a *ManagementAuthorizer) unaryInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	if err := a.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// ServerOptions returns the options for a management gRPC server that
+// authorizes every request
+func (a *ManagementAuthorizer) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.Creds(managementCredentials{}),
+		grpc.UnaryInterceptor(a.unaryInterceptor),
+	}
+}
+
+// ListenManagementSocket listens on the management unix socket at path. A
+// stale socket left by a previous run is replaced, but one still in use is an
+// error. With peer credentials any local user may connect for read-only
+// operations. Otherwise the socket is limited to the owner and group, and on
+// Windows the directory holding it is limited to SYSTEM and Administrators
+func ListenManagementSocket(path string, group string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating management socket directory: %w", err)
+	}
+	// Set before the socket exists so it is never reachable with a wider ACL
+	if err := restrictSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("management socket %s is in use, is another node running?", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale management socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(0660)
+	if peerCredSupported {
+		mode = 0666
+	}
+	if runtime.GOOS != "windows" {
+		if err = os.Chmod(path, mode); err == nil && group != "" {
+			err = chownGroup(path, group)
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("error setting management socket permissions: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func chownGroup(path, group string) error {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, -1, gid)
+}
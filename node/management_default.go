@@ -0,0 +1,9 @@
+//go:build !windows
+
+package node
+
+// restrictSocketDir is a no-op, the socket's file mode and group limit who
+// may connect
+func restrictSocketDir(dir string) error {
+	return nil
+}
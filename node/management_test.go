@@ -0,0 +1,177 @@
+package node
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// managementService records the auth info of the last status request
+type managementService struct {
+	nodev1.UnimplementedNodeServiceServer
+	info chan managementAuthInfo
+}
+
+func (s *managementService) Status(ctx context.Context, req *nodev1.StatusRequest) (*nodev1.StatusResponse, error) {
+	p, _ := peer.FromContext(ctx)
+	info, _ := p.AuthInfo.(managementAuthInfo)
+	s.info <- info
+	return &nodev1.StatusResponse{}, nil
+}
+
+func (s *managementService) Down(ctx context.Context, req *nodev1.DownRequest) (*nodev1.DownResponse, error) {
+	return &nodev1.DownResponse{Status: "node is stopped"}, nil
+}
+
+func dialManagement(t *testing.T, target string) nodev1.NodeServiceClient {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return nodev1.NewNodeServiceClient(conn)
+}
+
+func TestManagementAuthorization(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not used on windows")
+	}
+
+	authorizer, err := NewManagementAuthorizer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &managementService{info: make(chan managementAuthInfo, 1)}
+	server := grpc.NewServer(authorizer.ServerOptions()...)
+	nodev1.RegisterNodeServiceServer(server, service)
+	t.Cleanup(server.Stop)
+
+	path := filepath.Join(t.TempDir(), ManagementSocketName)
+	sock, err := ListenManagementSocket(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(sock)
+	go server.Serve(tcp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	local := dialManagement(t, "unix:"+path)
+	if _, err = local.Status(ctx, &nodev1.StatusRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	info := <-service.info
+	if info.network != "unix" {
+		t.Fatalf("socket client network = %q, want unix", info.network)
+	}
+	if peerCredSupported && (info.cred == nil || info.cred.UID != uint32(os.Geteuid())) {
+		t.Fatalf("socket client credentials = %+v, want uid %d", info.cred, os.Geteuid())
+	}
+	if _, err = local.Down(ctx, &nodev1.DownRequest{}); err != nil {
+		t.Fatalf("privileged call over the socket failed: %s", err)
+	}
+
+	remote := dialManagement(t, tcp.Addr().String())
+	if _, err = remote.Status(ctx, &nodev1.StatusRequest{}); err != nil {
+		t.Fatalf("read-only call over tcp failed: %s", err)
+	}
+	<-service.info
+	if _, err = remote.Down(ctx, &nodev1.DownRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("privileged call over tcp = %v, want permission denied", err)
+	}
+}
+
+func TestManagementAuthorizeCredentials(t *testing.T) {
+	a := &ManagementAuthorizer{
+		uid: 1000,
+		gid: 2000,
+		groupIDs: func(uid uint32) ([]string, error) {
+			if uid == 1002 {
+				return []string{"100", "2000"}, nil
+			}
+			return []string{"100"}, nil
+		},
+	}
+
+	tests := []struct {
+		name    string
+		network string
+		cred    *PeerCred
+		method  string
+		allowed bool
+	}{
+		{"status from anyone", "unix", &PeerCred{UID: 1003, GID: 1003}, nodev1.NodeService_Status_FullMethodName, true},
+		{"ping over tcp", "tcp", nil, nodev1.NodeService_Ping_FullMethodName, true},
+		{"root", "unix", &PeerCred{UID: 0, GID: 0}, nodev1.NodeService_Up_FullMethodName, true},
+		{"service user", "unix", &PeerCred{UID: 1000, GID: 1000}, nodev1.NodeService_Login_FullMethodName, true},
+		{"primary group", "unix", &PeerCred{UID: 1001, GID: 2000}, nodev1.NodeService_Down_FullMethodName, true},
+		{"supplementary group", "unix", &PeerCred{UID: 1002, GID: 1002}, nodev1.NodeService_Logout_FullMethodName, true},
+		{"other user", "unix", &PeerCred{UID: 1003, GID: 1003}, nodev1.NodeService_Up_FullMethodName, false},
+		{"other user rotating key", "unix", &PeerCred{UID: 1003, GID: 1003}, nodev1.NodeService_RotateKey_FullMethodName, false},
+		{"no peer credentials", "unix", nil, nodev1.NodeService_Up_FullMethodName, true},
+		{"tcp", "tcp", nil, nodev1.NodeService_Up_FullMethodName, false},
+	}
+
+	for _, tt := range tests {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: managementAuthInfo{network: tt.network, cred: tt.cred},
+		})
+		err := a.authorize(ctx, tt.method)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: allowed = %v, want %v (%v)", tt.name, allowed, tt.allowed, err)
+		}
+	}
+}
+
+func TestListenManagementSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not used on windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "run", ManagementSocketName)
+	l, err := ListenManagementSocket(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := os.FileMode(0660)
+	if peerCredSupported {
+		want = 0666
+	}
+	if fi.Mode().Perm() != want {
+		t.Fatalf("socket mode = %s, want %s", fi.Mode().Perm(), want)
+	}
+
+	if _, err = ListenManagementSocket(path, ""); err == nil {
+		t.Fatal("listened on a management socket that is in use")
+	}
+
+	// A socket file left behind by a crashed node is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = ListenManagementSocket(path, "")
+	if err != nil {
+		t.Fatalf("stale socket was not replaced: %s", err)
+	}
+	l.Close()
+}
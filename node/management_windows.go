@@ -0,0 +1,38 @@
+package node
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// Full access for SYSTEM, Administrators and the owner, inherited by files
+// created in the directory
+const managementDirSDDL = "D:P(A;OICI;GA;;;SY)(A;OICI;GA;;;BA)(A;OICI;GA;;;OW)"
+
+// restrictSocketDir replaces the ACL of the management socket directory, so
+// the socket inherits it when created. Windows checks the socket's ACL on
+// connect, which keeps other local users from reaching the management API
+func restrictSocketDir(dir string) error {
+	sd, err := windows.SecurityDescriptorFromString(managementDirSDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	err = windows.SetNamedSecurityInfo(
+		dir,
+		windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		nil,
+		nil,
+		dacl,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error setting management socket directory acl: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Package netmon watches the host network for changes that invalidate ICE
+// candidates, such as interfaces going up or down and IPv4 addresses being
+// added or removed
+package netmon
+
+import (
+	"context"
+	"net"
+)
+
+// Watch reports underlay network changes on the returned channel until ctx is
+// done. Changes on the interfaces named in ignore, like the node's own tunnel,
+// and on loopback interfaces are not reported. Bursts of changes may be
+// coalesced into a single notification
+func Watch(ctx context.Context, ignore ...string) (<-chan struct{}, error) {
+	changes := make(chan struct{}, 1)
+	if err := watch(ctx, changes, ignore); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func notify(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// ignored reports whether changes on the interface with index should be skipped.
+// An interface that no longer exists is not ignored, its removal is a change
+func ignored(index int, ignore []string) bool {
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return false
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		return true
+	}
+	for _, name := range ignore {
+		if iface.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+//go:build !linux
+
+package netmon
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Interval the interface addresses are polled at where no change notifications are available
+const pollInterval = time.Second * 5
+
+// watch polls the interface list and reports when the usable IPv4 addresses change
+func watch(ctx context.Context, changes chan<- struct{}, ignore []string) error {
+	last, err := snapshot(ignore)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		t := time.NewTicker(pollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			current, err := snapshot(ignore)
+			if err != nil {
+				continue
+			}
+			if current != last {
+				last = current
+				notify(changes)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// snapshot returns the global IPv4 addresses of the interfaces that are up
+func snapshot(ignore []string) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || ignored(iface.Index, ignore) {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			addrs = append(addrs, iface.Name+"/"+ipnet.IP.String())
+		}
+	}
+	slices.Sort(addrs)
+	return strings.Join(addrs, ","), nil
+}
@@ -0,0 +1,139 @@
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Link flags that affect whether an interface can carry traffic
+const linkStateFlags = unix.IFF_UP | unix.IFF_RUNNING
+
+// watch subscribes to rtnetlink link and IPv4 address notifications
+func watch(ctx context.Context, changes chan<- struct{}, ignore []string) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("error opening netlink socket: %w", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR,
+	})
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("error binding netlink socket: %w", err)
+	}
+
+	// Reads go through the runtime poller so closing the file unblocks them
+	f := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	go func() {
+		m := &monitor{ignore: ignore, links: currentLinkFlags()}
+		buf := make([]byte, unix.Getpagesize()*4)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if errors.Is(err, unix.ENOBUFS) {
+					// Notifications were dropped, resync link state and assume a change
+					m.links = currentLinkFlags()
+					notify(changes)
+					continue
+				}
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, msg := range msgs {
+				if m.changed(msg) {
+					notify(changes)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+type monitor struct {
+	ignore []string
+	// Last seen state flags for each link by index
+	links map[int]uint32
+}
+
+// changed reports whether a netlink notification changes the usable underlay
+func (m *monitor) changed(msg syscall.NetlinkMessage) bool {
+	switch msg.Header.Type {
+	case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+		if len(msg.Data) < unix.SizeofIfInfomsg {
+			return false
+		}
+		info := (*unix.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		index := int(info.Index)
+
+		flags := info.Flags & linkStateFlags
+		if msg.Header.Type == unix.RTM_DELLINK {
+			flags = 0
+		}
+		prev, known := m.links[index]
+		m.links[index] = flags
+		if msg.Header.Type == unix.RTM_DELLINK {
+			delete(m.links, index)
+		}
+		// Many link attributes are reported with RTM_NEWLINK, only state changes matter
+		if prev == flags || (!known && flags != linkStateFlags) {
+			return false
+		}
+		return !m.isIgnored(index, info.Flags)
+	case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+		if len(msg.Data) < unix.SizeofIfAddrmsg {
+			return false
+		}
+		addr := (*unix.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		if addr.Family != unix.AF_INET || addr.Scope != unix.RT_SCOPE_UNIVERSE {
+			return false
+		}
+		return !m.isIgnored(int(addr.Index), 0)
+	default:
+		return false
+	}
+}
+
+func (m *monitor) isIgnored(index int, flags uint32) bool {
+	if flags&unix.IFF_LOOPBACK != 0 {
+		return true
+	}
+	return ignored(index, m.ignore)
+}
+
+func currentLinkFlags() map[int]uint32 {
+	links := make(map[int]uint32)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return links
+	}
+	for _, iface := range ifaces {
+		var flags uint32
+		if iface.Flags&net.FlagUp != 0 {
+			flags |= unix.IFF_UP
+		}
+		if iface.Flags&net.FlagRunning != 0 {
+			flags |= unix.IFF_RUNNING
+		}
+		links[iface.Index] = flags
+	}
+	return links
+}
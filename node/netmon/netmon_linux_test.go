@@ -0,0 +1,76 @@
+package netmon
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Interface index that doesn't exist on the test host
+const testIndex = 1 << 20
+
+func linkMessage(msgType uint16, flags uint32) syscall.NetlinkMessage {
+	data := make([]byte, unix.SizeofIfInfomsg)
+	info := (*unix.IfInfomsg)(unsafe.Pointer(&data[0]))
+	info.Index = testIndex
+	info.Flags = flags
+	return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: msgType}, Data: data}
+}
+
+func addrMessage(msgType uint16, family, scope uint8) syscall.NetlinkMessage {
+	data := make([]byte, unix.SizeofIfAddrmsg)
+	addr := (*unix.IfAddrmsg)(unsafe.Pointer(&data[0]))
+	addr.Family = family
+	addr.Scope = scope
+	addr.Index = testIndex
+	return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: msgType}, Data: data}
+}
+
+func TestMonitorLinkChanges(t *testing.T) {
+	m := &monitor{links: map[int]uint32{}}
+
+	tests := []struct {
+		name string
+		msg  syscall.NetlinkMessage
+		want bool
+	}{
+		{"new link down", linkMessage(unix.RTM_NEWLINK, 0), false},
+		{"admin up", linkMessage(unix.RTM_NEWLINK, unix.IFF_UP), true},
+		{"carrier up", linkMessage(unix.RTM_NEWLINK, unix.IFF_UP|unix.IFF_RUNNING), true},
+		{"attribute change", linkMessage(unix.RTM_NEWLINK, unix.IFF_UP|unix.IFF_RUNNING|unix.IFF_MULTICAST), false},
+		{"carrier down", linkMessage(unix.RTM_NEWLINK, unix.IFF_UP), true},
+		{"removed", linkMessage(unix.RTM_DELLINK, unix.IFF_UP), true},
+		{"new link up", linkMessage(unix.RTM_NEWLINK, unix.IFF_UP|unix.IFF_RUNNING), true},
+		{"loopback", linkMessage(unix.RTM_NEWLINK, unix.IFF_LOOPBACK), false},
+	}
+
+	for _, tt := range tests {
+		if got := m.changed(tt.msg); got != tt.want {
+			t.Errorf("%s: changed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMonitorAddrChanges(t *testing.T) {
+	m := &monitor{links: map[int]uint32{}}
+
+	tests := []struct {
+		name string
+		msg  syscall.NetlinkMessage
+		want bool
+	}{
+		{"ipv4 added", addrMessage(unix.RTM_NEWADDR, unix.AF_INET, unix.RT_SCOPE_UNIVERSE), true},
+		{"ipv4 removed", addrMessage(unix.RTM_DELADDR, unix.AF_INET, unix.RT_SCOPE_UNIVERSE), true},
+		{"ipv4 link local", addrMessage(unix.RTM_NEWADDR, unix.AF_INET, unix.RT_SCOPE_LINK), false},
+		{"ipv6", addrMessage(unix.RTM_NEWADDR, unix.AF_INET6, unix.RT_SCOPE_UNIVERSE), false},
+		{"route", syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: unix.RTM_NEWROUTE}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := m.changed(tt.msg); got != tt.want {
+			t.Errorf("%s: changed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
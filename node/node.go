@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,6 +18,7 @@ import (
 	"github.com/caldog20/machineid"
 	"github.com/caldog20/zeronet/node/conn"
 	"github.com/caldog20/zeronet/node/tun"
+	"github.com/caldog20/zeronet/pkg/relay"
 	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
 	"github.com/flynn/noise"
 	"github.com/pion/ice/v3"
@@ -49,6 +51,31 @@ type Node struct {
 		l       sync.RWMutex
 		keyPair noise.DHKey
 	}
+	// Interval to rotate the noise keypair, disabled when 0
+	keyRotation time.Duration
+
+	// Persistent keypair and login session
+	state      *StateStore
+	controller string
+
+	// Local settings from the node config file
+	config *Config
+	// Effective runtime settings, local config takes precedence over controller defaults
+	mtu        int
+	dnsServers []netip.Addr
+	relayURL   string
+	// Expiry of the TURN credentials issued by the controller, zero if there are none
+	turnExpiry time.Time
+
+	// Relay used by peers without a direct path, nil when no relay is configured
+	relay atomic.Pointer[relay.Client]
+
+	// Shared crypto worker queues, see pipeline.go
+	encryptQueue chan *OutboundBuffer
+	decryptQueue chan *InboundBuffer
+	cryptoDone   chan struct{}
+	cryptoWG     sync.WaitGroup
+	closeOnce    sync.Once
 
 	// TODO: Verify this bool
 	running    atomic.Bool
@@ -57,6 +84,9 @@ type Node struct {
 	port                        uint16
 	controllerDiscoveryEndpoint *net.UDPAddr
 
+	// Local proxies into the overlay in userspace mode
+	proxyListeners []net.Listener
+
 	runCtx    context.Context
 	runCancel context.CancelFunc
 	nodev1.UnimplementedNodeServiceServer
@@ -66,56 +96,71 @@ type Node struct {
 	stunUrls  []*stun.URI
 }
 
-func NewNode(controller string, port uint16) (*Node, error) {
+func NewNode(config *Config) (*Node, error) {
 	node := new(Node)
 	node.maps.id = make(map[uint32]*Peer)
 	node.maps.ip = make(map[netip.Addr]*Peer)
+	node.config = config
 
-	// TODO: For now, we generate a new key on startup every time
-	// TODO: Key rotation periodically
-	// Try to load key from disk
-	//keypair, err := LoadKeyFromDisk()
-	//if err != nil {
-	//	keypair, err = GenerateNewKeypair()
-	//	if err != nil {
-	//		log.Println("error storing keypair to disk")
-	//	}
-	//}
-	keypair, err := GenerateNewKeypair()
+	var err error
+	node.state, err = NewStateStore(config.StateDir)
 	if err != nil {
-		return nil, errors.New("could not generate keypair: " + err.Error())
+		return nil, err
+	}
+
+	// Try to load key from disk, otherwise generate and persist a new one
+	keypair, err := LoadKeyFromDisk(node.state.KeyPath())
+	if err != nil {
+		keypair, err = GenerateNewKeypair()
+		if err != nil {
+			return nil, errors.New("could not generate keypair: " + err.Error())
+		}
+		if err = StoreKeyToDisk(node.state.KeyPath(), keypair); err != nil {
+			log.Printf("error storing keypair to disk: %s", err)
+		}
 	}
 
 	node.noise.keyPair = keypair
-	node.port = port
+	node.port = config.Port
+	node.keyRotation = config.KeyRotation
 
-	node.machineID, err = machineid.ProtectedID("Zeronet")
-	if err != nil {
-		return nil, fmt.Errorf("error generating machine ID: %s", err.Error())
+	node.machineID = config.MachineID
+	if node.machineID == "" {
+		node.machineID, err = machineid.ProtectedID("Zeronet")
+		if err != nil {
+			return nil, fmt.Errorf("error generating machine ID: %s", err.Error())
+		}
 	}
 
-	host, err := os.Hostname()
-	if err != nil {
+	if config.Hostname != "" {
+		node.hostname = config.Hostname
+	} else if host, err := os.Hostname(); err != nil {
 		log.Printf("error getting hostname: %s", err.Error())
-		host = fmt.Sprintf("node-%d", rand.Uint32())
-		log.Printf("defaulting hostname to %s", host)
+		node.hostname = fmt.Sprintf("node-%d", rand.Uint32())
+		log.Printf("defaulting hostname to %s", node.hostname)
 	} else {
 		hostname := strings.Split(host, ".")
 		node.hostname = hostname[0]
 	}
 
+	// Fallback to the last controller the node logged in to
+	controller := config.Controller
+	if controller == "" {
+		controller = node.state.Get().Controller
+	}
+	if controller == "" {
+		controller = DefaultController
+	}
+	node.controller = controller
+
 	node.grpcClient, err = NewControllerClient(controller)
 	if err != nil {
 		return nil, err
 	}
+	node.grpcClient.reauth = node.reauthenticate
 
-	// TODO make this configurable
-	node.parseStunUrls(
-		"stun:stun.l.google.com:19302",
-		"stun:stun1.l.google.com:19302",
-		"stun:stun.services.mozilla.com:3478",
-		"stun:stun.siptraffic.com:3478",
-	)
+	node.applyLocalSettings()
+	node.startCryptoWorkers(runtime.NumCPU())
 
 	return node, nil
 }
@@ -142,15 +187,12 @@ func (n *Node) Start() error {
 		return err
 	}
 
-	n.udpMux = ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{
-		Logger:                nil,
-		UDPConn:               n.conn.GetConn(),
-		XORMappedAddrCacheTTL: time.Second * 20,
-	})
+	n.udpMux = newUDPMux(n.conn)
 
 	// Create local tunnel interface
-	n.tun, err = tun.NewTun()
+	n.tun, err = n.newTun()
 	if err != nil {
+		n.udpMux.Close()
 		n.conn.Close()
 		return err
 	}
@@ -158,6 +200,13 @@ func (n *Node) Start() error {
 	n.runCtx, n.runCancel = context.WithCancel(context.Background())
 
 	err = n.Run()
+	if err == nil {
+		err = n.startProxies()
+		if err != nil {
+			n.StopAllPeers()
+			n.running.Store(false)
+		}
+	}
 	if err != nil {
 		n.udpMux.Close()
 		n.conn.Close()
@@ -185,6 +234,12 @@ func (node *Node) Run() error {
 		return err
 	}
 
+	if dns := node.getDNSServers(); len(dns) > 0 {
+		if err = node.tun.ConfigureDNS(dns); err != nil {
+			log.Printf("error configuring tunnel dns: %s", err)
+		}
+	}
+
 	//// Initially set endpoint
 	//err = node.sendStunRequest()
 	//if err != nil {
@@ -192,9 +247,21 @@ func (node *Node) Run() error {
 	//}
 
 	//go node.ReadUDPPackets(node.OnUDPPacket, 0)
+	if relayURL := node.getRelayURL(); relayURL != "" {
+		client := relay.NewClient(relayURL, node.machineID)
+		node.relay.Store(client)
+		go client.Run(node.runCtx)
+	}
 	node.StartUpdateStream(node.runCtx)
 	go node.ReadTunPackets(node.OnTunnelPacket)
 
+	if node.keyRotation > 0 {
+		go node.keyRotationRoutine(node.runCtx, node.keyRotation)
+	}
+	go node.turnRefreshRoutine(node.runCtx)
+	go node.authRefreshRoutine(node.runCtx)
+	go node.networkMonitorRoutine(node.runCtx)
+
 	//go node.stunRoutine()
 	//for _, peer := range node.maps.id {
 	//	if peer.running.Load() {
@@ -216,10 +283,14 @@ func (node *Node) Stop() error {
 		return fmt.Errorf("node is already stopped")
 	}
 
+	node.stopProxies()
 	node.StopAllPeers()
 	node.runCancel()
+	node.relay.Store(nil)
+	node.lock.Lock()
 	node.udpMux.Close()
 	node.conn.Close()
+	node.lock.Unlock()
 	node.tun.Close()
 
 	node.running.Store(false)
@@ -228,13 +299,46 @@ func (node *Node) Stop() error {
 	return nil
 }
 
+// Close stops the node if running, then stops the crypto workers and closes
+// the controller connection. The node can't be used again once closed
+func (node *Node) Close() error {
+	var err error
+	node.closeOnce.Do(func() {
+		if node.running.Load() {
+			err = node.Stop()
+		}
+		node.stopCryptoWorkers()
+		if cerr := node.grpcClient.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// StopAllPeers stops every peer in parallel and waits for their routines to exit
 func (node *Node) StopAllPeers() {
 	node.maps.l.RLock()
-	defer node.maps.l.RUnlock()
-
+	peers := make([]*Peer, 0, len(node.maps.id))
 	for _, peer := range node.maps.id {
-		go peer.Stop()
+		peers = append(peers, peer)
+	}
+	node.maps.l.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peer.Stop()
+		}()
 	}
+	wg.Wait()
+}
+
+func (node *Node) keyPair() noise.DHKey {
+	node.noise.l.RLock()
+	defer node.noise.l.RUnlock()
+	return node.noise.keyPair
 }
 
 func (node *Node) lookupPeer(id uint32) (*Peer, bool) {
@@ -295,16 +399,29 @@ func (node *Node) OnTunnelPacket(buffer *OutboundBuffer) {
 	return
 }
 
+func newUDPMux(c *conn.Conn) *ice.UniversalUDPMuxDefault {
+	return ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{
+		Logger:                nil,
+		UDPConn:               c.PacketConn(),
+		XORMappedAddrCacheTTL: time.Second * 20,
+	})
+}
+
 func (node *Node) getAgentConfig() *ice.AgentConfig {
+	node.lock.RLock()
+	urls := node.stunUrls
+	udpMux := node.udpMux
+	node.lock.RUnlock()
+
 	return &ice.AgentConfig{
-		UDPMux:       node.udpMux.UDPMuxDefault,
-		UDPMuxSrflx:  node.udpMux,
+		UDPMux:       udpMux.UDPMuxDefault,
+		UDPMuxSrflx:  udpMux,
 		NetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4},
-		Urls:         node.stunUrls,
+		Urls:         urls,
 	}
 }
 
-func (node *Node) parseStunUrls(urls ...string) {
+func parseStunUrls(urls ...string) []*stun.URI {
 	var stunUrls []*stun.URI
 
 	for _, u := range urls {
@@ -316,5 +433,5 @@ func (node *Node) parseStunUrls(urls ...string) {
 		stunUrls = append(stunUrls, parsed)
 	}
 
-	node.stunUrls = stunUrls
+	return stunUrls
 }
@@ -11,19 +11,38 @@ type OnTunnelPacket func(buffer *OutboundBuffer)
 
 func (node *Node) ReadTunPackets(callback OnTunnelPacket) {
 	runtime.LockOSThread()
+
+	batchSize := node.tun.BatchSize()
+	buffers := make([]*OutboundBuffer, batchSize)
+	packets := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+
 	for {
-		buffer := GetOutboundBuffer()
-		n, err := node.tun.Read(buffer.packet)
+		// Only replace the buffers handed off by the last read
+		for i := range buffers {
+			if buffers[i] == nil {
+				buffers[i] = GetOutboundBuffer()
+				packets[i] = buffers[i].packet
+			}
+		}
+
+		n, err := node.tun.ReadBatch(packets, sizes)
+		for i := range n {
+			buffers[i].size = sizes[i]
+			callback(buffers[i])
+			buffers[i] = nil
+		}
+
 		if err != nil {
-			PutOutboundBuffer(buffer)
 			if errors.Is(err, os.ErrClosed) {
+				for _, buffer := range buffers {
+					if buffer != nil {
+						PutOutboundBuffer(buffer)
+					}
+				}
 				return
 			}
 			log.Printf("%v", err)
-			continue
 		}
-
-		buffer.size = n
-		callback(buffer)
 	}
 }
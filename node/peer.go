@@ -5,15 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/caldog20/zeronet/pkg/header"
+	"github.com/caldog20/zeronet/noiseconn"
 	proto "github.com/caldog20/zeronet/proto/gen/controller/v1"
 	"github.com/pion/ice/v3"
-  "github.com/caldog20/zeronet/noiseconn"
 )
 
 const (
@@ -35,15 +35,19 @@ type Peer struct {
 	pendingLock sync.RWMutex
 	Hostname    string
 
-  noiseConn *noiseconn.Conn
+	noiseConn    *noiseconn.Conn
+	remoteStatic []byte
 
 	agent *ice.Agent
-	conn  *ice.Conn
+	conn  net.Conn
 	node  *Node // Pointer back to node for stuff
 	IP    netip.Addr
 	ID    uint32
 
+	// Data plane queues, see pipeline.go
 	outbound       chan *OutboundBuffer
+	sendQueue      chan *OutboundBuffer
+	receiveQueue   chan *InboundBuffer
 	iceCredentials chan IceCreds
 	iceCandidates  chan ice.Candidate
 	candidatesDone chan struct{}
@@ -52,6 +56,31 @@ type Peer struct {
 	inTransport atomic.Bool
 	connecting  atomic.Bool
 	initiator   atomic.Bool
+	recovering  atomic.Bool
+	// The session runs over the controller relay, see peer_relay.go
+	relayed   atomic.Bool
+	upgrading atomic.Bool
+
+	// Incremented for every completed handshake so routines tied to a
+	// session can tell when it has been replaced
+	session atomic.Uint64
+	// Cancels the in-flight connection attempt, see newAttempt
+	attemptCancel context.CancelFunc
+
+	// Reported by the status RPC, times are unix nanoseconds
+	iceState      atomic.Int32
+	lastHandshake atomic.Int64
+	lastRx        atomic.Int64
+	lastTx        atomic.Int64
+	rxBytes       atomic.Uint64
+	txBytes       atomic.Uint64
+
+	// Outstanding probes sent by Ping, keyed by probe id
+	probes struct {
+		l       sync.Mutex
+		next    uint64
+		pending map[uint64]chan struct{}
+	}
 
 	wg sync.WaitGroup
 }
@@ -64,8 +93,11 @@ func NewPeer() *Peer {
 		chan *OutboundBuffer,
 		OutboundChannelSize,
 	) // allow up to 64 packets to be cached/pending handshake???
+	peer.sendQueue = make(chan *OutboundBuffer, OutboundChannelSize)
+	peer.receiveQueue = make(chan *InboundBuffer, InboundChannelSize)
 	peer.iceCredentials = make(chan IceCreds, 2)
 	peer.iceCandidates = make(chan ice.Candidate)
+	peer.probes.pending = make(map[uint64]chan struct{})
 	peer.wg = sync.WaitGroup{}
 
 	// peer.ctx, peer.cancel = context.WithCancel(context.Background())
@@ -83,62 +115,14 @@ func (node *Node) AddPeer(peerInfo *proto.Peer) (*Peer, error) {
 
 	peer.node = node
 
-	remoteStatic, err := DecodeBase64Key(peerInfo.GetPublicKey())
+	peer.remoteStatic, err = DecodeBase64Key(peerInfo.GetPublicKey())
 	if err != nil {
 		return nil, fmt.Errorf("error decoding noise public key for peer: %w", err)
 	}
 
-	node.noise.l.RLock()
-	defer node.noise.l.RUnlock()
-  peer.noiseConn = noiseconn.NewNoiseConn(node.noise.keyPair, remoteStatic)
-
-	// TODO: Move ICE Callback configuration to separate function
-	peer.agent, err = ice.NewAgent(node.getAgentConfig())
+	peer.noiseConn = noiseconn.NewNoiseConn(node.keyPair(), peer.remoteStatic)
 
-	err = peer.agent.OnCandidate(func(c ice.Candidate) {
-		if c == nil {
-			return
-		}
-		node.sendPeerCandidate(peer.ID, c.Marshal())
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	err = peer.agent.OnConnectionStateChange(func(c ice.ConnectionState) {
-		switch c {
-		case ice.ConnectionStateCompleted:
-			// Final candidate pair selected, stop candidate receiver routine
-			log.Printf("peer %d ice status: connection completed", peer.ID)
-			peer.cancelReceiveRemoteCandidates()
-		case ice.ConnectionStateConnected:
-			peer.connecting.Store(false)
-			peer.inTransport.Store(true)
-			// peer.pendingLock.Unlock()
-			// peer.setupNoiseState()
-			log.Printf("peer %d ice status: connected", peer.ID)
-		case ice.ConnectionStateDisconnected:
-			if peer.inTransport.Load() {
-				// peer.inTransport.Store(false)
-				peer.pendingLock.Lock()
-			}
-			log.Printf("peer %d ice status: disconnected", peer.ID)
-		case ice.ConnectionStateFailed:
-			peer.connecting.Store(false)
-			if peer.inTransport.Load() {
-				peer.inTransport.Store(false)
-			}
-			peer.cancelReceiveRemoteCandidates()
-			log.Printf("peer %d ice status: connection failed", peer.ID)
-		case ice.ConnectionStateClosed:
-			log.Printf("peer %d ice status: closed agent", peer.ID)
-			if peer.inTransport.Load() {
-				peer.inTransport.Store(false)
-				peer.pendingLock.Lock()
-			}
-		default:
-		}
-	})
+	peer.agent, err = peer.newAgent()
 	if err != nil {
 		return nil, err
 	}
@@ -154,185 +138,122 @@ func (node *Node) AddPeer(peerInfo *proto.Peer) (*Peer, error) {
 
 	// TODO: Add methods to manipulate map
 	node.maps.l.Lock()
+	// A peer still holding the IP is stale, the controller reassigned it
+	stale, taken := node.maps.ip[peer.IP]
+	if taken {
+		node.deletePeerLocked(stale)
+	}
 	node.maps.id[peer.ID] = peer
 	node.maps.ip[peer.IP] = peer
 	node.maps.l.Unlock()
 
-	return peer, nil
-}
-
-func (peer *Peer) setupNoiseState() error {
-	initiator := peer.initiator.Load()
-	err := peer.noiseState.Initialize(initiator)
-	if err != nil {
-		return err
+	if taken {
+		log.Printf("removing peer %d, its ip was reassigned to peer %d", stale.ID, peer.ID)
+		go stale.Close()
 	}
 
-	peer.handshake(initiator)
-	return nil
-}
-
-func (peer *Peer) handshake(initiator bool) {
-	if initiator {
-		peer.initiateHandshake()
-	} else {
-		peer.respondHandshake()
-	}
+	return peer, nil
 }
 
-func (peer *Peer) initiateHandshake() error {
-	data := make([]byte, 1400)
-	h := header.NewHeader()
-	var err error
+// newAgent creates an ICE agent for the peer with candidate and connection state
+// callbacks configured. A closed agent cannot be reused, so this is also called
+// when the peer state is reset
+func (peer *Peer) newAgent() (*ice.Agent, error) {
+	node := peer.node
 
-	// Send Handshake P1
-	data, _ = h.Encode(data, header.Handshake, peer.ID, 0)
-	data, err = peer.noiseState.GenerateHandshakeP1(data)
+	agent, err := ice.NewAgent(node.getAgentConfig())
 	if err != nil {
-		log.Printf("peer %d generate handshake p1 failed: %s", peer.ID, err)
-		return err
-	}
-	n, err := peer.conn.Write(data)
-	if err != nil {
-		log.Printf("error sending handshake message to peer %d: %s", peer.ID, err)
-		return err
+		return nil, err
 	}
-	log.Printf("sent handshake p1 message to peer %d: %d bytes", peer.ID, n)
 
-	// Wait for Handshake P2
-	n, err = peer.conn.Read(data)
-	if err != nil {
-		log.Printf("error receiving handshake p2 message from peer %d: %s", peer.ID, err)
-		return err
-	}
-	log.Printf("received handshake p2 message from peer %d: %d bytes", peer.ID, n)
-	err = h.Parse(data[:header.HeaderLen])
+	err = agent.OnCandidate(func(c ice.Candidate) {
+		if c == nil {
+			return
+		}
+		node.sendPeerCandidate(peer.ID, c.Marshal())
+	})
 	if err != nil {
-		log.Printf("error parsing header during handshake from peer %d: %s", peer.ID, err)
-		return err
+		agent.Close()
+		return nil, err
 	}
-	err = peer.noiseState.ConsumeHandshakeP2(data[header.HeaderLen:n])
+
+	peer.iceState.Store(int32(ice.ConnectionStateNew))
+	err = agent.OnConnectionStateChange(func(c ice.ConnectionState) {
+		peer.iceState.Store(int32(c))
+		switch c {
+		case ice.ConnectionStateCompleted:
+			// Final candidate pair selected, stop candidate receiver routine
+			debugf("peer %d ice status: connection completed", peer.ID)
+			peer.cancelReceiveRemoteCandidates()
+		case ice.ConnectionStateConnected:
+			debugf("peer %d ice status: connected", peer.ID)
+		case ice.ConnectionStateDisconnected:
+			debugf("peer %d ice status: disconnected", peer.ID)
+		case ice.ConnectionStateFailed:
+			peer.connecting.Store(false)
+			peer.cancelReceiveRemoteCandidates()
+			debugf("peer %d ice status: connection failed", peer.ID)
+		case ice.ConnectionStateClosed:
+			debugf("peer %d ice status: closed agent", peer.ID)
+		default:
+		}
+	})
 	if err != nil {
-		log.Printf("error consuming handshake p2 message from peer %d: %s", peer.ID, err)
-		return err
+		agent.Close()
+		return nil, err
 	}
 
-	log.Printf("peer %d handshake complete - beginning transport", peer.ID)
-	peer.pendingLock.Unlock()
-	go peer.processInbound()
-	go peer.processOutbound()
-
-	return nil
+	return agent, nil
 }
 
-func (peer *Peer) respondHandshake() error {
-	data := make([]byte, 1400)
-	h := header.NewHeader()
-	var err error
+// setupNoiseState runs the noise handshake over the established ICE connection
+// and starts the inbound routine once the session is ready for transport
+func (peer *Peer) setupNoiseState() error {
+	peer.mu.RLock()
+	nc := peer.noiseConn
+	conn := peer.conn
+	peer.mu.RUnlock()
 
-	// Read handshake p1 from peer
-	n, err := peer.conn.Read(data)
-	if err != nil {
-		log.Printf("error reading handshake message from peer %d: %s", peer.ID, err)
-		return err
-	}
-	err = h.Parse(data)
-	if err != nil {
-		log.Printf("error parsing header during handshake from peer %d: %s", peer.ID, err)
-		return err
-	}
-	err = peer.noiseState.ConsumeHandshakeP1(data[header.HeaderLen:n])
-	if err != nil {
-		log.Printf("error consuming handshake p1 from peer %d: %s", peer.ID, err)
-		return err
-	}
+	nc.SetConn(conn)
 
-	// Send handshake p2 to peer
-	data = data[:0]
-	data, err = h.Encode(data, header.Handshake, peer.ID, 1)
-	if err != nil {
-		log.Printf("error encoding header for handshake response to peer %d: %s", peer.ID, err)
-		return err
+	var err error
+	if peer.initiator.Load() {
+		err = nc.Dial()
+	} else {
+		err = nc.Accept()
 	}
-	data, err = peer.noiseState.GenerateHandshakeP2(data)
 	if err != nil {
-		log.Printf("error generating handshake p2 message for peer %d: %s", peer.ID, err)
+		log.Printf("peer %d noise handshake failed: %s", peer.ID, err)
+		peer.connecting.Store(false)
 		return err
 	}
 
-	n, err = peer.conn.Write(data)
-	if err != nil {
-		log.Printf("error sending handshake message to peer %d: %s", peer.ID, err)
-		return err
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	// Peer state was reset while handshaking, this session is no longer valid
+	if peer.noiseConn != nc {
+		return errors.New("peer state reset during handshake")
 	}
-	log.Printf("sent handshake p2 message to peer %d: %d bytes - beginning transport", peer.ID, n)
+
+	log.Printf("peer %d handshake complete - beginning transport", peer.ID)
+	peer.connecting.Store(false)
+	peer.inTransport.Store(true)
+	peer.lastHandshake.Store(time.Now().UnixNano())
+	session := peer.session.Add(1)
 	peer.pendingLock.Unlock()
-	go peer.processInbound()
-	go peer.processOutbound()
-	return nil
-}
 
-func (peer *Peer) processInbound() {
-	for {
-		if !peer.inTransport.Load() {
-			log.Printf("peer %d no longer in transport, killing inbound routine", peer.ID)
-			return
-		}
-		peer.pendingLock.RLock()
-		buffer := GetInboundBuffer()
-		n, err := peer.conn.Read(buffer.in)
-		if err != nil {
-			PutInboundBuffer(buffer)
-			peer.pendingLock.RUnlock()
-			if !peer.running.Load() {
-				return
-			}
-			log.Printf("error reading data packet from peer %d: %s", peer.ID, err)
-			continue
-		}
-		log.Printf("read %d byte data packet from peer %d", n, peer.ID)
-		buffer.header.Parse(buffer.in[:header.HeaderLen])
-		nonce := buffer.header.Counter
-		data, err := peer.noiseState.Decrypt(
-			buffer.packet[:0],
-			buffer.in[header.HeaderLen:n],
-			nonce,
-		)
-		if err != nil {
-			log.Printf("error decrypting inbound data packet from peer %d: %s", peer.ID, err)
-			peer.pendingLock.RUnlock()
-			PutInboundBuffer(buffer)
-			continue
-		}
-		peer.node.tun.Write(data)
+	go peer.processInbound(nc)
+	go peer.runTimers(nc, session)
+	if peer.relayed.Load() && peer.initiator.Load() {
+		go peer.upgradeRoutine(session)
 	}
+	return nil
 }
 
-func (peer *Peer) processOutbound() {
-	for buffer := range peer.outbound {
-		if buffer == nil {
-			log.Printf("peer %d no longer in transport, killing outbound routine", peer.ID)
-			return
-		}
-		peer.pendingLock.RLock()
-		// nonce := peer.noiseState.nonce.Add(1)
-		nonce := peer.noiseState.tx.Nonce()
-		data, _ := buffer.header.Encode(buffer.out, header.Data, peer.ID, nonce)
-		data, err := peer.noiseState.Encrypt(data, buffer.packet[:buffer.size], nonce)
-		if err != nil {
-			log.Printf("error encrypting packet for remote peer %d: %s", peer.ID, err)
-			peer.pendingLock.RUnlock()
-			continue
-		}
-		n, err := peer.conn.Write(data)
-		if err != nil {
-			log.Printf("error sending encrypted data packet to peer %d: %s", peer.ID, err)
-		}
-		log.Printf("send %d byte data packet to peer %d", n, peer.ID)
-
-		PutOutboundBuffer(buffer)
-		peer.pendingLock.RUnlock()
-	}
+func (peer *Peer) isCurrentSession(nc *noiseconn.Conn) bool {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return peer.noiseConn == nc
 }
 
 func (peer *Peer) Start() error {
@@ -349,9 +270,10 @@ func (peer *Peer) Start() error {
 	// Lock here when starting peer so routines have to wait for handshake before trying to read data from channels
 	peer.pendingLock.Lock()
 
-	// peer.wg.Add(2)
-	// go peer.Inbound()
-	// go peer.Outbound()
+	peer.wg.Add(3)
+	go peer.processOutbound()
+	go peer.processSend()
+	go peer.processReceive()
 
 	peer.running.Store(true)
 	peer.inTransport.Store(false)
@@ -359,19 +281,27 @@ func (peer *Peer) Start() error {
 }
 
 func (peer *Peer) Stop() {
+	if !peer.running.CompareAndSwap(true, false) {
+		return
+	}
 	log.Printf("Stopping peer %d", peer.ID)
-	peer.running.Store(false)
-	peer.ResetState()
 
-	// send nil value to kill goroutines
 	peer.mu.Lock()
-	defer peer.mu.Unlock()
+	peer.closeTransportLocked()
+	peer.mu.Unlock()
+
+	// Release pending lock so the outbound routine can drain and exit
+	peer.pendingLock.Unlock()
+
+	// send nil value to kill goroutines
 	peer.outbound <- nil
+	peer.receiveQueue <- nil
 
 	// Wait until all routines are finished
 	peer.wg.Wait()
-	log.Printf("peer %d goroutines have stopped", peer.ID)
-	// peer.pendingLock.Unlock()
+	peer.flushOutboundQueue()
+	peer.flushReceiveQueue()
+	debugf("peer %d goroutines have stopped", peer.ID)
 }
 
 func (peer *Peer) InboundPacket(buffer *InboundBuffer) {
@@ -391,7 +321,7 @@ func (peer *Peer) OutboundPacket(buffer *OutboundBuffer) {
 	select {
 	case peer.outbound <- buffer:
 	default:
-		log.Printf("peer id %d: outbound channel full", peer.ID)
+		debugf("peer id %d: outbound channel full", peer.ID)
 	}
 
 	if !peer.inTransport.Load() && !peer.connecting.Load() {
@@ -402,104 +332,248 @@ func (peer *Peer) OutboundPacket(buffer *OutboundBuffer) {
 	//}
 }
 
-// TODO: Add retries and counting
+// InitiateConnection offers ICE credentials to the remote peer and dials once
+// the answer is received, falling back to the relay if no direct path is found.
+// Retries after a dead session are handled by recoverSession
 func (peer *Peer) InitiateConnection() {
 	log.Println("Initiating connection")
-	if peer.connecting.Load() || peer.inTransport.Load() {
+	if !peer.running.Load() || peer.inTransport.Load() || !peer.connecting.CompareAndSwap(false, true) {
 		return
 	}
-	peer.connecting.Store(true)
 	peer.initiator.Store(true)
+
+	ctx, agent := peer.newAttempt()
+
 	go func() {
-		localUfrag, localPwd, err := peer.agent.GetLocalUserCredentials()
+		conn, err := peer.dialICE(ctx, agent)
 		if err != nil {
-			log.Println("error getting local user credentials: ", err)
-			peer.connecting.Store(false)
+			if ctx.Err() != nil {
+				// Attempt was abandoned, the peer state belongs to whoever cancelled it
+				return
+			}
+			if errors.Is(err, errNoAnswer) {
+				log.Printf("peer %d did not answer ice offer", peer.ID)
+				peer.connecting.Store(false)
+				return
+			}
+			log.Printf("error dialing remote peer %d: %v", peer.ID, err)
+			if !peer.connectRelay(agent) {
+				peer.connecting.Store(false)
+			}
 			return
 		}
-
-		var remoteCreds IceCreds
-		// Block here waiting for ice credentials from remote peer
-		func() {
-			t := time.NewTimer(time.Second * 10)
-			timeout := time.NewTicker(time.Second * 30)
-
-			for {
-				// Send offer to remote peer with local credentials
-				peer.node.sendPeerIceOffer(peer.ID, localUfrag, localPwd)
-				select {
-				case remoteCreds = <-peer.iceCredentials:
-					t.Stop()
-					timeout.Stop()
-					return
-				case <-t.C:
-					t.Reset(time.Second * 10)
-					continue
-				case <-timeout.C:
-					t.Stop()
-					peer.connecting.Store(false)
-					return
-				}
-			}
-		}()
-
-		if err = peer.agent.GatherCandidates(); err != nil {
-			log.Println("error gathering candidates: ", err)
-			peer.connecting.Store(false)
+		if !peer.setConn(agent, conn) {
 			return
 		}
+		peer.setupNoiseState()
+	}()
+}
 
-		// Async loop to add remote candidates when received
-		peer.receiveRemoteCandidates()
+var errNoAnswer = errors.New("remote peer did not answer ice offer")
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-		defer cancel()
-		// Block here until dialing succeeds with remote candidate pair
-		peer.conn, err = peer.agent.Dial(ctx, remoteCreds.ufrag, remoteCreds.pwd)
-		if err != nil {
-			log.Printf("error dialing remote peer %d: %v", peer.ID, err)
-			return
+// newAttempt returns the current agent and a context for a connection attempt
+// using it. The context is cancelled when the attempt is abandoned through
+// glare resolution or the peer state is reset
+func (peer *Peer) newAttempt() (context.Context, *ice.Agent) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.cancelAttemptLocked()
+	peer.attemptCancel = cancel
+	return ctx, peer.agent
+}
+
+func (peer *Peer) cancelAttemptLocked() {
+	if peer.attemptCancel != nil {
+		peer.attemptCancel()
+		peer.attemptCancel = nil
+	}
+}
+
+// dialICE offers the agent's credentials to the remote peer and dials the
+// remote candidates once the answer is received
+func (peer *Peer) dialICE(ctx context.Context, agent *ice.Agent) (*ice.Conn, error) {
+	localUfrag, localPwd, err := agent.GetLocalUserCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("error getting local user credentials: %w", err)
+	}
+
+	// Discard answers to earlier offers
+	for len(peer.iceCredentials) > 0 {
+		<-peer.iceCredentials
+	}
+
+	var remoteCreds IceCreds
+	// Block here waiting for ice credentials from remote peer
+	answered := func() bool {
+		t := time.NewTimer(time.Second * 10)
+		timeout := time.NewTimer(time.Second * 30)
+		defer t.Stop()
+		defer timeout.Stop()
+
+		for {
+			// Agent was replaced by a reset, abandon this attempt
+			if !peer.isCurrentAgent(agent) {
+				return false
+			}
+			// Send offer to remote peer with local credentials
+			peer.node.sendPeerIceOffer(peer.ID, localUfrag, localPwd)
+			select {
+			case remoteCreds = <-peer.iceCredentials:
+				return true
+			case <-t.C:
+				t.Reset(time.Second * 10)
+				continue
+			case <-timeout.C:
+				return false
+			case <-ctx.Done():
+				return false
+			}
 		}
-		peer.setupNoiseState()
 	}()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if !answered {
+		return nil, errNoAnswer
+	}
+
+	if err = agent.GatherCandidates(); err != nil {
+		return nil, fmt.Errorf("error gathering candidates: %w", err)
+	}
+
+	// Async loop to add remote candidates when received
+	peer.receiveRemoteCandidates(agent)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	// Block here until dialing succeeds with remote candidate pair
+	return agent.Dial(ctx, remoteCreds.ufrag, remoteCreds.pwd)
 }
 
+// RespondConnection answers an ICE offer from the remote peer. An offer while
+// the session is relayed is the remote peer trying to upgrade to a direct path.
+// An offer crossing our own is resolved by winsGlare
 func (peer *Peer) RespondConnection(creds IceCreds) {
 	log.Println("Responding connection")
-	if peer.connecting.Load() || peer.inTransport.Load() {
+	if peer.inTransport.Load() {
+		if peer.relayed.Load() {
+			go peer.acceptUpgrade(creds)
+		}
 		return
 	}
-	peer.connecting.Store(true)
-	peer.initiator.Store(false)
-	go func() {
-		localUfrag, localPwd, err := peer.agent.GetLocalUserCredentials()
-		if err != nil {
-			log.Println("error getting local user credentials: ", err)
+	if peer.connecting.Load() && peer.initiator.Load() {
+		if peer.winsGlare() {
+			debugf("peer %d offer crossed ours, keeping initiator role", peer.ID)
 			return
 		}
-
-		// Send answer back to remote peer with local creds
-		peer.node.sendPeerIceAnswer(peer.ID, localUfrag, localPwd)
-
-		if err = peer.agent.GatherCandidates(); err != nil {
-			log.Println("error gathering candidates: ", err)
+		log.Printf("peer %d offer crossed ours, yielding initiator role", peer.ID)
+		if err := peer.abandonAttempt(); err != nil {
+			log.Printf("peer %d error creating ice agent: %s", peer.ID, err)
 			peer.connecting.Store(false)
 			return
 		}
+		// Still connecting, the attempt continues as the responder
+	} else if !peer.connecting.CompareAndSwap(false, true) {
+		return
+	}
+	peer.initiator.Store(false)
 
-		// Async loop to add remote candidates when received
-		peer.receiveRemoteCandidates()
+	ctx, agent := peer.newAttempt()
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-		defer cancel()
-		peer.conn, err = peer.agent.Accept(ctx, creds.ufrag, creds.pwd)
+	go func() {
+		conn, err := peer.acceptICE(ctx, agent, creds)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Printf("error accepting remote peer %d: %v", peer.ID, err)
+			if !peer.connectRelay(agent) {
+				peer.connecting.Store(false)
+			}
+			return
+		}
+		if !peer.setConn(agent, conn) {
+			return
 		}
 		peer.setupNoiseState()
 	}()
 }
 
+// winsGlare reports whether this side keeps the initiator role when both
+// peers offered at the same time. The peer with the lower ID initiates, so
+// both sides agree without another round trip
+func (peer *Peer) winsGlare() bool {
+	return peer.node.id < peer.ID
+}
+
+// abandonAttempt cancels our in-flight offer so the remote peer's offer can be
+// answered. The agent our offer was made with is replaced, as the remote peer
+// will never answer it
+func (peer *Peer) abandonAttempt() error {
+	peer.mu.Lock()
+	peer.cancelAttemptLocked()
+	peer.mu.Unlock()
+
+	_, err := peer.replaceAgent()
+	return err
+}
+
+// acceptICE answers an offer with the agent's credentials and accepts a
+// connection from the remote candidates
+func (peer *Peer) acceptICE(ctx context.Context, agent *ice.Agent, creds IceCreds) (*ice.Conn, error) {
+	localUfrag, localPwd, err := agent.GetLocalUserCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("error getting local user credentials: %w", err)
+	}
+
+	// Send answer back to remote peer with local creds
+	peer.node.sendPeerIceAnswer(peer.ID, localUfrag, localPwd)
+
+	if err = agent.GatherCandidates(); err != nil {
+		return nil, fmt.Errorf("error gathering candidates: %w", err)
+	}
+
+	// Async loop to add remote candidates when received
+	peer.receiveRemoteCandidates(agent)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	return agent.Accept(ctx, creds.ufrag, creds.pwd)
+}
+
+// abandonConnectAttempt gives up on a pending connection attempt when the
+// controller reports our signaling can't reach the peer, instead of waiting
+// for the attempt to time out. The next outbound packet starts a new attempt
+func (peer *Peer) abandonConnectAttempt(reason string) {
+	if peer.inTransport.Load() || !peer.connecting.Load() {
+		return
+	}
+	log.Printf("peer %d %s, abandoning connection attempt", peer.ID, reason)
+	peer.ResetState()
+}
+
+func (peer *Peer) isCurrentAgent(agent *ice.Agent) bool {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return peer.agent == agent
+}
+
+// setConn stores the ICE conn if it belongs to the current agent. Connections
+// from an agent replaced by a reset are closed and discarded
+func (peer *Peer) setConn(agent *ice.Agent, conn *ice.Conn) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.agent != agent {
+		conn.Close()
+		return false
+	}
+	peer.conn = conn
+	return true
+}
+
 func (peer *Peer) cancelReceiveRemoteCandidates() {
 	select {
 	case peer.candidatesDone <- struct{}{}:
@@ -507,20 +581,23 @@ func (peer *Peer) cancelReceiveRemoteCandidates() {
 	}
 }
 
-func (peer *Peer) receiveRemoteCandidates() {
-	peer.candidatesDone = make(chan struct{})
+func (peer *Peer) receiveRemoteCandidates(agent *ice.Agent) {
+	done := make(chan struct{})
+	peer.candidatesDone = done
 	go func() {
 		for {
 			select {
 			case c := <-peer.iceCandidates:
-				peer.agent.AddRemoteCandidate(c)
-			case <-peer.candidatesDone:
+				agent.AddRemoteCandidate(c)
+			case <-done:
 				return
 			}
 		}
 	}()
 }
 
+// ResetState tears down the peer's ICE agent and noise session and replaces them
+// with fresh ones, so a new connection can be established using the current keys
 func (peer *Peer) ResetState() {
 	// Temporarily stop peer while resetting state
 	// to prevent peer trying to process packets while clearing
@@ -534,8 +611,60 @@ func (peer *Peer) ResetState() {
 
 	peer.mu.Lock()
 	defer peer.mu.Unlock()
-	peer.agent.Close()
-	peer.inTransport.Store(false)
+
+	peer.closeTransportLocked()
+
+	peer.noiseConn = noiseconn.NewNoiseConn(peer.node.keyPair(), peer.remoteStatic)
+	agent, err := peer.newAgent()
+	if err != nil {
+		log.Printf("peer %d error creating new ice agent: %s", peer.ID, err)
+		return
+	}
+	peer.agent = agent
+}
+
+// closeTransportLocked blocks the outbound routine until a new handshake
+// completes and closes the current ICE agent and noise session.
+// Closing the agent also closes the ICE conn which unblocks the inbound routine
+func (peer *Peer) closeTransportLocked() {
+	if peer.inTransport.CompareAndSwap(true, false) {
+		peer.pendingLock.Lock()
+	}
+	peer.connecting.Store(false)
+	peer.cancelAttemptLocked()
+	peer.cancelReceiveRemoteCandidates()
+
+	if peer.agent != nil {
+		peer.agent.Close()
+	}
+	// Unblock any reader holding the noise conn before closing it
+	if peer.conn != nil {
+		peer.conn.Close()
+	}
+	peer.noiseConn.Close()
+	peer.conn = nil
+	peer.relayed.Store(false)
+}
+
+// UpdateRemoteKey replaces the remote static key for the peer and tears down the
+// current session so the next handshake is performed with the new key
+func (peer *Peer) UpdateRemoteKey(key []byte) {
+	peer.mu.Lock()
+	peer.remoteStatic = key
+	peer.mu.Unlock()
+
+	log.Printf("peer %d public key changed, resetting session", peer.ID)
+	peer.Reconnect()
+}
+
+// Reconnect resets the peer session and initiates a new connection if this side
+// initiated the previous one. The responder waits for a new offer instead
+func (peer *Peer) Reconnect() {
+	wasConnected := peer.inTransport.Load() || peer.connecting.Load()
+	peer.ResetState()
+	if wasConnected && peer.initiator.Load() {
+		peer.InitiateConnection()
+	}
 }
 
 func (peer *Peer) flushOutboundQueue() {
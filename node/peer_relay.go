@@ -0,0 +1,146 @@
+package node
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pion/ice/v3"
+)
+
+const (
+	// Interval the initiator retries ICE while a session is relayed
+	RelayUpgradeInterval = time.Minute
+	// Time to wait for the remote side to start its handshake over the relay
+	RelayHandshakeTimeout = time.Second * 10
+)
+
+// connectRelay falls back to the relay after ICE failed to find a direct path
+// and runs the noise handshake over it. It reports false if no relay is
+// connected, leaving the failed attempt to the caller
+func (peer *Peer) connectRelay(agent *ice.Agent) bool {
+	client := peer.node.relay.Load()
+	if client == nil || !client.Connected() {
+		return false
+	}
+
+	conn := client.Conn(peer.ID)
+	// The remote side may not fall back to the relay, don't wait on it forever.
+	// The deadline is cleared once the handshake completes
+	conn.SetDeadline(time.Now().Add(RelayHandshakeTimeout))
+
+	peer.mu.Lock()
+	if peer.agent != agent {
+		// Peer was reset during the attempt
+		peer.mu.Unlock()
+		conn.Close()
+		return true
+	}
+	peer.conn = conn
+	peer.relayed.Store(true)
+	peer.mu.Unlock()
+
+	log.Printf("peer %d no direct path found, connecting through relay", peer.ID)
+	peer.setupNoiseState()
+	return true
+}
+
+// upgradeRoutine retries ICE while the session is relayed and moves the
+// session to the direct path once one is found
+func (peer *Peer) upgradeRoutine(session uint64) {
+	ticker := time.NewTicker(RelayUpgradeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !peer.running.Load() || !peer.inTransport.Load() || peer.session.Load() != session || !peer.relayed.Load() {
+			return
+		}
+
+		agent, err := peer.replaceAgent()
+		if err != nil {
+			log.Printf("peer %d error creating ice agent: %s", peer.ID, err)
+			continue
+		}
+
+		conn, err := peer.dialICE(context.Background(), agent)
+		if err != nil {
+			debugf("peer %d direct path still unavailable: %s", peer.ID, err)
+			continue
+		}
+		if peer.switchConn(agent, conn) {
+			log.Printf("peer %d upgraded from relay to direct path", peer.ID)
+			return
+		}
+	}
+}
+
+// acceptUpgrade answers an upgrade attempt from the remote peer while relayed
+func (peer *Peer) acceptUpgrade(creds IceCreds) {
+	if !peer.upgrading.CompareAndSwap(false, true) {
+		return
+	}
+	defer peer.upgrading.Store(false)
+
+	agent, err := peer.replaceAgent()
+	if err != nil {
+		log.Printf("peer %d error creating ice agent: %s", peer.ID, err)
+		return
+	}
+
+	conn, err := peer.acceptICE(context.Background(), agent, creds)
+	if err != nil {
+		debugf("peer %d direct path still unavailable: %s", peer.ID, err)
+		return
+	}
+	if peer.switchConn(agent, conn) {
+		log.Printf("peer %d upgraded from relay to direct path", peer.ID)
+	}
+}
+
+// replaceAgent closes the current ICE agent and installs a new one without
+// touching the noise session
+func (peer *Peer) replaceAgent() (*ice.Agent, error) {
+	agent, err := peer.newAgent()
+	if err != nil {
+		return nil, err
+	}
+
+	peer.mu.Lock()
+	old := peer.agent
+	peer.agent = agent
+	peer.mu.Unlock()
+
+	peer.cancelReceiveRemoteCandidates()
+	if old != nil {
+		old.Close()
+	}
+	return agent, nil
+}
+
+// switchConn moves the current noise session from the relay to conn. Packets
+// in flight on the relay are lost, the session keys are unchanged
+func (peer *Peer) switchConn(agent *ice.Agent, conn *ice.Conn) bool {
+	peer.mu.Lock()
+	if peer.agent != agent || !peer.inTransport.Load() || !peer.relayed.Load() {
+		peer.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	old := peer.conn
+	nc := peer.noiseConn
+	peer.conn = conn
+	peer.relayed.Store(false)
+	peer.mu.Unlock()
+
+	// Unblock the inbound routine reading from the relay so the noise conn can
+	// be swapped. The relay conn is only closed once the swap is done, as the
+	// inbound routine exits when the conn it reads from is closed
+	if old != nil {
+		old.SetReadDeadline(time.Now())
+	}
+	nc.SetConn(conn)
+	if old != nil {
+		old.Close()
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+//go:build darwin || freebsd
+
+package node
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const peerCredSupported = true
+
+// peerCred returns the credentials of the process connected to a unix socket.
+// LOCAL_PEERCRED doesn't report the pid, the first group is the effective gid
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Xucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	pc := &PeerCred{UID: cred.Uid}
+	if cred.Ngroups > 0 {
+		pc.GID = cred.Groups[0]
+	}
+	return pc, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package node
+
+import "net"
+
+const peerCredSupported = false
+
+// peerCred is not supported, socket permissions decide who may connect
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errPeerCredUnsupported
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	proto "github.com/caldog20/zeronet/proto/gen/controller/v1"
+)
+
+// RemovePeer removes a peer from the node and tears down its ICE agent and
+// noise session. Packets for its overlay IP are dropped from then on
+func (node *Node) RemovePeer(id uint32) {
+	node.maps.l.Lock()
+	peer, found := node.maps.id[id]
+	if found {
+		node.deletePeerLocked(peer)
+	}
+	node.maps.l.Unlock()
+
+	if !found {
+		return
+	}
+	log.Printf("removing peer %d", id)
+	peer.Close()
+}
+
+// deletePeerLocked removes the peer from both maps. The IP mapping is only
+// removed if it still points at this peer
+func (node *Node) deletePeerLocked(peer *Peer) {
+	delete(node.maps.id, peer.ID)
+	peer.mu.RLock()
+	ip := peer.IP
+	peer.mu.RUnlock()
+	if node.maps.ip[ip] == peer {
+		delete(node.maps.ip, ip)
+	}
+}
+
+// UpdatePeer applies changed attributes from the controller to a known peer.
+// Hostname and IP are swapped in both maps under a single lock so lookups
+// never see a half applied update. A changed public key restarts the session
+func (node *Node) UpdatePeer(info *proto.Peer) error {
+	ip, err := ParseAddr(info.GetIp())
+	if err != nil {
+		return fmt.Errorf("error parsing peer ip: %w", err)
+	}
+	key, err := DecodeBase64Key(info.GetPublicKey())
+	if err != nil {
+		return fmt.Errorf("error decoding noise public key for peer: %w", err)
+	}
+
+	node.maps.l.Lock()
+	peer, found := node.maps.id[info.GetId()]
+	if !found {
+		node.maps.l.Unlock()
+		return fmt.Errorf("peer %d not found", info.GetId())
+	}
+
+	// Another peer still holding the IP is stale, the controller reassigned it
+	stale, taken := node.maps.ip[ip]
+	if taken && stale != peer {
+		node.deletePeerLocked(stale)
+	} else {
+		stale = nil
+	}
+
+	peer.mu.Lock()
+	if peer.IP != ip {
+		log.Printf("peer %d ip changed from %s to %s", peer.ID, peer.IP, ip)
+		if node.maps.ip[peer.IP] == peer {
+			delete(node.maps.ip, peer.IP)
+		}
+		peer.IP = ip
+	}
+	node.maps.ip[ip] = peer
+	peer.Hostname = info.GetHostname()
+	keyChanged := !bytes.Equal(peer.remoteStatic, key)
+	peer.mu.Unlock()
+	node.maps.l.Unlock()
+
+	if stale != nil {
+		log.Printf("removing peer %d, its ip was reassigned to peer %d", stale.ID, peer.ID)
+		stale.Close()
+	}
+	if keyChanged {
+		peer.UpdateRemoteKey(key)
+	}
+	return nil
+}
+
+// Close stops the peer and releases its ICE agent and noise session.
+// The peer can't be started again
+func (peer *Peer) Close() {
+	peer.Stop()
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	// Stop only tears down the transport of a running peer
+	peer.closeTransportLocked()
+}
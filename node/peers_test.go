@@ -0,0 +1,243 @@
+package node
+
+import (
+	"encoding/base64"
+	"net/netip"
+	"testing"
+
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+)
+
+func testPeerInfo(t *testing.T, id uint32, ip, hostname string) *controllerv1.Peer {
+	keypair, err := GenerateNewKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &controllerv1.Peer{
+		Id:        id,
+		Hostname:  hostname,
+		Ip:        ip,
+		PublicKey: base64.StdEncoding.EncodeToString(keypair.Public),
+		Connected: true,
+	}
+}
+
+func requirePeerAt(t *testing.T, node *Node, id uint32, ip string) {
+	t.Helper()
+	addr := netip.MustParseAddr(ip)
+	node.maps.l.RLock()
+	defer node.maps.l.RUnlock()
+	byID, found := node.maps.id[id]
+	if !found {
+		t.Fatalf("peer %d not found by id", id)
+	}
+	if byIP := node.maps.ip[addr]; byIP != byID {
+		t.Fatalf("ip %s does not map to peer %d", ip, id)
+	}
+}
+
+func TestUpdatePeerAttributes(t *testing.T) {
+	c := newFakeController(false)
+	node := c.addNode(t, 1)
+
+	info := testPeerInfo(t, 2, "100.70.0.2", "before")
+	if _, err := node.AddPeer(info); err != nil {
+		t.Fatal(err)
+	}
+
+	info.Ip = "100.70.0.20"
+	info.Hostname = "after"
+	if err := node.UpdatePeer(info); err != nil {
+		t.Fatal(err)
+	}
+
+	requirePeerAt(t, node, 2, "100.70.0.20")
+	if _, found := node.LookupPeerIP("100.70.0.2"); found {
+		t.Fatal("old ip still maps to a peer")
+	}
+	if ip, found := node.LookupPeerIP("after"); !found || ip.String() != "100.70.0.20" {
+		t.Fatalf("hostname lookup = %s %v", ip, found)
+	}
+}
+
+func TestUpdatePeerKey(t *testing.T) {
+	c := newFakeController(false)
+	node := c.addNode(t, 1)
+
+	info := testPeerInfo(t, 2, "100.70.0.2", "peer")
+	peer, err := node.AddPeer(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info.PublicKey = testPeerInfo(t, 2, "", "").PublicKey
+	if err = node.UpdatePeer(info); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := DecodeBase64Key(info.PublicKey)
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	if string(peer.remoteStatic) != string(key) {
+		t.Fatal("remote key was not updated")
+	}
+}
+
+func TestReassignedIPRemovesStalePeer(t *testing.T) {
+	c := newFakeController(false)
+	node := c.addNode(t, 1)
+
+	if _, err := node.AddPeer(testPeerInfo(t, 2, "100.70.0.2", "old")); err != nil {
+		t.Fatal(err)
+	}
+	// Peer 2 was deleted without a disconnect reaching this node
+	if _, err := node.AddPeer(testPeerInfo(t, 3, "100.70.0.2", "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	requirePeerAt(t, node, 3, "100.70.0.2")
+	if _, found := node.lookupPeer(2); found {
+		t.Fatal("stale peer was not removed")
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	c := newFakeController(false)
+	node := c.addNode(t, 1)
+
+	peer, err := node.AddPeer(testPeerInfo(t, 2, "100.70.0.2", "peer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	node.handlePeerDeleteUpdate(&controllerv1.UpdateResponse{
+		UpdateType: controllerv1.UpdateType_DELETE,
+		PeerList: &controllerv1.PeerList{
+			Count: 1,
+			Peers: []*controllerv1.Peer{{Id: 2}},
+		},
+	})
+
+	if _, found := node.lookupPeer(2); found {
+		t.Fatal("peer still found by id")
+	}
+	if _, found := node.LookupPeerIP("100.70.0.2"); found {
+		t.Fatal("peer still found by ip")
+	}
+	if peer.running.Load() {
+		t.Fatal("removed peer is still running")
+	}
+}
+
+func TestDisconnectKeepsPeer(t *testing.T) {
+	c := newFakeController(false)
+	node := c.addNode(t, 1)
+
+	peer, err := node.AddPeer(testPeerInfo(t, 2, "100.70.0.2", "peer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	node.handlePeerDisconnectUpdate(&controllerv1.UpdateResponse{
+		UpdateType: controllerv1.UpdateType_DISCONNECT,
+		PeerList: &controllerv1.PeerList{
+			Count: 1,
+			Peers: []*controllerv1.Peer{{Id: 2}},
+		},
+	})
+
+	requirePeerAt(t, node, 2, "100.70.0.2")
+	if !peer.running.Load() {
+		t.Fatal("offline peer was stopped")
+	}
+}
+
+func TestInitialSyncReconciles(t *testing.T) {
+	c := newFakeController(false)
+	node := c.addNode(t, 1)
+
+	kept := testPeerInfo(t, 2, "100.70.0.2", "kept")
+	if _, err := node.AddPeer(kept); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.AddPeer(testPeerInfo(t, 3, "100.70.0.3", "gone")); err != nil {
+		t.Fatal(err)
+	}
+	offline := testPeerInfo(t, 5, "100.70.0.5", "offline")
+	if _, err := node.AddPeer(offline); err != nil {
+		t.Fatal(err)
+	}
+	unknown := testPeerInfo(t, 6, "100.70.0.6", "unknown")
+
+	// Peer 3 was deleted, peer 4 joined and peers 5 and 6 lost their
+	// update streams while the stream was down
+	kept.Hostname = "renamed"
+	offline.Connected = false
+	unknown.Connected = false
+	node.handleInitialSync(&controllerv1.UpdateResponse{
+		UpdateType: controllerv1.UpdateType_INIT,
+		PeerList: &controllerv1.PeerList{
+			Count: 4,
+			Peers: []*controllerv1.Peer{kept, testPeerInfo(t, 4, "100.70.0.4", "new"), offline, unknown},
+		},
+	})
+
+	requirePeerAt(t, node, 2, "100.70.0.2")
+	requirePeerAt(t, node, 4, "100.70.0.4")
+	requirePeerAt(t, node, 5, "100.70.0.5")
+	if _, found := node.lookupPeer(3); found {
+		t.Fatal("peer missing from init was not removed")
+	}
+	if _, found := node.lookupPeer(6); found {
+		t.Fatal("unknown offline peer was added")
+	}
+	if _, found := node.LookupPeerIP("renamed"); !found {
+		t.Fatal("hostname change was not applied")
+	}
+	for _, id := range []uint32{2, 4} {
+		if peer, _ := node.lookupPeer(id); !peer.running.Load() {
+			t.Fatalf("peer %d was not started", id)
+		}
+	}
+}
+
+func TestInitialSyncKeepsActiveSession(t *testing.T) {
+	requireHostCandidates(t)
+
+	c := newFakeController(false)
+	a := c.addNode(t, 1)
+	b := c.addNode(t, 2)
+	peerOfA, peerOfB := c.connect(t, a, b)
+	peerOfA.InitiateConnection()
+	waitForTransport(t, peerOfA, peerOfB)
+	session := peerOfA.session.Load()
+
+	// The controller restarted and node b hasn't reconnected its stream yet
+	info := &controllerv1.Peer{
+		Id:        b.id,
+		PublicKey: base64.StdEncoding.EncodeToString(b.noise.keyPair.Public),
+		Ip:        "100.70.0.2",
+	}
+	a.handlePeerDisconnectUpdate(&controllerv1.UpdateResponse{
+		UpdateType: controllerv1.UpdateType_DISCONNECT,
+		PeerList:   &controllerv1.PeerList{Count: 1, Peers: []*controllerv1.Peer{info}},
+	})
+	a.handleInitialSync(&controllerv1.UpdateResponse{
+		UpdateType: controllerv1.UpdateType_INIT,
+		PeerList:   &controllerv1.PeerList{Count: 1, Peers: []*controllerv1.Peer{info}},
+	})
+
+	requirePeerAt(t, a, 2, "100.70.0.2")
+	if peer, _ := a.lookupPeer(2); peer != peerOfA {
+		t.Fatal("peer was replaced")
+	}
+	if !peerOfA.inTransport.Load() || peerOfA.session.Load() != session {
+		t.Fatal("active session was torn down")
+	}
+}
@@ -0,0 +1,182 @@
+package node
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/caldog20/zeronet/noiseconn"
+	"github.com/caldog20/zeronet/pkg/header"
+	"github.com/pion/ice/v3"
+)
+
+const probeLen = 8
+
+var ErrPeerNotRunning = errors.New("peer is not running")
+
+type PingResult struct {
+	RTT time.Duration
+	// Candidate types of the selected pair the probe was sent over
+	LocalCandidateType  string
+	RemoteCandidateType string
+	// True if the peer had no session and the probe triggered a new connection
+	NewConnection bool
+	// True if the probe went through the controller relay
+	Relayed bool
+}
+
+// Ping sends an in-band probe to the peer over the noise session and waits for
+// the reply. If the peer is not connected, a connection is initiated first
+func (peer *Peer) Ping(ctx context.Context) (*PingResult, error) {
+	if !peer.running.Load() {
+		return nil, ErrPeerNotRunning
+	}
+
+	result := &PingResult{}
+	if !peer.inTransport.Load() {
+		result.NewConnection = true
+		peer.InitiateConnection()
+		if err := peer.waitForTransport(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	peer.mu.RLock()
+	nc := peer.noiseConn
+	agent := peer.agent
+	peer.mu.RUnlock()
+
+	id, reply := peer.addProbe()
+	defer peer.removeProbe(id)
+
+	probe := make([]byte, probeLen)
+	binary.BigEndian.PutUint64(probe, id)
+
+	start := time.Now()
+	if _, err := nc.WriteMessage(header.Probe, probe); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-reply:
+		result.RTT = time.Since(start)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if peer.relayed.Load() {
+		result.Relayed = true
+	} else if pair := selectedPair(agent); pair != nil {
+		result.LocalCandidateType = pair.Local.Type().String()
+		result.RemoteCandidateType = pair.Remote.Type().String()
+	}
+
+	return result, nil
+}
+
+func (peer *Peer) waitForTransport(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+
+	for !peer.inTransport.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if !peer.running.Load() {
+			return ErrPeerNotRunning
+		}
+	}
+
+	return nil
+}
+
+func (peer *Peer) addProbe() (uint64, chan struct{}) {
+	peer.probes.l.Lock()
+	defer peer.probes.l.Unlock()
+
+	peer.probes.next++
+	id := peer.probes.next
+	reply := make(chan struct{}, 1)
+	peer.probes.pending[id] = reply
+	return id, reply
+}
+
+func (peer *Peer) removeProbe(id uint64) {
+	peer.probes.l.Lock()
+	delete(peer.probes.pending, id)
+	peer.probes.l.Unlock()
+}
+
+// handleProbe echoes the probe back to the remote peer on the session it arrived on
+func (peer *Peer) handleProbe(nc *noiseconn.Conn, probe []byte) {
+	if len(probe) != probeLen {
+		return
+	}
+	if _, err := nc.WriteMessage(header.ProbeReply, probe); err != nil {
+		log.Printf("error sending probe reply to peer %d: %s", peer.ID, err)
+	}
+}
+
+func (peer *Peer) handleProbeReply(probe []byte) {
+	if len(probe) != probeLen {
+		return
+	}
+	id := binary.BigEndian.Uint64(probe)
+
+	peer.probes.l.Lock()
+	reply, found := peer.probes.pending[id]
+	peer.probes.l.Unlock()
+
+	if found {
+		select {
+		case reply <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// findPeer looks up a peer by ID, overlay IP or hostname
+func (node *Node) findPeer(target string) (*Peer, bool) {
+	if id, err := strconv.ParseUint(target, 10, 32); err == nil {
+		if peer, found := node.lookupPeer(uint32(id)); found {
+			return peer, true
+		}
+	}
+
+	node.maps.l.RLock()
+	defer node.maps.l.RUnlock()
+
+	if ip, err := netip.ParseAddr(target); err == nil {
+		peer, found := node.maps.ip[ip]
+		return peer, found
+	}
+
+	for _, peer := range node.maps.id {
+		peer.mu.RLock()
+		hostname := peer.Hostname
+		peer.mu.RUnlock()
+		if hostname == target {
+			return peer, true
+		}
+	}
+
+	return nil, false
+}
+
+// pathType describes a selected candidate pair as relay or direct
+func pathType(local, remote string) string {
+	switch {
+	case local == "" || remote == "":
+		return "unknown"
+	case local == ice.CandidateTypeRelay.String() || remote == ice.CandidateTypeRelay.String():
+		return "relay"
+	default:
+		return "direct"
+	}
+}
@@ -0,0 +1,295 @@
+package node
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/caldog20/zeronet/noiseconn"
+	"github.com/caldog20/zeronet/pkg/header"
+	"github.com/pion/ice/v3"
+)
+
+// The data plane is a staged pipeline modeled after wireguard-go.
+//
+// Outbound: processOutbound reserves a nonce for each packet in order, then
+// queues the buffer on both the peer's send queue and the node's shared
+// encryption queue. Any encryption worker can seal the packet, while
+// processSend writes sealed packets to the peer in the order they were queued.
+//
+// Inbound: processInbound reads packets for the current session in order and
+// queues them on the peer's receive queue and the shared decryption queue.
+// processReceive delivers opened packets in order.
+//
+// Each buffer's lock is taken before it is queued and released by the worker
+// once the crypto is done, so the ordered stage waits on it without extra channels.
+
+const (
+	CryptoQueueSize = 1024
+	// Maximum number of received packets written to the tunnel at once
+	ReceiveBatchSize = 128
+	// Repeated read errors on a session are logged at most this often
+	InboundErrorLogInterval = time.Second * 5
+	// Longest wait between reads after repeated read errors
+	InboundErrorBackoffMax = time.Second
+)
+
+// startCryptoWorkers starts the shared encryption and decryption workers.
+// Workers live for the lifetime of the node as peers may be started and stopped
+// at any time, stopCryptoWorkers ends them once the node is closed
+func (node *Node) startCryptoWorkers(workers int) {
+	node.encryptQueue = make(chan *OutboundBuffer, CryptoQueueSize)
+	node.decryptQueue = make(chan *InboundBuffer, CryptoQueueSize)
+	node.cryptoDone = make(chan struct{})
+
+	node.cryptoWG.Add(workers * 2)
+	for range workers {
+		go node.encryptWorker()
+		go node.decryptWorker()
+	}
+}
+
+// stopCryptoWorkers stops the workers and waits for them to exit. Peers must
+// be stopped first, as stopping a peer waits on buffers still being processed.
+// The queues are left open so a late send from a peer routine can't panic
+func (node *Node) stopCryptoWorkers() {
+	close(node.cryptoDone)
+	node.cryptoWG.Wait()
+}
+
+func (node *Node) encryptWorker() {
+	defer node.cryptoWG.Done()
+
+	for {
+		select {
+		case <-node.cryptoDone:
+			return
+		case buffer := <-node.encryptQueue:
+			buffer.sealed, buffer.err = buffer.sealer.Seal(buffer.out[:0], buffer.packet[:buffer.size])
+			buffer.lock.Unlock()
+		}
+	}
+}
+
+func (node *Node) decryptWorker() {
+	defer node.cryptoWG.Done()
+
+	for {
+		select {
+		case <-node.cryptoDone:
+			return
+		case buffer := <-node.decryptQueue:
+			buffer.plaintext, buffer.err = buffer.opener.Open(buffer.packet[:0])
+			buffer.lock.Unlock()
+		}
+	}
+}
+
+func (peer *Peer) processOutbound() {
+	defer peer.wg.Done()
+
+	for buffer := range peer.outbound {
+		if buffer == nil {
+			debugf("peer %d stopping, killing outbound routine", peer.ID)
+			peer.sendQueue <- nil
+			return
+		}
+
+		// Blocks until the noise handshake has completed
+		peer.pendingLock.RLock()
+		nc := peer.noiseConn
+		sealer, err := nc.NewSealer(header.Data)
+		peer.pendingLock.RUnlock()
+		if err != nil {
+			log.Printf("error preparing data packet for peer %d: %s", peer.ID, err)
+			PutOutboundBuffer(buffer)
+			continue
+		}
+
+		buffer.nc = nc
+		buffer.sealer = sealer
+		buffer.lock.Lock()
+		peer.sendQueue <- buffer
+		peer.node.encryptQueue <- buffer
+	}
+}
+
+func (peer *Peer) processSend() {
+	defer peer.wg.Done()
+
+	for buffer := range peer.sendQueue {
+		if buffer == nil {
+			return
+		}
+
+		// Wait for the encryption worker
+		buffer.lock.Lock()
+		err := buffer.err
+		if err == nil {
+			err = buffer.nc.WritePacket(buffer.sealed)
+		}
+		if err != nil {
+			log.Printf("error sending encrypted data packet to peer %d: %s", peer.ID, err)
+		} else {
+			peer.txBytes.Add(uint64(buffer.size))
+			peer.lastTx.Store(time.Now().UnixNano())
+		}
+		buffer.lock.Unlock()
+
+		PutOutboundBuffer(buffer)
+	}
+}
+
+// processInbound reads packets for a single session, exiting once the session
+// has been closed or replaced, or its conn is closed. A session left without
+// a reader stops receiving and is recovered by the peer's timers
+func (peer *Peer) processInbound(nc *noiseconn.Conn) {
+	var failures int
+	var lastLog time.Time
+
+	for {
+		buffer := GetInboundBuffer()
+		opener, err := nc.ReadPacket(buffer.in)
+		if err != nil {
+			PutInboundBuffer(buffer)
+			if !peer.running.Load() || !peer.inTransport.Load() || !peer.isCurrentSession(nc) {
+				debugf("peer %d no longer in transport, killing inbound routine", peer.ID)
+				return
+			}
+			if isConnClosed(err) {
+				log.Printf("peer %d transport conn closed, killing inbound routine", peer.ID)
+				return
+			}
+
+			// Back off on repeated errors and log at most once per interval.
+			// A deadline is set to interrupt the read when the conn is swapped
+			failures++
+			if !errors.Is(err, os.ErrDeadlineExceeded) && time.Since(lastLog) >= InboundErrorLogInterval {
+				log.Printf("error reading data packet from peer %d: %s (%d errors)", peer.ID, err, failures)
+				lastLog = time.Now()
+			}
+			time.Sleep(min(time.Millisecond<<min(failures-1, 10), InboundErrorBackoffMax))
+			continue
+		}
+		failures = 0
+
+		if !peer.running.Load() {
+			PutInboundBuffer(buffer)
+			return
+		}
+
+		buffer.nc = nc
+		buffer.opener = opener
+		buffer.lock.Lock()
+		peer.receiveQueue <- buffer
+		peer.node.decryptQueue <- buffer
+	}
+}
+
+func (peer *Peer) processReceive() {
+	defer peer.wg.Done()
+
+	buffers := make([]*InboundBuffer, 0, ReceiveBatchSize)
+	packets := make([][]byte, 0, ReceiveBatchSize)
+
+	for buffer := range peer.receiveQueue {
+		stop := buffer == nil
+		if !stop {
+			buffers = append(buffers, buffer)
+		}
+
+		// Take whatever else is already queued so the tunnel can coalesce it
+	drain:
+		for !stop && len(buffers) < cap(buffers) {
+			select {
+			case buffer = <-peer.receiveQueue:
+				if buffer == nil {
+					stop = true
+				} else {
+					buffers = append(buffers, buffer)
+				}
+			default:
+				break drain
+			}
+		}
+
+		for _, buffer := range buffers {
+			// Wait for the decryption worker
+			buffer.lock.Lock()
+			if buffer.err != nil {
+				debugf("error decrypting packet from peer %d: %s", peer.ID, buffer.err)
+			} else if packet := peer.handleMessage(buffer); packet != nil {
+				packets = append(packets, packet)
+			}
+			buffer.lock.Unlock()
+		}
+
+		if len(packets) > 0 {
+			if _, err := peer.node.tun.WriteBatch(packets); err != nil {
+				debugf("error writing packets from peer %d to tunnel: %s", peer.ID, err)
+			}
+		}
+
+		for i, buffer := range buffers {
+			PutInboundBuffer(buffer)
+			buffers[i] = nil
+		}
+		buffers = buffers[:0]
+		clear(packets)
+		packets = packets[:0]
+
+		if stop {
+			return
+		}
+	}
+}
+
+// handleMessage returns the packet to write to the tunnel, if any
+func (peer *Peer) handleMessage(buffer *InboundBuffer) []byte {
+	n := len(buffer.plaintext)
+	peer.rxBytes.Add(uint64(n))
+	peer.lastRx.Store(time.Now().UnixNano())
+
+	switch buffer.opener.Type() {
+	case header.Data:
+		// Empty data messages are keepalives
+		if n > 0 {
+			return buffer.plaintext
+		}
+	case header.Probe:
+		peer.handleProbe(buffer.nc, buffer.plaintext)
+	case header.ProbeReply:
+		peer.handleProbeReply(buffer.plaintext)
+	}
+
+	return nil
+}
+
+func (peer *Peer) flushReceiveQueue() {
+	for {
+		select {
+		case buffer := <-peer.receiveQueue:
+			if buffer == nil {
+				continue
+			}
+			// Wait for any in progress decryption before returning the buffer
+			buffer.lock.Lock()
+			buffer.lock.Unlock()
+			PutInboundBuffer(buffer)
+		default:
+			return
+		}
+	}
+}
+
+// isConnClosed reports whether err means the session's conn was closed and no
+// more packets can be read from it
+func isConnClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, ice.ErrClosed)
+}
@@ -0,0 +1,244 @@
+package node
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caldog20/zeronet/node/tun"
+	"github.com/caldog20/zeronet/noiseconn"
+	"github.com/flynn/noise"
+)
+
+var memPacketPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, BufferSize)
+	return &b
+}}
+
+// memConn is a lossless in-memory datagram conn using pooled packet buffers,
+// so the transport doesn't add allocations to the benchmarks
+type memConn struct {
+	in        chan *[]byte
+	out       chan *[]byte
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func newMemConnPair() (*memConn, *memConn) {
+	ab := make(chan *[]byte, 1024)
+	ba := make(chan *[]byte, 1024)
+	closed := make(chan struct{})
+	once := new(sync.Once)
+	return &memConn{in: ba, out: ab, closed: closed, closeOnce: once},
+		&memConn{in: ab, out: ba, closed: closed, closeOnce: once}
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	select {
+	case b := <-c.in:
+		n := copy(p, *b)
+		memPacketPool.Put(b)
+		return n, nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	b := memPacketPool.Get().(*[]byte)
+	*b = append((*b)[:0], p...)
+	select {
+	case c.out <- b:
+		return len(p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *memConn) LocalAddr() net.Addr                { return nil }
+func (c *memConn) RemoteAddr() net.Addr               { return nil }
+
+// countingTun counts packets written by the inbound pipeline
+type countingTun struct {
+	tun.Tun
+	packets  atomic.Uint64
+	target   uint64
+	done     chan struct{}
+	onPacket func(b []byte)
+}
+
+func (t *countingTun) Write(b []byte) (int, error) {
+	if t.onPacket != nil {
+		t.onPacket(b)
+	}
+	if t.packets.Add(1) == t.target {
+		close(t.done)
+	}
+	return len(b), nil
+}
+
+func (t *countingTun) WriteBatch(bufs [][]byte) (int, error) {
+	for _, b := range bufs {
+		t.Write(b)
+	}
+	return len(bufs), nil
+}
+
+func newPipelinePeer(t testing.TB, workers int, local, remote noise.DHKey, conn net.Conn, initiator bool) (*Peer, *countingTun) {
+	tun := &countingTun{done: make(chan struct{})}
+	node := &Node{tun: tun}
+	node.startCryptoWorkers(workers)
+	// Registered first so it runs after the peers are stopped
+	t.Cleanup(node.stopCryptoWorkers)
+
+	peer := NewPeer()
+	peer.node = node
+	peer.noiseConn = noiseconn.NewNoiseConn(local, remote.Public)
+	peer.conn = conn
+	peer.initiator.Store(initiator)
+	if err := peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return peer, tun
+}
+
+// newPipelinePair connects two peers over an in-memory transport, returning
+// the sending peer and the tunnel of the receiving peer
+func newPipelinePair(t testing.TB, workers int) (*Peer, *countingTun) {
+	c1, c2 := newMemConnPair()
+	sender, _, recvTun := connectPipelinePeers(t, workers, c1, c2)
+	return sender, recvTun
+}
+
+// connectPipelinePeers starts two peers over c1 and c2 and completes the
+// noise handshake between them
+func connectPipelinePeers(t testing.TB, workers int, c1, c2 net.Conn) (*Peer, *Peer, *countingTun) {
+	k1, err := GenerateNewKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := GenerateNewKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, _ := newPipelinePeer(t, workers, k1, k2, c1, true)
+	receiver, recvTun := newPipelinePeer(t, workers, k2, k1, c2, false)
+
+	errs := make(chan error, 2)
+	go func() { errs <- sender.setupNoiseState() }()
+	go func() { errs <- receiver.setupNoiseState() }()
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() {
+		sender.Stop()
+		receiver.Stop()
+	})
+
+	return sender, receiver, recvTun
+}
+
+func sendPackets(sender *Peer, payload []byte, count int) {
+	for i := range count {
+		buffer := GetOutboundBuffer()
+		buffer.size = copy(buffer.packet, payload)
+		binary.BigEndian.PutUint32(buffer.packet, uint32(i))
+		sender.outbound <- buffer
+	}
+}
+
+func TestPipelinePreservesOrder(t *testing.T) {
+	sender, recvTun := newPipelinePair(t, runtime.NumCPU())
+
+	const count = 10000
+	next := uint32(0)
+	outOfOrder := 0
+	recvTun.target = count
+	// Only called from the peer's receive routine
+	recvTun.onPacket = func(b []byte) {
+		if binary.BigEndian.Uint32(b) != next {
+			outOfOrder++
+		}
+		next++
+	}
+
+	sendPackets(sender, make([]byte, 1300), count)
+
+	select {
+	case <-recvTun.done:
+	case <-time.After(time.Second * 10):
+		t.Fatalf("timed out, received %d of %d packets", recvTun.packets.Load(), count)
+	}
+
+	if outOfOrder != 0 {
+		t.Fatalf("%d packets delivered out of order", outOfOrder)
+	}
+}
+
+// readCountingConn counts reads so a test can tell whether a routine is still
+// reading from the conn
+type readCountingConn struct {
+	*memConn
+	reads atomic.Uint64
+}
+
+func (c *readCountingConn) Read(p []byte) (int, error) {
+	c.reads.Add(1)
+	return c.memConn.Read(p)
+}
+
+func TestInboundExitsOnClosedConn(t *testing.T) {
+	c1, c2 := newMemConnPair()
+	conn := &readCountingConn{memConn: c2}
+	_, receiver, _ := connectPipelinePeers(t, 1, c1, conn)
+
+	// The session stays current, only its conn goes away
+	conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	reads := conn.reads.Load()
+	time.Sleep(time.Millisecond * 200)
+
+	if n := conn.reads.Load(); n != reads {
+		t.Fatalf("inbound routine still reading after the conn was closed, %d reads in 200ms", n-reads)
+	}
+	if !receiver.inTransport.Load() {
+		t.Fatal("session was reset, the test no longer covers a current session")
+	}
+}
+
+// BenchmarkPipeline measures throughput of a single peer through both the
+// outbound and inbound pipelines with an increasing number of crypto workers
+func BenchmarkPipeline(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			sender, recvTun := newPipelinePair(b, workers)
+			recvTun.target = uint64(b.N)
+			payload := make([]byte, 1300)
+
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			sendPackets(sender, payload, b.N)
+			<-recvTun.done
+		})
+	}
+}
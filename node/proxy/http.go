@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServeHTTPConnect runs an HTTP proxy on l that only supports CONNECT tunnels
+func (s *Server) ServeHTTPConnect(l net.Listener) error {
+	return serve(l, func(conn net.Conn) {
+		logError("http", s.handleHTTPConnect(conn))
+	})
+}
+
+func (s *Server) handleHTTPConnect(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+
+	if req.Method != http.MethodConnect {
+		httpReply(conn, http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		httpReply(conn, http.StatusBadRequest)
+		return err
+	}
+
+	remote, err := s.dial(host, port)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errUnknownHost) {
+			status = http.StatusNotFound
+		}
+		httpReply(conn, status)
+		return fmt.Errorf("error connecting to %s: %w", req.Host, err)
+	}
+	defer remote.Close()
+
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Forward anything the client sent after the request headers
+	if n := reader.Buffered(); n > 0 {
+		b, _ := reader.Peek(n)
+		if _, err = remote.Write(b); err != nil {
+			return err
+		}
+	}
+
+	pipe(conn, remote)
+	return nil
+}
+
+func httpReply(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
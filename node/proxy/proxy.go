@@ -0,0 +1,89 @@
+// Package proxy implements local SOCKS5 and HTTP CONNECT proxies that dial
+// into the overlay network, for nodes running without a kernel tunnel
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const dialTimeout = time.Second * 10
+
+// DialFunc dials address through the overlay
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// ResolveFunc resolves an overlay hostname to a peer IP
+type ResolveFunc func(host string) (netip.Addr, bool)
+
+type Server struct {
+	Dial    DialFunc
+	Resolve ResolveFunc
+}
+
+func NewServer(dial DialFunc, resolve ResolveFunc) *Server {
+	return &Server{Dial: dial, Resolve: resolve}
+}
+
+// serve accepts connections on l and handles each with handler until l is closed
+func serve(l net.Listener, handler func(net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go handler(conn)
+	}
+}
+
+// dial resolves host through the overlay hostnames and connects to it
+func (s *Server) dial(host, port string) (net.Conn, error) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		var found bool
+		if s.Resolve != nil {
+			addr, found = s.Resolve(host)
+		}
+		if !found {
+			return nil, errUnknownHost
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return s.Dial(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+}
+
+var errUnknownHost = errors.New("unknown host")
+
+// pipe copies data between a and b until both directions are done
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Half close so the other direction can drain
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+func logError(proto string, err error) {
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("%s proxy: %s", proto, err)
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+// echoServer returns a dialer that connects every address to a local echo
+// server and records the dialed addresses
+func echoServer(t *testing.T) (DialFunc, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	dialed := make(chan string, 1)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}
+	return dial, dialed
+}
+
+func resolver(host string) (netip.Addr, bool) {
+	if host == "peer1" {
+		return netip.MustParseAddr("100.70.0.2"), true
+	}
+	return netip.Addr{}, false
+}
+
+func startProxy(t *testing.T, serve func(net.Listener) error) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serve(l)
+	return l.Addr().String()
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("hello overlay")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Fatalf("echo mismatch: %q", buf)
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	dial, dialed := echoServer(t)
+	addr := startProxy(t, NewServer(dial, resolver).ServeSOCKS5)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5AuthNone {
+		t.Fatalf("unexpected auth method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0, socks5AddrDomain, 5}
+	req = append(req, "peer1"...)
+	req = append(req, 0x1f, 0x90)
+	conn.Write(req)
+
+	reply = make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5Succeeded {
+		t.Fatalf("connect failed with code %d", reply[1])
+	}
+	if got := <-dialed; got != "100.70.0.2:8080" {
+		t.Fatalf("dialed %s, expected 100.70.0.2:8080", got)
+	}
+
+	expectEcho(t, conn)
+}
+
+func TestSOCKS5UnknownHost(t *testing.T) {
+	dial, _ := echoServer(t)
+	addr := startProxy(t, NewServer(dial, resolver).ServeSOCKS5)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	req := []byte{socks5Version, socks5CmdConnect, 0, socks5AddrDomain, 7}
+	req = append(req, "missing"...)
+	req = append(req, 0, 80)
+	conn.Write(req)
+
+	reply := make([]byte, 12)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socks5HostUnreachable {
+		t.Fatalf("expected host unreachable, got %d", reply[3])
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	dial, dialed := echoServer(t)
+	addr := startProxy(t, NewServer(dial, resolver).ServeHTTPConnect)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("CONNECT 100.70.0.3:22 HTTP/1.1\r\nHost: 100.70.0.3:22\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if got := <-dialed; got != "100.70.0.3:22" {
+		t.Fatalf("dialed %s, expected 100.70.0.3:22", got)
+	}
+
+	msg := "hello overlay"
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo mismatch: %q", buf)
+	}
+}
+
+func TestHTTPMethodNotAllowed(t *testing.T) {
+	dial, _ := echoServer(t)
+	addr := startProxy(t, NewServer(dial, resolver).ServeHTTPConnect)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET http://peer1/ HTTP/1.1\r\nHost: peer1\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+}
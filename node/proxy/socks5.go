@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUnacceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5HostUnreachable     = 0x04
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+
+	handshakeTimeout = time.Second * 10
+)
+
+// ServeSOCKS5 runs a SOCKS5 proxy without authentication on l.
+// Only the CONNECT command is supported
+func (s *Server) ServeSOCKS5(l net.Listener) error {
+	return serve(l, func(conn net.Conn) {
+		logError("socks5", s.handleSOCKS5(conn))
+	})
+}
+
+func (s *Server) handleSOCKS5(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// Method selection
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	method := byte(socks5AuthUnacceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthUnacceptable {
+		return errors.New("no acceptable authentication method")
+	}
+
+	// Request
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	cmd, addrType := buf[1], buf[3]
+
+	var host string
+	switch addrType {
+	case socks5AddrIPv4:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return err
+		}
+		host = netip.AddrFrom4([4]byte(buf[:4])).String()
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return err
+		}
+		host = string(buf[:n])
+	case socks5AddrIPv6:
+		// The overlay is IPv4 only, consume the address before replying
+		if _, err := io.ReadFull(conn, buf[:16+2]); err != nil {
+			return err
+		}
+		return socks5Reply(conn, socks5AddrTypeUnsupported)
+	default:
+		return socks5Reply(conn, socks5AddrTypeUnsupported)
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))
+
+	if cmd != socks5CmdConnect {
+		return socks5Reply(conn, socks5CmdNotSupported)
+	}
+
+	remote, err := s.dial(host, port)
+	if err != nil {
+		code := byte(socks5GeneralFailure)
+		if errors.Is(err, errUnknownHost) {
+			code = socks5HostUnreachable
+		}
+		socks5Reply(conn, code)
+		return fmt.Errorf("error connecting to %s: %w", net.JoinHostPort(host, port), err)
+	}
+	defer remote.Close()
+
+	if err = socks5Reply(conn, socks5Succeeded); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	pipe(conn, remote)
+	return nil
+}
+
+// socks5Reply writes a reply with an unspecified bound address
+func socks5Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,142 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Reauthenticate with the stored refresh token once the controller auth
+	// expires within this window
+	AuthRefreshBefore = time.Hour * 24 * 7
+	// How often to check the controller auth expiry
+	authRefreshCheckInterval = time.Hour
+)
+
+var errNoRefreshToken = errors.New("no refresh token stored, interactive login required")
+
+// authLoginInfo converts the controller's identity provider details to the
+// form the login flows use
+func authLoginInfo(info *controllerv1.GetPKCEAuthInfoResponse) *nodev1.LoginResponse {
+	return &nodev1.LoginResponse{
+		Status:             "need access token",
+		ClientId:           info.GetClientId(),
+		AuthEndpoint:       info.GetAuthEndpoint(),
+		TokenEndpoint:      info.GetTokenEndpoint(),
+		RedirectUri:        info.GetRedirectUri(),
+		Audience:           info.GetAudience(),
+		DeviceAuthEndpoint: info.GetDeviceAuthEndpoint(),
+	}
+}
+
+// saveRefreshToken stores the refresh token from a login so the node can
+// reauthenticate without user interaction. The state file is owner only
+func (n *Node) saveRefreshToken(token string) {
+	if token == "" {
+		return
+	}
+	err := n.state.Update(func(s *State) {
+		s.RefreshToken = token
+	})
+	if err != nil {
+		log.Printf("error persisting refresh token: %s", err)
+	}
+}
+
+// refreshAccessToken exchanges the stored refresh token for a new access token
+// at the identity provider the controller uses
+func (n *Node) refreshAccessToken(ctx context.Context) (string, error) {
+	refresh := n.state.Get().RefreshToken
+	if refresh == "" {
+		return "", errNoRefreshToken
+	}
+
+	info, err := n.grpcClient.client.GetPKCEAuthInfo(ctx, &controllerv1.GetPKCEAuthInfoRequest{})
+	if err != nil {
+		return "", fmt.Errorf("error getting identity provider info: %w", err)
+	}
+	conf := oauthConfig(authLoginInfo(info))
+
+	tok, err := conf.TokenSource(ctx, &oauth2.Token{RefreshToken: refresh}).Token()
+	if err != nil {
+		var rerr *oauth2.RetrieveError
+		if errors.As(err, &rerr) && rerr.ErrorCode == "invalid_grant" {
+			// Revoked or expired, only an interactive login can replace it
+			n.state.Update(func(s *State) {
+				s.RefreshToken = ""
+			})
+		}
+		return "", fmt.Errorf("error refreshing access token: %w", err)
+	}
+
+	// Providers rotating refresh tokens invalidate the one just used
+	if tok.RefreshToken != refresh {
+		n.saveRefreshToken(tok.RefreshToken)
+	}
+	return tok.AccessToken, nil
+}
+
+// loginWithRefreshToken logs in to the controller with an access token
+// obtained from the stored refresh token
+func (n *Node) loginWithRefreshToken(ctx context.Context) (*controllerv1.LoginPeerResponse, error) {
+	token, err := n.refreshAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return n.loginPeer(ctx, token)
+}
+
+// reauthenticate renews the node's controller auth without user interaction
+func (n *Node) reauthenticate(ctx context.Context) error {
+	resp, err := n.loginWithRefreshToken(ctx)
+	if err != nil {
+		return err
+	}
+	if err = n.applyLogin(resp); err != nil {
+		return err
+	}
+	log.Printf("reauthenticated with controller, auth expires at %s", n.getAuthExpiry().Format(time.RFC3339))
+	return nil
+}
+
+func (n *Node) getAuthExpiry() time.Time {
+	expires := n.state.Get().AuthExpires
+	if expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(expires, 0)
+}
+
+// authRefreshRoutine reauthenticates with the stored refresh token before the
+// controller auth expires, so the node never needs an interactive login while
+// the refresh token stays valid
+func (n *Node) authRefreshRoutine(ctx context.Context) {
+	for {
+		expiry := n.getAuthExpiry()
+		if !expiry.IsZero() && time.Until(expiry) < AuthRefreshBefore {
+			rCtx, cancel := context.WithTimeout(ctx, time.Second*30)
+			err := n.reauthenticate(rCtx)
+			cancel()
+			if errors.Is(err, errNoRefreshToken) {
+				debugf("auth expires at %s, %s", expiry.Format(time.RFC3339), err)
+			} else if err != nil {
+				log.Printf("error reauthenticating before auth expires at %s: %s", expiry.Format(time.RFC3339), err)
+			}
+		}
+
+		t := time.NewTimer(authRefreshCheckInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
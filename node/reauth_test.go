@@ -0,0 +1,144 @@
+package node
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// authController only logs in peers presenting the access token the mock IdP
+// issues for refresh tokens, as if the peer's auth had expired
+type authController struct {
+	controllerv1.UnimplementedControllerServiceServer
+	idp *mockIdP
+}
+
+func (s *authController) GetPKCEAuthInfo(
+	ctx context.Context,
+	req *controllerv1.GetPKCEAuthInfoRequest,
+) (*controllerv1.GetPKCEAuthInfoResponse, error) {
+	return &controllerv1.GetPKCEAuthInfoResponse{
+		ClientId:           "node",
+		TokenEndpoint:      s.idp.URL + "/oauth/token",
+		DeviceAuthEndpoint: s.idp.URL + "/oauth/device/code",
+	}, nil
+}
+
+func (s *authController) LoginPeer(
+	ctx context.Context,
+	req *controllerv1.LoginPeerRequest,
+) (*controllerv1.LoginPeerResponse, error) {
+	if req.GetAccessToken() != "refreshed-token" {
+		return nil, status.Error(codes.Unauthenticated, "peer auth is expired")
+	}
+	return &controllerv1.LoginPeerResponse{
+		Config: &controllerv1.PeerConfig{
+			PeerId:   1,
+			TunnelIp: "100.70.0.1",
+			Prefix:   "100.70.0.0/24",
+		},
+		AuthExpires: time.Now().Add(time.Hour * 24 * 30).Unix(),
+	}, nil
+}
+
+func newAuthTestNode(t *testing.T, idp *mockIdP) *Node {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	controllerv1.RegisterControllerServiceServer(server, &authController{idp: idp})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	client, err := NewControllerClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	state, err := NewStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keypair, err := GenerateNewKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &Node{config: &Config{}, state: state, grpcClient: client, machineID: "machine"}
+	node.maps.id = make(map[uint32]*Peer)
+	node.maps.ip = make(map[netip.Addr]*Peer)
+	node.noise.keyPair = keypair
+	return node
+}
+
+func TestLoginRefreshesExpiredAuth(t *testing.T) {
+	idp := newMockIdP(t, 0)
+	node := newAuthTestNode(t, idp)
+	node.saveRefreshToken(idp.rotateRefreshToken())
+
+	resp, err := node.Login(context.Background(), &nodev1.LoginRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetStatus() != "login successful" {
+		t.Fatalf("login status = %q, want login successful", resp.GetStatus())
+	}
+	if !node.LoggedIn() {
+		t.Fatal("node is not logged in")
+	}
+
+	state := node.state.Get()
+	if state.RefreshToken != idp.currentRefreshToken() {
+		t.Fatalf("stored refresh token %q, want rotated %q", state.RefreshToken, idp.currentRefreshToken())
+	}
+	if time.Until(node.getAuthExpiry()) < AuthRefreshBefore {
+		t.Fatalf("auth expiry %s was not renewed", node.getAuthExpiry())
+	}
+}
+
+func TestLoginFallsBackToInteractive(t *testing.T) {
+	idp := newMockIdP(t, 0)
+	node := newAuthTestNode(t, idp)
+	// The IdP no longer accepts this token
+	node.saveRefreshToken("revoked")
+
+	resp, err := node.Login(context.Background(), &nodev1.LoginRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetStatus() != "need access token" || resp.GetDeviceAuthEndpoint() == "" {
+		t.Fatalf("login response = %v, want interactive login details", resp)
+	}
+	if node.LoggedIn() {
+		t.Fatal("node logged in with a revoked refresh token")
+	}
+	if token := node.state.Get().RefreshToken; token != "" {
+		t.Fatalf("revoked refresh token %q was kept", token)
+	}
+}
+
+func TestLoginStoresRefreshToken(t *testing.T) {
+	idp := newMockIdP(t, 0)
+	node := newAuthTestNode(t, idp)
+
+	_, err := node.Login(context.Background(), &nodev1.LoginRequest{
+		AccessToken:  "refreshed-token",
+		RefreshToken: "refresh-from-login",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := node.state.Get().RefreshToken; token != "refresh-from-login" {
+		t.Fatalf("stored refresh token %q, want refresh-from-login", token)
+	}
+}
@@ -0,0 +1,102 @@
+package node
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/caldog20/zeronet/node/conn"
+	"github.com/caldog20/zeronet/node/netmon"
+)
+
+// Time to wait for the underlay to settle after a change before restarting ICE,
+// a single roam usually produces a burst of link and address notifications
+const NetworkChangeDebounce = time.Second * 2
+
+// networkMonitorRoutine restarts ICE for all peers when the underlay network changes
+func (node *Node) networkMonitorRoutine(ctx context.Context) {
+	changes, err := netmon.Watch(ctx, node.tun.Name())
+	if err != nil {
+		log.Printf("error watching for network changes: %s", err)
+		return
+	}
+
+	debounce := time.NewTimer(NetworkChangeDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			debounce.Reset(NetworkChangeDebounce)
+		case <-debounce.C:
+			node.handleNetworkChange()
+		}
+	}
+}
+
+// handleNetworkChange rebinds the underlay socket so host candidates reflect the
+// current interface addresses, then restarts ICE for every peer
+func (node *Node) handleNetworkChange() {
+	log.Println("underlay network changed, restarting ice")
+
+	if err := node.rebindUDP(); err != nil {
+		log.Printf("error rebinding udp socket: %s", err)
+		return
+	}
+
+	node.maps.l.RLock()
+	peers := make([]*Peer, 0, len(node.maps.id))
+	for _, peer := range node.maps.id {
+		peers = append(peers, peer)
+	}
+	node.maps.l.RUnlock()
+
+	for _, peer := range peers {
+		go peer.RestartICE()
+	}
+}
+
+// rebindUDP replaces the underlay socket and ICE mux. The mux only learns the
+// local addresses when it is created, and agents using the old mux are
+// closed with it
+func (node *Node) rebindUDP() error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	// Node is stopping
+	if node.runCtx.Err() != nil {
+		return nil
+	}
+
+	// The new socket binds the same port, so the old one must be closed first
+	node.udpMux.Close()
+	node.conn.Close()
+
+	c, err := conn.NewConn(node.port)
+	if err != nil {
+		return err
+	}
+	node.conn = c
+	node.udpMux = newUDPMux(c)
+	return nil
+}
+
+// RestartICE replaces the peer's ICE agent after an underlay network change.
+// An active session is torn down and re-established from this side with fresh
+// candidates, and the remote peer is told to reset so it drops the dead path
+// and answers the new offer instead of waiting for its rx timeout
+func (peer *Peer) RestartICE() {
+	active := peer.inTransport.Load() || peer.connecting.Load()
+	if active {
+		log.Printf("peer %d restarting ice after network change", peer.ID)
+		peer.node.sendPeerIceReset(peer.ID)
+	}
+
+	peer.ResetState()
+	if active {
+		peer.InitiateConnection()
+	}
+}
@@ -3,7 +3,9 @@ package node
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 	"net/netip"
 	"strings"
 
@@ -21,6 +23,7 @@ func (n *Node) Up(ctx context.Context, req *nodev1.UpRequest) (*nodev1.UpRespons
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	n.saveRunning(true)
 	return &nodev1.UpResponse{Status: "node is running"}, nil
 }
 
@@ -30,10 +33,155 @@ func (n *Node) Down(ctx context.Context, req *nodev1.DownRequest) (*nodev1.DownR
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	n.saveRunning(false)
 	return &nodev1.DownResponse{Status: "node is stopped"}, nil
 }
 
 func (n *Node) Login(ctx context.Context, req *nodev1.LoginRequest) (*nodev1.LoginResponse, error) {
+	resp, err := n.loginPeer(ctx, req.GetAccessToken())
+	if err != nil && req.GetAccessToken() == "" && status.Code(err) == codes.Unauthenticated {
+		// Try the stored refresh token before asking for an interactive login
+		var rerr error
+		resp, rerr = n.loginWithRefreshToken(ctx)
+		if rerr == nil {
+			err = nil
+		} else if !errors.Is(rerr, errNoRefreshToken) {
+			log.Printf("silent reauthentication failed, interactive login required: %s", rerr)
+		}
+	}
+	if err != nil {
+		e, ok := status.FromError(err)
+		if !ok {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if e.Code() != codes.Unauthenticated {
+			return nil, err
+		}
+		info, err := n.grpcClient.client.GetPKCEAuthInfo(context.Background(), &controllerv1.GetPKCEAuthInfoRequest{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, ("error getting pkce info for auth flow"))
+		}
+		return authLoginInfo(info), nil
+	}
+
+	if err = n.applyLogin(resp); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	n.saveRefreshToken(req.GetRefreshToken())
+
+	return &nodev1.LoginResponse{Status: "login successful"}, nil
+}
+
+// Logout stops the node and forgets the local login session, including the
+// stored refresh token, so the next login is interactive
+func (n *Node) Logout(ctx context.Context, req *nodev1.LogoutRequest) (*nodev1.LogoutResponse, error) {
+	if n.running.Load() {
+		if err := n.Stop(); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	n.loggedIn.Store(false)
+
+	err := n.state.Update(func(s *State) {
+		s.LoggedIn = false
+		s.Running = false
+		s.AuthExpires = 0
+		s.RefreshToken = ""
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("error persisting logout: %s", err))
+	}
+
+	return &nodev1.LogoutResponse{Status: "node is logged out"}, nil
+}
+
+// LoginWithToken logs in to the controller, registering the node with
+// accessToken if it isn't registered yet
+func (n *Node) LoginWithToken(ctx context.Context, accessToken string) error {
+	resp, err := n.loginPeer(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+	return n.applyLogin(resp)
+}
+
+func (n *Node) LoggedIn() bool {
+	return n.loggedIn.Load()
+}
+
+func (n *Node) applyLogin(resp *controllerv1.LoginPeerResponse) error {
+	if err := n.applyPeerConfig(resp.GetConfig()); err != nil {
+		return err
+	}
+	n.applyNetworkSettings(resp.GetSettings())
+	n.saveAuthExpiry(resp.GetAuthExpires())
+	return nil
+}
+
+func (n *Node) saveAuthExpiry(expires int64) {
+	err := n.state.Update(func(s *State) {
+		s.AuthExpires = expires
+	})
+	if err != nil {
+		log.Printf("error persisting auth expiry: %s", err)
+	}
+}
+
+func (n *Node) RotateKey(ctx context.Context, req *nodev1.RotateKeyRequest) (*nodev1.RotateKeyResponse, error) {
+	pubkey, err := n.RotateKeypair(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &nodev1.RotateKeyResponse{Status: "key rotated", PublicKey: pubkey}, nil
+}
+
+func (n *Node) Status(ctx context.Context, req *nodev1.StatusRequest) (*nodev1.StatusResponse, error) {
+	return n.status(), nil
+}
+
+func (n *Node) Ping(ctx context.Context, req *nodev1.PingRequest) (*nodev1.PingResponse, error) {
+	if !n.running.Load() {
+		return nil, status.Error(codes.Unavailable, "node is not running")
+	}
+
+	peer, found := n.findPeer(req.GetPeer())
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "peer %s not found", req.GetPeer())
+	}
+
+	result, err := peer.Ping(ctx)
+	if err != nil {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return nil, status.Error(codes.DeadlineExceeded, "timed out waiting for probe reply")
+		case errors.Is(err, ErrPeerNotRunning):
+			return nil, status.Error(codes.Unavailable, err.Error())
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	path := pathType(result.LocalCandidateType, result.RemoteCandidateType)
+	if result.Relayed {
+		path = "controller relay"
+	}
+
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return &nodev1.PingResponse{
+		PeerId:              peer.ID,
+		Hostname:            peer.Hostname,
+		Ip:                  peer.IP.String(),
+		Rtt:                 result.RTT.Microseconds(),
+		PathType:            path,
+		LocalCandidateType:  result.LocalCandidateType,
+		RemoteCandidateType: result.RemoteCandidateType,
+		NewConnection:       result.NewConnection,
+	}, nil
+}
+
+func (n *Node) loginPeer(ctx context.Context, accessToken string) (*controllerv1.LoginPeerResponse, error) {
 	n.noise.l.RLock()
 	pubkey := base64.StdEncoding.EncodeToString(n.noise.keyPair.Public)
 	mid := n.machineID
@@ -44,38 +192,95 @@ func (n *Node) Login(ctx context.Context, req *nodev1.LoginRequest) (*nodev1.Log
 		MachineId:   mid,
 		PublicKey:   pubkey,
 		Hostname:    hostname,
-		AccessToken: req.GetAccessToken(),
+		AccessToken: accessToken,
 	}
 
-	resp, err := n.grpcClient.client.LoginPeer(ctx, loginRequest)
-	if err != nil {
-		e, ok := status.FromError(err)
-		if ok {
-			if e.Code() == codes.Unauthenticated {
-				info, err := n.grpcClient.client.GetPKCEAuthInfo(context.Background(), &controllerv1.GetPKCEAuthInfoRequest{})
-				if err != nil {
-					return nil, status.Error(codes.Internal, ("error getting pkce info for auth flow"))
-				}
-				return &nodev1.LoginResponse{
-					Status:        "need access token",
-					ClientId:      info.GetClientId(),
-					AuthEndpoint:  info.GetAuthEndpoint(),
-					TokenEndpoint: info.GetTokenEndpoint(),
-					RedirectUri:   info.GetRedirectUri(),
-					Audience:      info.GetAudience(),
-				}, nil
-			}
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-	}
+	return n.grpcClient.client.LoginPeer(ctx, loginRequest)
+}
 
+// applyPeerConfig sets the node's overlay address from the controller provided
+// config, marks the node logged in and persists the login session
+func (n *Node) applyPeerConfig(config *controllerv1.PeerConfig) error {
 	// TODO: Fix prefix for node address
 	// Change to netip.Addr and have prefix separate
+	p := strings.Split(config.GetPrefix(), "/")
+	if len(p) != 2 {
+		return fmt.Errorf("invalid prefix in peer config: %s", config.GetPrefix())
+	}
+	ip, err := netip.ParsePrefix(fmt.Sprintf("%s/%s", config.GetTunnelIp(), p[1]))
+	if err != nil {
+		return fmt.Errorf("invalid tunnel ip in peer config: %w", err)
+	}
 
-	n.id = resp.Config.PeerId
-	p := strings.Split(resp.Config.Prefix, "/")
-	n.ip = netip.MustParsePrefix(fmt.Sprintf("%s/%s", resp.Config.TunnelIp, p[1]))
+	n.id = config.GetPeerId()
+	n.ip = ip
 	n.loggedIn.Store(true)
-	return &nodev1.LoginResponse{Status: "login successful"}, nil
+
+	err = n.state.Update(func(s *State) {
+		s.Controller = n.controller
+		s.LoggedIn = true
+		s.PeerID = config.GetPeerId()
+		s.TunnelIP = config.GetTunnelIp()
+		s.Prefix = config.GetPrefix()
+	})
+	if err != nil {
+		log.Printf("error persisting login session: %s", err)
+	}
+
+	return nil
+}
+
+func (n *Node) saveRunning(running bool) {
+	err := n.state.Update(func(s *State) {
+		s.Running = running
+	})
+	if err != nil {
+		log.Printf("error persisting node state: %s", err)
+	}
+}
+
+// Resume restores the persisted login session and starts the node if it was
+// running when the service last stopped. The session is refreshed with the
+// controller, falling back to the last peer config if the controller is unavailable
+func (n *Node) Resume(ctx context.Context) error {
+	state := n.state.Get()
+	if !state.LoggedIn {
+		return nil
+	}
+
+	config := &controllerv1.PeerConfig{
+		PeerId:   state.PeerID,
+		TunnelIp: state.TunnelIP,
+		Prefix:   state.Prefix,
+	}
+
+	resp, err := n.loginPeer(ctx, "")
+	if status.Code(err) == codes.Unauthenticated {
+		log.Println("controller auth expired, reauthenticating with refresh token")
+		resp, err = n.loginWithRefreshToken(ctx)
+	}
+	if err != nil {
+		if !controllerUnreachable(err) {
+			// Session is no longer valid, require a new login
+			n.state.Update(func(s *State) {
+				s.LoggedIn = false
+			})
+			return fmt.Errorf("error resuming login session: %w", err)
+		}
+		log.Println("controller unavailable, resuming with last peer config")
+	} else {
+		config = resp.GetConfig()
+		n.applyNetworkSettings(resp.GetSettings())
+		n.saveAuthExpiry(resp.GetAuthExpires())
+	}
+
+	if err = n.applyPeerConfig(config); err != nil {
+		return err
+	}
+
+	if !state.Running {
+		return nil
+	}
+
+	return n.Start()
 }
@@ -0,0 +1,98 @@
+package node
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	"google.golang.org/grpc"
+)
+
+// hangingController never answers logins, like an overloaded controller
+type hangingController struct {
+	controllerv1.UnimplementedControllerServiceServer
+}
+
+func (s *hangingController) LoginPeer(
+	ctx context.Context,
+	req *controllerv1.LoginPeerRequest,
+) (*controllerv1.LoginPeerResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// newResumeTestNode creates a node with a saved login session for controller
+func newResumeTestNode(t *testing.T, controller string) *Node {
+	config := DefaultConfig()
+	config.Controller = controller
+	config.StateDir = t.TempDir()
+	config.MachineID = "machine"
+	config.Hostname = "node"
+
+	state, err := NewStateStore(config.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.Update(func(s *State) {
+		s.LoggedIn = true
+		s.PeerID = 7
+		s.TunnelIP = "100.70.0.7"
+		s.Prefix = "100.70.0.0/24"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := NewNode(config)
+	if err != nil {
+		t.Fatalf("error creating node with the controller down: %s", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func requireResumedOffline(t *testing.T, node *Node, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("resume failed: %s", err)
+	}
+	if !node.LoggedIn() || !node.state.Get().LoggedIn {
+		t.Fatal("saved login session was cleared")
+	}
+	if node.id != 7 || node.IP().String() != "100.70.0.7" {
+		t.Fatalf("resumed as peer %d %s, want 7 100.70.0.7", node.id, node.IP())
+	}
+}
+
+func TestResumeControllerDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on the address anymore
+	addr := l.Addr().String()
+	l.Close()
+
+	node := newResumeTestNode(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	requireResumedOffline(t, node, node.Resume(ctx))
+}
+
+func TestResumeControllerTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	controllerv1.RegisterControllerServiceServer(server, &hangingController{})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	node := newResumeTestNode(t, l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	requireResumedOffline(t, node, node.Resume(ctx))
+}
@@ -0,0 +1,240 @@
+package node
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caldog20/zeronet/node/tun"
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+	"github.com/pion/stun/v2"
+)
+
+const (
+	// How often to check for TURN credentials when the node has none
+	turnRefreshCheckInterval = time.Minute * 5
+	turnRefreshMinInterval   = time.Second * 10
+)
+
+var debugLogging atomic.Bool
+
+// debugf logs only when the node log level is set to debug
+func debugf(format string, v ...any) {
+	if debugLogging.Load() {
+		log.Printf(format, v...)
+	}
+}
+
+func setLogLevel(level string) {
+	switch strings.ToLower(level) {
+	case "debug":
+		debugLogging.Store(true)
+	case "", "info":
+		debugLogging.Store(false)
+	default:
+		log.Printf("unknown log level %s, defaulting to info", level)
+		debugLogging.Store(false)
+	}
+}
+
+// applyLocalSettings sets the effective settings from the node config,
+// falling back to the built-in defaults
+func (node *Node) applyLocalSettings() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.mtu = tun.DefaultMTU
+	if node.config.MTU > 0 {
+		node.mtu = clampMTU(node.config.MTU)
+	}
+
+	stunServers := node.config.StunServers
+	if len(stunServers) == 0 {
+		stunServers = DefaultStunServers
+	}
+	node.stunUrls = parseStunUrls(stunServers...)
+	node.relayURL = node.config.Relay
+
+	setLogLevel(node.config.LogLevel)
+}
+
+// applyNetworkSettings applies the network wide defaults pushed by the controller
+// for any setting not explicitly set in the local node config
+func (node *Node) applyNetworkSettings(settings *controllerv1.NetworkSettings) {
+	if settings == nil {
+		return
+	}
+
+	if node.config.MTU <= 0 && settings.GetMtu() > 0 {
+		node.setMTU(int(settings.GetMtu()))
+	}
+
+	if len(node.config.StunServers) == 0 {
+		urls := parseStunUrls(settings.GetStunServers()...)
+		var expiry time.Time
+		for _, ts := range settings.GetTurnServers() {
+			turn, err := stun.ParseURI(ts.GetUrl())
+			if err != nil {
+				log.Printf("failed to parse turn uri: %s", ts.GetUrl())
+				continue
+			}
+			turn.Username = ts.GetUsername()
+			turn.Password = ts.GetCredential()
+			urls = append(urls, turn)
+
+			if ts.GetExpires() > 0 {
+				expires := time.Unix(ts.GetExpires(), 0)
+				if expiry.IsZero() || expires.Before(expiry) {
+					expiry = expires
+				}
+			}
+		}
+		if len(urls) > 0 {
+			// New ICE agents will use the updated servers
+			node.lock.Lock()
+			node.stunUrls = urls
+			node.turnExpiry = expiry
+			node.lock.Unlock()
+		}
+	}
+
+	var dns []netip.Addr
+	for _, s := range settings.GetDnsServers() {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			log.Printf("failed to parse dns server: %s", s)
+			continue
+		}
+		dns = append(dns, addr)
+	}
+	node.setDNSServers(dns)
+
+	if node.config.LogLevel == "" && settings.GetLogLevel() != "" {
+		setLogLevel(settings.GetLogLevel())
+	}
+
+	if node.config.Relay == "" {
+		// Used by the relay client on the next start
+		node.lock.Lock()
+		node.relayURL = settings.GetRelayUrl()
+		node.lock.Unlock()
+	}
+}
+
+func (node *Node) getTurnExpiry() time.Time {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+	return node.turnExpiry
+}
+
+// turnRefreshRoutine fetches new network settings from the controller before
+// the TURN credentials issued to the node expire
+func (node *Node) turnRefreshRoutine(ctx context.Context) {
+	for {
+		wait := turnRefreshCheckInterval
+		if expiry := node.getTurnExpiry(); !expiry.IsZero() {
+			wait = max(time.Until(expiry)*3/4, turnRefreshMinInterval)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		if node.getTurnExpiry().IsZero() {
+			continue
+		}
+
+		rCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+		settings, err := node.grpcClient.GetNetworkSettings(rCtx, node.machineID)
+		cancel()
+		if err != nil {
+			log.Printf("error refreshing turn credentials: %s", err)
+			continue
+		}
+		node.applyNetworkSettings(settings)
+		debugf("refreshed turn credentials, expiring at %s", node.getTurnExpiry())
+	}
+}
+
+func (node *Node) getMTU() int {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+	return node.mtu
+}
+
+// clampMTU limits mtu to the range the packet buffers support
+func clampMTU(mtu int) int {
+	if mtu < MinMTU || mtu > MaxMTU {
+		clamped := min(max(mtu, MinMTU), MaxMTU)
+		log.Printf("invalid mtu %d, must be between %d and %d, using %d", mtu, MinMTU, MaxMTU, clamped)
+		return clamped
+	}
+	return mtu
+}
+
+// setMTU updates the effective MTU, applying it to the tunnel if the node is running
+func (node *Node) setMTU(mtu int) {
+	mtu = clampMTU(mtu)
+	node.lock.Lock()
+	changed := node.mtu != mtu
+	node.mtu = mtu
+	node.lock.Unlock()
+
+	if changed && node.running.Load() {
+		if err := node.tun.SetMTU(mtu); err != nil {
+			log.Printf("error setting tunnel mtu: %s", err)
+		}
+	}
+}
+
+// getRelayURL returns the relay URL, filling in the controller host if the URL has none
+func (node *Node) getRelayURL() string {
+	node.lock.RLock()
+	relayURL := node.relayURL
+	node.lock.RUnlock()
+	if relayURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		log.Printf("invalid relay url %s: %s", relayURL, err)
+		return ""
+	}
+	if u.Hostname() == "" {
+		host, _, err := net.SplitHostPort(node.controller)
+		if err != nil {
+			host = node.controller
+		}
+		u.Host = net.JoinHostPort(host, u.Port())
+	}
+	return u.String()
+}
+
+func (node *Node) getDNSServers() []netip.Addr {
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+	return node.dnsServers
+}
+
+// setDNSServers updates the tunnel DNS servers, applying them if the node is running
+func (node *Node) setDNSServers(servers []netip.Addr) {
+	node.lock.Lock()
+	node.dnsServers = servers
+	node.lock.Unlock()
+
+	if len(servers) > 0 && node.running.Load() {
+		if err := node.tun.ConfigureDNS(servers); err != nil {
+			log.Printf("error configuring tunnel dns: %s", err)
+		}
+	}
+}
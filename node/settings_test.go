@@ -0,0 +1,30 @@
+package node
+
+import (
+	"testing"
+
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+)
+
+func TestMTUClampedToBufferSize(t *testing.T) {
+	tests := []struct {
+		local, pushed int
+		want          int
+	}{
+		{local: 1400, want: 1400},
+		{local: 9000, want: MaxMTU},
+		{local: 100, want: MinMTU},
+		{pushed: 1380, want: 1380},
+		{pushed: 9000, want: MaxMTU},
+		{local: 1400, pushed: 9000, want: 1400},
+	}
+
+	for _, tt := range tests {
+		node := &Node{config: &Config{MTU: tt.local}}
+		node.applyLocalSettings()
+		node.applyNetworkSettings(&controllerv1.NetworkSettings{Mtu: uint32(tt.pushed)})
+		if got := node.getMTU(); got != tt.want {
+			t.Errorf("local %d pushed %d: mtu = %d, want %d", tt.local, tt.pushed, got, tt.want)
+		}
+	}
+}
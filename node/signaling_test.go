@@ -0,0 +1,220 @@
+package node
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caldog20/zeronet/node/conn"
+	controllerv1 "github.com/caldog20/zeronet/proto/gen/controller/v1"
+)
+
+// fakeController relays ICE signaling between test nodes the way the
+// controller does, rewriting the peer ID to the sender. When crossOffers is
+// set, the first offer from each node is held back until both nodes have
+// sent one so the offers are guaranteed to cross
+type fakeController struct {
+	nodes       map[uint32]*Node
+	crossOffers bool
+
+	mu      sync.Mutex
+	held    []*controllerv1.IceUpdate
+	heldTo  []uint32
+	offered map[uint32]bool
+	answers map[uint32]int
+}
+
+func newFakeController(crossOffers bool) *fakeController {
+	return &fakeController{
+		nodes:       make(map[uint32]*Node),
+		crossOffers: crossOffers,
+		offered:     make(map[uint32]bool),
+		answers:     make(map[uint32]int),
+	}
+}
+
+func (c *fakeController) addNode(t *testing.T, id uint32) *Node {
+	keypair, err := GenerateNewKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := conn.NewConn(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &Node{id: id, tun: &countingTun{done: make(chan struct{})}}
+	node.maps.id = make(map[uint32]*Peer)
+	node.maps.ip = make(map[netip.Addr]*Peer)
+	node.noise.keyPair = keypair
+	node.conn = uc
+	node.udpMux = newUDPMux(uc)
+	node.grpcClient = &ControllerClient{txUpdates: make(chan *controllerv1.UpdateRequest, 64)}
+	node.startCryptoWorkers(1)
+	c.nodes[id] = node
+
+	go c.route(node)
+	t.Cleanup(func() {
+		node.StopAllPeers()
+		node.stopCryptoWorkers()
+		close(node.grpcClient.txUpdates)
+		node.udpMux.Close()
+	})
+	return node
+}
+
+// connect adds each node as a peer of the other
+func (c *fakeController) connect(t *testing.T, a, b *Node) (*Peer, *Peer) {
+	add := func(local, remote *Node) *Peer {
+		peer, err := local.AddPeer(&controllerv1.Peer{
+			Id:        remote.id,
+			PublicKey: base64.StdEncoding.EncodeToString(remote.noise.keyPair.Public),
+			Ip:        fmt.Sprintf("100.70.0.%d", remote.id),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = peer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return peer
+	}
+	return add(a, b), add(b, a)
+}
+
+func (c *fakeController) route(from *Node) {
+	for req := range from.grpcClient.txUpdates {
+		msg := req.GetIceUpdate()
+		update := &controllerv1.IceUpdate{
+			UpdateType: msg.GetUpdateType(),
+			PeerId:     from.id,
+			Ufrag:      msg.GetUfrag(),
+			Pwd:        msg.GetPwd(),
+			Candidate:  msg.GetCandidate(),
+		}
+
+		c.mu.Lock()
+		if msg.GetUpdateType() == controllerv1.IceUpdateType_ANSWER {
+			c.answers[from.id]++
+		}
+		if c.crossOffers && msg.GetUpdateType() == controllerv1.IceUpdateType_OFFER && !c.offered[from.id] {
+			c.offered[from.id] = true
+			c.held = append(c.held, update)
+			c.heldTo = append(c.heldTo, msg.GetPeerId())
+			if len(c.held) < 2 {
+				c.mu.Unlock()
+				continue
+			}
+			held, heldTo := c.held, c.heldTo
+			c.held, c.heldTo = nil, nil
+			c.mu.Unlock()
+			for i := range held {
+				c.nodes[heldTo[i]].handleIceUpdate(held[i])
+			}
+			continue
+		}
+		c.mu.Unlock()
+
+		to, ok := c.nodes[msg.GetPeerId()]
+		if !ok {
+			continue
+		}
+		// Candidates block until the remote agent is receiving them
+		go to.handleIceUpdate(update)
+	}
+}
+
+func (c *fakeController) answerCount(id uint32) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.answers[id]
+}
+
+func requireHostCandidates(t *testing.T) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+			return
+		}
+	}
+	t.Skip("no non-loopback ipv4 address for ice host candidates")
+}
+
+func waitForTransport(t *testing.T, peers ...*Peer) {
+	deadline := time.Now().Add(time.Second * 15)
+	for time.Now().Before(deadline) {
+		connected := true
+		for _, peer := range peers {
+			connected = connected && peer.inTransport.Load()
+		}
+		if connected {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("peers did not connect")
+}
+
+func TestCrossingOffersResolveToLowerID(t *testing.T) {
+	requireHostCandidates(t)
+
+	for _, ids := range [][2]uint32{{1, 2}, {2, 1}} {
+		t.Run(fmt.Sprintf("%d-%d", ids[0], ids[1]), func(t *testing.T) {
+			c := newFakeController(true)
+			a := c.addNode(t, ids[0])
+			b := c.addNode(t, ids[1])
+			peerOfA, peerOfB := c.connect(t, a, b)
+
+			// Both sides have traffic for each other at the same moment
+			peerOfA.InitiateConnection()
+			peerOfB.InitiateConnection()
+
+			start := time.Now()
+			waitForTransport(t, peerOfA, peerOfB)
+			// Without resolution both sides wait out the 30s answer timeout
+			if elapsed := time.Since(start); elapsed > time.Second*10 {
+				t.Fatalf("glare took %s to resolve", elapsed)
+			}
+
+			low, high := peerOfA, peerOfB
+			lowNode, highNode := a, b
+			if a.id > b.id {
+				low, high = peerOfB, peerOfA
+				lowNode, highNode = b, a
+			}
+			if !low.initiator.Load() || high.initiator.Load() {
+				t.Fatalf("expected node %d to initiate", lowNode.id)
+			}
+			if n := c.answerCount(lowNode.id); n != 0 {
+				t.Fatalf("winning node %d answered %d offers", lowNode.id, n)
+			}
+			if n := c.answerCount(highNode.id); n != 1 {
+				t.Fatalf("yielding node %d answered %d offers, want 1", highNode.id, n)
+			}
+		})
+	}
+}
+
+func TestSingleOfferConnects(t *testing.T) {
+	requireHostCandidates(t)
+
+	c := newFakeController(false)
+	a := c.addNode(t, 2)
+	b := c.addNode(t, 1)
+	peerOfA, peerOfB := c.connect(t, a, b)
+
+	// The higher ID keeps the initiator role when there is no glare
+	peerOfA.InitiateConnection()
+	waitForTransport(t, peerOfA, peerOfB)
+
+	if !peerOfA.initiator.Load() || peerOfB.initiator.Load() {
+		t.Fatal("expected the offering node to initiate")
+	}
+}
@@ -0,0 +1,146 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	KeyFileName   = "node.keypair"
+	StateFileName = "state.yaml"
+)
+
+// State is persisted to the state directory so the node can resume
+// its login session after a service restart
+type State struct {
+	Controller string `yaml:"Controller"`
+	LoggedIn   bool   `yaml:"LoggedIn"`
+	Running    bool   `yaml:"Running"`
+	PeerID     uint32 `yaml:"PeerID"`
+	TunnelIP   string `yaml:"TunnelIP"`
+	Prefix     string `yaml:"Prefix"`
+	// Unix time in seconds the controller auth expires
+	AuthExpires int64 `yaml:"AuthExpires,omitempty"`
+	// Exchanged for new access tokens to reauthenticate without user
+	// interaction. The state file is only readable by its owner
+	RefreshToken string `yaml:"RefreshToken,omitempty"`
+}
+
+type StateStore struct {
+	mu    sync.Mutex
+	dir   string
+	state State
+}
+
+// DefaultStateDir returns the OS specific directory used to store node state
+func DefaultStateDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("ProgramData"), "Zeronet")
+	case "darwin":
+		return "/Library/Application Support/Zeronet"
+	default:
+		return "/var/lib/zeronet"
+	}
+}
+
+// NewStateStore creates the state directory if needed and loads any existing state
+func NewStateStore(dir string) (*StateStore, error) {
+	if dir == "" {
+		dir = DefaultStateDir()
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating state directory: %w", err)
+	}
+
+	s := &StateStore{dir: dir}
+
+	f, err := os.Open(s.statePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("error opening state file: %w", err)
+	}
+	defer f.Close()
+
+	err = yaml.NewDecoder(f).Decode(&s.state)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding state file: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *StateStore) Dir() string {
+	return s.dir
+}
+
+func (s *StateStore) KeyPath() string {
+	return filepath.Join(s.dir, KeyFileName)
+}
+
+func (s *StateStore) statePath() string {
+	return filepath.Join(s.dir, StateFileName)
+}
+
+func (s *StateStore) Get() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Update applies fn to the current state and persists the result
+func (s *StateStore) Update(fn func(state *State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.state
+	fn(&state)
+
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(s.statePath(), data)
+	if err != nil {
+		return err
+	}
+
+	s.state = state
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file with owner only permissions and
+// renames it into place so a crash never leaves a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
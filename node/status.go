@@ -0,0 +1,108 @@
+package node
+
+import (
+	"encoding/base64"
+	"sort"
+	"time"
+
+	nodev1 "github.com/caldog20/zeronet/proto/gen/node/v1"
+	"github.com/pion/ice/v3"
+)
+
+// Status returns a snapshot of the peer's connection state
+func (peer *Peer) Status() *nodev1.PeerStatus {
+	peer.mu.RLock()
+	agent := peer.agent
+	status := &nodev1.PeerStatus{
+		Id:       peer.ID,
+		Hostname: peer.Hostname,
+		Ip:       peer.IP.String(),
+	}
+	peer.mu.RUnlock()
+
+	status.Running = peer.running.Load()
+	status.Connected = peer.inTransport.Load()
+	status.IceState = ice.ConnectionState(peer.iceState.Load()).String()
+	status.LastHandshake = unixSeconds(peer.lastHandshake.Load())
+	status.LastRx = unixSeconds(peer.lastRx.Load())
+	status.LastTx = unixSeconds(peer.lastTx.Load())
+	status.RxBytes = peer.rxBytes.Load()
+	status.TxBytes = peer.txBytes.Load()
+	status.Relayed = peer.relayed.Load()
+
+	if pair := selectedPair(agent); pair != nil && !status.Relayed {
+		status.LocalCandidateType = pair.Local.Type().String()
+		status.RemoteCandidateType = pair.Remote.Type().String()
+		status.LocalCandidate = pair.Local.Address()
+		status.RemoteCandidate = pair.Remote.Address()
+	}
+
+	return status
+}
+
+func selectedPair(agent *ice.Agent) *ice.CandidatePair {
+	if agent == nil {
+		return nil
+	}
+	pair, err := agent.GetSelectedCandidatePair()
+	if err != nil {
+		return nil
+	}
+	return pair
+}
+
+// status returns a snapshot of the node and all known peers
+func (node *Node) status() *nodev1.StatusResponse {
+	node.noise.l.RLock()
+	pubkey := base64.StdEncoding.EncodeToString(node.noise.keyPair.Public)
+	node.noise.l.RUnlock()
+
+	stream := node.grpcClient.StreamStatus()
+	status := &nodev1.StatusResponse{
+		LoggedIn:             node.loggedIn.Load(),
+		Running:              node.running.Load(),
+		PeerId:               node.id,
+		Hostname:             node.hostname,
+		PublicKey:            pubkey,
+		Controller:           node.controller,
+		ControllerState:      stream.State.String(),
+		ControllerStateSince: timeSeconds(stream.Since),
+		ControllerRetryAt:    timeSeconds(stream.RetryAt),
+	}
+	if stream.Err != nil {
+		status.ControllerError = stream.Err.Error()
+	}
+	if node.ip.IsValid() {
+		status.TunnelIp = node.ip.String()
+	}
+
+	node.maps.l.RLock()
+	peers := make([]*Peer, 0, len(node.maps.id))
+	for _, peer := range node.maps.id {
+		peers = append(peers, peer)
+	}
+	node.maps.l.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	for _, peer := range peers {
+		status.Peers = append(status.Peers, peer.Status())
+	}
+
+	return status
+}
+
+func timeSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func unixSeconds(nanos int64) int64 {
+	if nanos == 0 {
+		return 0
+	}
+	return time.Unix(0, nanos).Unix()
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/caldog20/zeronet/noiseconn"
+)
+
+// Interval the peer timers are evaluated at
+const timerTick = time.Second
+
+// runTimers drives the keepalive and dead peer detection for a single session.
+// An empty data message is sent when nothing has been sent for TimerKeepalive,
+// so a live session always receives something within TimerRxTimeout. If nothing
+// is received for TimerRxTimeout the session is considered dead and recovered
+func (peer *Peer) runTimers(nc *noiseconn.Conn, session uint64) {
+	ticker := time.NewTicker(timerTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !peer.running.Load() || !peer.inTransport.Load() || peer.session.Load() != session {
+			return
+		}
+
+		now := time.Now()
+
+		lastRx := max(peer.lastRx.Load(), peer.lastHandshake.Load())
+		if now.Sub(time.Unix(0, lastRx)) >= TimerRxTimeout {
+			log.Printf("peer %d rx timeout, nothing received for %s", peer.ID, TimerRxTimeout)
+			go peer.recoverSession()
+			return
+		}
+
+		lastTx := max(peer.lastTx.Load(), peer.lastHandshake.Load())
+		if now.Sub(time.Unix(0, lastTx)) >= TimerKeepalive {
+			peer.sendKeepalive(nc)
+		}
+	}
+}
+
+func (peer *Peer) sendKeepalive(nc *noiseconn.Conn) {
+	_, err := nc.Write(nil)
+	if err != nil {
+		debugf("peer %d error sending keepalive: %s", peer.ID, err)
+		return
+	}
+	peer.lastTx.Store(time.Now().UnixNano())
+}
+
+// recoverSession restarts ICE and performs a new noise handshake after the
+// session has timed out. Only the side that initiated the previous session
+// retries, up to CountHandshakeRetries times, the other side resets and waits
+// for a new offer. If every attempt fails the peer is left idle and a new
+// connection is initiated on the next outbound packet
+func (peer *Peer) recoverSession() {
+	if !peer.recovering.CompareAndSwap(false, true) {
+		return
+	}
+	defer peer.recovering.Store(false)
+
+	if !peer.initiator.Load() {
+		peer.ResetState()
+		return
+	}
+
+	for attempt := 1; attempt <= CountHandshakeRetries; attempt++ {
+		if !peer.running.Load() {
+			return
+		}
+
+		debugf("peer %d reconnect attempt %d/%d", peer.ID, attempt, CountHandshakeRetries)
+		peer.ResetState()
+		peer.InitiateConnection()
+		if peer.waitForConnectAttempt() {
+			log.Printf("peer %d session recovered after %d attempts", peer.ID, attempt)
+			return
+		}
+
+		time.Sleep(TimerHandshakeTimeout)
+	}
+
+	log.Printf("peer %d unreachable after %d attempts, going idle", peer.ID, CountHandshakeRetries)
+	peer.ResetState()
+}
+
+// waitForConnectAttempt blocks until the current connection attempt finishes
+// and reports whether the peer is back in transport
+func (peer *Peer) waitForConnectAttempt() bool {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !peer.running.Load() {
+			return false
+		}
+		if peer.inTransport.Load() {
+			return true
+		}
+		if !peer.connecting.Load() {
+			return false
+		}
+	}
+
+	return false
+}
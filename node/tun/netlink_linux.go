@@ -0,0 +1,209 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Minimal rtnetlink client for configuring the tunnel interface without
+// shelling out to iproute2
+
+var netlinkSeq atomic.Uint32
+
+type netlinkRequest struct {
+	msgType uint16
+	flags   uint16
+	data    []byte
+}
+
+func newNetlinkRequest(msgType uint16, flags uint16, msg []byte) *netlinkRequest {
+	return &netlinkRequest{
+		msgType: msgType,
+		flags:   flags | unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		data:    append([]byte(nil), msg...),
+	}
+}
+
+func rtaAlignOf(n int) int {
+	return (n + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
+
+func (r *netlinkRequest) addAttr(attrType uint16, value []byte) {
+	length := unix.SizeofRtAttr + len(value)
+	attr := make([]byte, rtaAlignOf(length))
+	binary.NativeEndian.PutUint16(attr[0:], uint16(length))
+	binary.NativeEndian.PutUint16(attr[2:], attrType)
+	copy(attr[unix.SizeofRtAttr:], value)
+	r.data = append(r.data, attr...)
+}
+
+func (r *netlinkRequest) addUint32Attr(attrType uint16, value uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, value)
+	r.addAttr(attrType, b)
+}
+
+func (r *netlinkRequest) serialize(seq uint32) []byte {
+	length := unix.SizeofNlMsghdr + len(r.data)
+	b := make([]byte, length)
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&b[0]))
+	hdr.Len = uint32(length)
+	hdr.Type = r.msgType
+	hdr.Flags = r.flags
+	hdr.Seq = seq
+	copy(b[unix.SizeofNlMsghdr:], r.data)
+	return b
+}
+
+// execute sends the request on a new netlink socket and waits for the kernel ack
+func (r *netlinkRequest) execute() error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("error opening netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("error binding netlink socket: %w", err)
+	}
+
+	seq := netlinkSeq.Add(1)
+	if err = unix.Sendto(fd, r.serialize(seq), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("error sending netlink request: %w", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("error reading netlink response: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("error parsing netlink response: %w", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Seq != seq {
+				continue
+			}
+			if msg.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(msg.Data) < 4 {
+				return errors.New("short netlink error message")
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(msg.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	msg := (*unix.IfInfomsg)(unsafe.Pointer(&b[0]))
+	msg.Family = unix.AF_UNSPEC
+	msg.Index = int32(index)
+	msg.Flags = flags
+	msg.Change = change
+	return b
+}
+
+// linkSetMTU sets the interface MTU
+func linkSetMTU(index int, mtu int) error {
+	req := newNetlinkRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, 0, 0))
+	req.addUint32Attr(unix.IFLA_MTU, uint32(mtu))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("error setting link mtu: %w", err)
+	}
+	return nil
+}
+
+// linkSetUp brings the interface up
+func linkSetUp(index int) error {
+	req := newNetlinkRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, unix.IFF_UP, unix.IFF_UP))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("error setting link up: %w", err)
+	}
+	return nil
+}
+
+func addrRequest(msgType uint16, flags uint16, index int, addr netip.Prefix) *netlinkRequest {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	msg := (*unix.IfAddrmsg)(unsafe.Pointer(&b[0]))
+	msg.Family = addrFamily(addr.Addr())
+	msg.Prefixlen = uint8(addr.Bits())
+	msg.Index = uint32(index)
+
+	req := newNetlinkRequest(msgType, flags, b)
+	req.addAttr(unix.IFA_LOCAL, addr.Addr().AsSlice())
+	req.addAttr(unix.IFA_ADDRESS, addr.Addr().AsSlice())
+	return req
+}
+
+// addrAdd assigns addr to the interface, replacing it if already present
+func addrAdd(index int, addr netip.Prefix) error {
+	req := addrRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, index, addr)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("error adding address %s: %w", addr, err)
+	}
+	return nil
+}
+
+func addrDel(index int, addr netip.Prefix) error {
+	req := addrRequest(unix.RTM_DELADDR, 0, index, addr)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("error removing address %s: %w", addr, err)
+	}
+	return nil
+}
+
+func routeRequest(msgType uint16, flags uint16, index int, prefix netip.Prefix) *netlinkRequest {
+	b := make([]byte, unix.SizeofRtMsg)
+	msg := (*unix.RtMsg)(unsafe.Pointer(&b[0]))
+	msg.Family = addrFamily(prefix.Addr())
+	msg.Dst_len = uint8(prefix.Bits())
+	msg.Table = unix.RT_TABLE_MAIN
+	msg.Protocol = unix.RTPROT_STATIC
+	msg.Scope = unix.RT_SCOPE_LINK
+	msg.Type = unix.RTN_UNICAST
+
+	req := newNetlinkRequest(msgType, flags, b)
+	req.addAttr(unix.RTA_DST, prefix.Masked().Addr().AsSlice())
+	req.addUint32Attr(unix.RTA_OIF, uint32(index))
+	return req
+}
+
+// routeAdd adds an on-link route for prefix through the interface
+func routeAdd(index int, prefix netip.Prefix) error {
+	req := routeRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, index, prefix)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("error adding route %s: %w", prefix, err)
+	}
+	return nil
+}
+
+func routeDel(index int, prefix netip.Prefix) error {
+	req := routeRequest(unix.RTM_DELROUTE, 0, index, prefix)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("error removing route %s: %w", prefix, err)
+	}
+	return nil
+}
+
+func addrFamily(addr netip.Addr) uint8 {
+	if addr.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
@@ -0,0 +1,394 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netstackNIC       tcpip.NICID = 1
+	netstackQueueSize             = 1024
+	// Receive window and concurrent handshake limit for inbound forwarded connections
+	forwarderRcvWnd      = 0
+	forwarderMaxInFlight = 1024
+)
+
+// NetTun is a Tun backed by a userspace TCP/IP stack, for hosts where /dev/net/tun
+// or CAP_NET_ADMIN are unavailable. Nothing is visible to the host network stack,
+// connections into the overlay are made with DialContext and inbound TCP
+// connections to the overlay IP are forwarded to local ports
+type NetTun struct {
+	stack *stack.Stack
+	ep    *channel.Endpoint
+	mtu   int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock sync.RWMutex
+	addr netip.Addr
+	// Routes through the tunnel, the stack route table is rebuilt from these
+	routes []netip.Prefix
+	// Overlay port to local address
+	forwards map[uint16]string
+
+	closed atomic.Bool
+}
+
+// NewNetTun creates a userspace tunnel. Inbound TCP connections to a port in
+// forwards are proxied to the mapped local address, others are reset
+func NewNetTun(mtu int, forwards map[uint16]string) (*NetTun, error) {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
+	t := &NetTun{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+			HandleLocal:        true,
+		}),
+		ep:       channel.New(netstackQueueSize, uint32(mtu), ""),
+		mtu:      mtu,
+		forwards: make(map[uint16]string),
+	}
+	for port, target := range forwards {
+		t.forwards[port] = target
+	}
+
+	if err := t.stack.CreateNIC(netstackNIC, t.ep); err != nil {
+		return nil, fmt.Errorf("error creating netstack nic: %s", err)
+	}
+
+	forwarder := tcp.NewForwarder(t.stack, forwarderRcvWnd, forwarderMaxInFlight, t.handleTCP)
+	t.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t, nil
+}
+
+// Read returns the next packet sent by the userspace stack
+func (t *NetTun) Read(b []byte) (int, error) {
+	pkt := t.ep.ReadContext(t.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	defer pkt.DecRef()
+
+	n := 0
+	for _, s := range pkt.AsSlices() {
+		n += copy(b[n:], s)
+	}
+	return n, nil
+}
+
+// Write delivers a packet from the overlay to the userspace stack
+func (t *NetTun) Write(b []byte) (int, error) {
+	if t.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+	t.ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+	return len(b), nil
+}
+
+func (t *NetTun) BatchSize() int {
+	return 1
+}
+
+func (t *NetTun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return readBatch(t, bufs, sizes)
+}
+
+func (t *NetTun) WriteBatch(bufs [][]byte) (int, error) {
+	return writeBatch(t, bufs)
+}
+
+func (t *NetTun) Name() string {
+	return "netstack"
+}
+
+func (t *NetTun) Close() error {
+	if !t.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	t.cancel()
+	t.ep.Close()
+	t.stack.Close()
+	return nil
+}
+
+func (t *NetTun) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+// SetMTU is not supported at runtime, the MTU is fixed when the stack is created
+func (t *NetTun) SetMTU(mtu int) error {
+	if mtu == t.mtu {
+		return nil
+	}
+	return errors.New("userspace tunnel mtu can't be changed while running")
+}
+
+func (t *NetTun) ConfigureIPAddress(addr netip.Prefix) error {
+	if !addr.Addr().Is4() {
+		return fmt.Errorf("unsupported tunnel address: %s", addr)
+	}
+
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFromSlice(addr.Addr().AsSlice()).WithPrefix(),
+	}
+	if err := t.stack.AddProtocolAddress(netstackNIC, protocolAddr, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("error adding netstack address: %s", err)
+	}
+
+	t.lock.Lock()
+	t.addr = addr.Addr()
+	t.lock.Unlock()
+
+	log.Printf("set userspace tunnel IP successful: %v", addr.Addr())
+	return t.AddRoute(addr.Masked())
+}
+
+// ConfigureDNS is a no-op as the userspace stack doesn't resolve names
+func (t *NetTun) ConfigureDNS(servers []netip.Addr) error {
+	return nil
+}
+
+func (t *NetTun) AddRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("unsupported route: %s", prefix)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, p := range t.routes {
+		if p == prefix {
+			return nil
+		}
+	}
+	t.routes = append(t.routes, prefix)
+	t.updateRouteTableLocked()
+	return nil
+}
+
+func (t *NetTun) RemoveRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, p := range t.routes {
+		if p == prefix {
+			t.routes = append(t.routes[:i], t.routes[i+1:]...)
+			t.updateRouteTableLocked()
+			return nil
+		}
+	}
+	return fmt.Errorf("route %s not found", prefix)
+}
+
+func (t *NetTun) updateRouteTableLocked() {
+	table := make([]tcpip.Route, 0, len(t.routes))
+	for _, p := range t.routes {
+		subnet, err := tcpip.NewSubnet(tcpip.AddrFromSlice(p.Addr().AsSlice()), tcpip.MaskFromBytes(net.CIDRMask(p.Bits(), 32)))
+		if err != nil {
+			continue
+		}
+		table = append(table, tcpip.Route{Destination: subnet, NIC: netstackNIC})
+	}
+	t.stack.SetRouteTable(table)
+}
+
+// DialContext connects to address through the userspace stack.
+// Only tcp and udp networks with IP addresses are supported
+func (t *NetTun) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !addrPort.Addr().Is4() {
+		return nil, fmt.Errorf("unsupported address: %s", address)
+	}
+
+	full := tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFromSlice(addrPort.Addr().AsSlice()),
+		Port: addrPort.Port(),
+	}
+
+	switch network {
+	case "tcp", "tcp4":
+		return gonet.DialContextTCP(ctx, t.stack, full, ipv4.ProtocolNumber)
+	case "udp", "udp4":
+		return gonet.DialUDP(t.stack, nil, &full, ipv4.ProtocolNumber)
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+}
+
+// Listen listens for TCP connections on the userspace stack. An empty host
+// listens on every address of the tunnel
+func (t *NetTun) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	full, err := listenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.ListenTCP(t.stack, full, ipv4.ProtocolNumber)
+}
+
+// ListenPacket listens for UDP packets on the userspace stack
+func (t *NetTun) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	full, err := listenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialUDP(t.stack, &full, nil, ipv4.ProtocolNumber)
+}
+
+func listenAddress(address string) (tcpip.FullAddress, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	full := tcpip.FullAddress{NIC: netstackNIC, Port: uint16(port)}
+	if host != "" {
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !addr.Is4() {
+			return tcpip.FullAddress{}, fmt.Errorf("unsupported address: %s", address)
+		}
+		full.Addr = tcpip.AddrFromSlice(addr.AsSlice())
+	}
+	return full, nil
+}
+
+// SetForward forwards inbound TCP connections on port to target, removing the
+// forward when target is empty
+func (t *NetTun) SetForward(port uint16, target string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if target == "" {
+		delete(t.forwards, port)
+		return
+	}
+	t.forwards[port] = target
+}
+
+func (t *NetTun) handleTCP(req *tcp.ForwarderRequest) {
+	id := req.ID()
+
+	t.lock.RLock()
+	target, found := t.forwards[id.LocalPort]
+	local := t.addr
+	t.lock.RUnlock()
+
+	// Only accept connections to our own overlay address on a forwarded port
+	dst, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	if !found || dst != local {
+		req.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := req.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Printf("error accepting forwarded connection to port %d: %s", id.LocalPort, tcpErr)
+		req.Complete(true)
+		return
+	}
+	req.Complete(false)
+
+	conn := gonet.NewTCPConn(&wq, ep)
+	go forward(conn, target)
+}
+
+func forward(conn net.Conn, target string) {
+	defer conn.Close()
+
+	local, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Printf("error dialing forward target %s: %s", target, err)
+		return
+	}
+	defer local.Close()
+
+	pipe(conn, local)
+}
+
+// pipe copies data between a and b until either side is done
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Half close so the other direction can drain
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+// ParseForward parses a port forward in <port>:<host:port> format
+func ParseForward(s string) (uint16, string, error) {
+	portStr, target, found := strings.Cut(s, ":")
+	if !found {
+		return 0, "", fmt.Errorf("invalid forward %q, expected <port>:<host:port>", s)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid forward port %q: %w", portStr, err)
+	}
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		return 0, "", fmt.Errorf("invalid forward target %q: %w", target, err)
+	}
+	return uint16(port), target, nil
+}
@@ -0,0 +1,148 @@
+package tun
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// linkNetTuns forwards packets read from a to b and from b to a
+func linkNetTuns(a, b *NetTun) {
+	relay := func(src, dst *NetTun) {
+		buf := make([]byte, DefaultMTU)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			dst.Write(buf[:n])
+		}
+	}
+	go relay(a, b)
+	go relay(b, a)
+}
+
+func TestNetTunForward(t *testing.T) {
+	// Local service the inbound overlay port is forwarded to
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	client, err := NewNetTun(DefaultMTU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewNetTun(DefaultMTU, map[uint16]string{8080: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err = client.ConfigureIPAddress(netip.MustParsePrefix("100.70.0.1/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.ConfigureIPAddress(netip.MustParsePrefix("100.70.0.2/24")); err != nil {
+		t.Fatal(err)
+	}
+	linkNetTuns(client, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Ports without a forward are reset
+	if _, err = client.DialContext(ctx, "tcp", "100.70.0.2:9090"); err == nil {
+		t.Fatal("expected connection to unforwarded port to fail")
+	}
+
+	conn, err := client.DialContext(ctx, "tcp", "100.70.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	msg := []byte("hello overlay")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Fatalf("echo mismatch: %q", buf)
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	port, target, err := ParseForward("8080:127.0.0.1:80")
+	if err != nil || port != 8080 || target != "127.0.0.1:80" {
+		t.Fatalf("unexpected forward %d %s %v", port, target, err)
+	}
+	for _, s := range []string{"8080", "x:127.0.0.1:80", "70000:127.0.0.1:80", "8080:127.0.0.1"} {
+		if _, _, err = ParseForward(s); err == nil {
+			t.Fatalf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestNetTunListen(t *testing.T) {
+	client, err := NewNetTun(DefaultMTU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewNetTun(DefaultMTU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client.ConfigureIPAddress(netip.MustParsePrefix("100.70.0.1/24"))
+	server.ConfigureIPAddress(netip.MustParsePrefix("100.70.0.2/24"))
+	linkNetTuns(client, server)
+
+	l, err := server.Listen("tcp", ":8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", "100.70.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected response %q", b)
+	}
+}
@@ -0,0 +1,392 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Segmentation offload support for tun devices opened with IFF_VNET_HDR. Reads may
+// return TCP or UDP super-packets that are split into MTU sized segments here, and
+// runs of segments from the same flow are coalesced into super-packets on write so
+// the kernel handles them in one pass
+
+const (
+	virtioNetHdrLen = 10
+	// Largest super-packet the kernel hands us or accepts
+	maxSuperPacketSize = 65535
+	// Segment limit for a coalesced super-packet
+	maxCoalescedSegments = 64
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	// Offsets of the checksum field within the transport header
+	tcpChecksumOffset = 16
+	udpChecksumOffset = 6
+)
+
+var (
+	errInvalidVirtioHdr = errors.New("invalid virtio net header")
+	errTooManySegments  = errors.New("not enough buffers to split super-packet")
+	errShortBuffer      = errors.New("buffer too small for packet")
+)
+
+// virtioNetHdr is the header the kernel prepends to every packet on an IFF_VNET_HDR
+// tun device, see struct virtio_net_hdr in include/uapi/linux/virtio_net.h
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return errInvalidVirtioHdr
+	}
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:])
+	return nil
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// checksumNoFold adds b to a ones' complement sum without folding the carries
+func checksumNoFold(b []byte, initial uint64) uint64 {
+	sum := initial
+	for len(b) >= 8 {
+		sum += uint64(binary.BigEndian.Uint32(b)) + uint64(binary.BigEndian.Uint32(b[4:]))
+		b = b[8:]
+	}
+	if len(b) >= 4 {
+		sum += uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+func checksum(b []byte, initial uint64) uint16 {
+	return checksumFold(checksumNoFold(b, initial))
+}
+
+func pseudoHeaderChecksumNoFold(protocol uint8, src, dst []byte, length uint16) uint64 {
+	sum := checksumNoFold(src, 0)
+	sum = checksumNoFold(dst, sum)
+	return sum + uint64(protocol) + uint64(length)
+}
+
+func ipAddrs(pkt []byte) (src, dst []byte) {
+	if pkt[0]>>4 == 6 {
+		return pkt[8:24], pkt[24:40]
+	}
+	return pkt[12:16], pkt[16:20]
+}
+
+// completeChecksum fills in a partial checksum left by the kernel for NEEDS_CSUM packets
+func completeChecksum(pkt []byte, hdr *virtioNetHdr) error {
+	start := int(hdr.csumStart)
+	field := start + int(hdr.csumOffset)
+	if field+2 > len(pkt) {
+		return errInvalidVirtioHdr
+	}
+	// The field holds the pseudo-header sum, so summing from csumStart gives the full checksum
+	sum := checksum(pkt[start:], 0)
+	binary.BigEndian.PutUint16(pkt[field:], ^sum)
+	return nil
+}
+
+// gsoSplit splits a TCP or UDP super-packet into segments of hdr.gsoSize payload
+// bytes, writing each full packet to bufs and its length to sizes
+func gsoSplit(pkt []byte, hdr *virtioNetHdr, bufs [][]byte, sizes []int) (int, error) {
+	if len(pkt) == 0 || hdr.gsoSize == 0 {
+		return 0, errInvalidVirtioHdr
+	}
+
+	isV6 := pkt[0]>>4 == 6
+	isTCP := hdr.gsoType == unix.VIRTIO_NET_HDR_GSO_TCPV4 || hdr.gsoType == unix.VIRTIO_NET_HDR_GSO_TCPV6
+	transportStart := int(hdr.csumStart)
+
+	// Don't trust hdrLen from the kernel, derive it from the transport header
+	var hdrLen, csumField int
+	var protocol uint8
+	if isTCP {
+		if transportStart+20 > len(pkt) {
+			return 0, errInvalidVirtioHdr
+		}
+		hdrLen = transportStart + int(pkt[transportStart+12]>>4)*4
+		csumField = transportStart + tcpChecksumOffset
+		protocol = unix.IPPROTO_TCP
+	} else {
+		hdrLen = transportStart + udpHeaderLen
+		csumField = transportStart + udpChecksumOffset
+		protocol = unix.IPPROTO_UDP
+	}
+	if hdrLen > len(pkt) || (!isV6 && transportStart < ipv4HeaderLen) || (isV6 && transportStart < ipv6HeaderLen) {
+		return 0, errInvalidVirtioHdr
+	}
+
+	src, dst := ipAddrs(pkt)
+	firstID := binary.BigEndian.Uint16(pkt[4:])
+	var firstSeq uint32
+	if isTCP {
+		firstSeq = binary.BigEndian.Uint32(pkt[transportStart+4:])
+	}
+
+	gsoSize := int(hdr.gsoSize)
+	count := 0
+	for offset := hdrLen; offset < len(pkt); offset += gsoSize {
+		if count == len(bufs) {
+			return count, errTooManySegments
+		}
+
+		end := min(offset+gsoSize, len(pkt))
+		total := hdrLen + end - offset
+		out := bufs[count]
+		if total > len(out) {
+			return count, errShortBuffer
+		}
+		copy(out, pkt[:hdrLen])
+		copy(out[hdrLen:], pkt[offset:end])
+		last := end == len(pkt)
+
+		if isV6 {
+			binary.BigEndian.PutUint16(out[4:], uint16(total-ipv6HeaderLen))
+		} else {
+			binary.BigEndian.PutUint16(out[2:], uint16(total))
+			binary.BigEndian.PutUint16(out[4:], firstID+uint16(count))
+			out[10], out[11] = 0, 0
+			binary.BigEndian.PutUint16(out[10:], ^checksum(out[:transportStart], 0))
+		}
+
+		if isTCP {
+			binary.BigEndian.PutUint32(out[transportStart+4:], firstSeq+uint32(gsoSize*count))
+			if !last {
+				out[transportStart+13] &^= tcpFlagFIN | tcpFlagPSH
+			}
+		} else {
+			binary.BigEndian.PutUint16(out[transportStart+4:], uint16(total-transportStart))
+		}
+
+		out[csumField], out[csumField+1] = 0, 0
+		sum := pseudoHeaderChecksumNoFold(protocol, src, dst, uint16(total-transportStart))
+		csum := ^checksum(out[transportStart:total], sum)
+		if !isTCP && csum == 0 {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(out[csumField:], csum)
+
+		sizes[count] = total
+		count++
+	}
+
+	return count, nil
+}
+
+// coalesceFlow describes the packets that may be appended to a super-packet
+type coalesceFlow struct {
+	first    []byte
+	protocol uint8
+	hdrLen   int
+	gsoSize  int
+	segments int
+	size     int
+	nextSeq  uint32
+	closed   bool
+	hasPSH   bool
+}
+
+func newCoalesceFlow(pkt []byte, protocol uint8, hdrLen int) coalesceFlow {
+	f := coalesceFlow{
+		first:    pkt,
+		protocol: protocol,
+		hdrLen:   hdrLen,
+		gsoSize:  len(pkt) - hdrLen,
+		size:     hdrLen,
+	}
+	if protocol == unix.IPPROTO_TCP {
+		f.nextSeq = binary.BigEndian.Uint32(pkt[ipv4HeaderLen+4:])
+	}
+	f.append(pkt)
+	return f
+}
+
+// coalescible returns the protocol and combined header length if pkt is an IPv4
+// TCP or UDP packet without IP options or fragmentation, with a valid checksum
+func coalescible(pkt []byte, uso bool) (protocol uint8, hdrLen int, ok bool) {
+	if len(pkt) < ipv4HeaderLen || pkt[0] != 0x45 {
+		return 0, 0, false
+	}
+	if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+		return 0, 0, false
+	}
+	// More fragments set or a fragment offset
+	if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+		return 0, 0, false
+	}
+
+	protocol = pkt[9]
+	switch protocol {
+	case unix.IPPROTO_TCP:
+		if len(pkt) < ipv4HeaderLen+20 {
+			return 0, 0, false
+		}
+		hdrLen = ipv4HeaderLen + int(pkt[ipv4HeaderLen+12]>>4)*4
+		if hdrLen < ipv4HeaderLen+20 {
+			return 0, 0, false
+		}
+		flags := pkt[ipv4HeaderLen+13]
+		// ECN and anything but plain data segments are passed through untouched
+		if flags&^(tcpFlagACK|tcpFlagPSH) != 0 || flags&tcpFlagACK == 0 {
+			return 0, 0, false
+		}
+	case unix.IPPROTO_UDP:
+		if !uso {
+			return 0, 0, false
+		}
+		hdrLen = ipv4HeaderLen + udpHeaderLen
+		if len(pkt) < hdrLen || int(binary.BigEndian.Uint16(pkt[ipv4HeaderLen+4:])) != len(pkt)-ipv4HeaderLen {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+	if hdrLen >= len(pkt) {
+		return 0, 0, false
+	}
+
+	src, dst := ipAddrs(pkt)
+	sum := pseudoHeaderChecksumNoFold(protocol, src, dst, uint16(len(pkt)-ipv4HeaderLen))
+	if protocol == unix.IPPROTO_UDP && binary.BigEndian.Uint16(pkt[ipv4HeaderLen+udpChecksumOffset:]) == 0 {
+		return 0, 0, false
+	}
+	if checksum(pkt[ipv4HeaderLen:], sum) != 0xffff {
+		return 0, 0, false
+	}
+
+	return protocol, hdrLen, true
+}
+
+// canAppend reports whether pkt continues the flow started by the first packet
+func (f *coalesceFlow) canAppend(pkt []byte, protocol uint8, hdrLen int) bool {
+	if f.closed || protocol != f.protocol || hdrLen != f.hdrLen {
+		return false
+	}
+	payload := len(pkt) - hdrLen
+	if payload > f.gsoSize || f.size+payload > maxSuperPacketSize || f.segments == maxCoalescedSegments {
+		return false
+	}
+
+	first := f.first
+	// Same TOS, DF bit, TTL, protocol and addresses
+	if pkt[1] != first[1] || pkt[6] != first[6] || pkt[8] != first[8] || string(pkt[12:20]) != string(first[12:20]) {
+		return false
+	}
+
+	if protocol == unix.IPPROTO_TCP {
+		t, ft := pkt[ipv4HeaderLen:hdrLen], first[ipv4HeaderLen:hdrLen]
+		// Ports and ack number, then window and options
+		if string(t[0:4]) != string(ft[0:4]) || string(t[8:12]) != string(ft[8:12]) || string(t[14:16]) != string(ft[14:16]) || string(t[20:]) != string(ft[20:]) {
+			return false
+		}
+		if binary.BigEndian.Uint32(t[4:]) != f.nextSeq {
+			return false
+		}
+	} else if string(pkt[ipv4HeaderLen:ipv4HeaderLen+4]) != string(first[ipv4HeaderLen:ipv4HeaderLen+4]) {
+		return false
+	}
+
+	return true
+}
+
+func (f *coalesceFlow) append(pkt []byte) {
+	payload := len(pkt) - f.hdrLen
+	f.segments++
+	f.size += payload
+	if f.protocol == unix.IPPROTO_TCP {
+		f.nextSeq += uint32(payload)
+		if pkt[ipv4HeaderLen+13]&tcpFlagPSH != 0 {
+			f.hasPSH = true
+			f.closed = true
+		}
+	}
+	// A short segment has to be the last one
+	if payload < f.gsoSize {
+		f.closed = true
+	}
+}
+
+// coalesce appends the payloads of pkts to out after the headers of the first packet,
+// fixing up the headers and filling hdr for a NEEDS_CSUM GSO write
+func coalesce(out []byte, pkts [][]byte, f *coalesceFlow, hdr *virtioNetHdr) []byte {
+	out = append(out[:0], pkts[0]...)
+	for _, pkt := range pkts[1:] {
+		out = append(out, pkt[f.hdrLen:]...)
+	}
+
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+	out[10], out[11] = 0, 0
+	binary.BigEndian.PutUint16(out[10:], ^checksum(out[:ipv4HeaderLen], 0))
+
+	*hdr = virtioNetHdr{
+		flags:     unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		hdrLen:    uint16(f.hdrLen),
+		gsoSize:   uint16(f.gsoSize),
+		csumStart: ipv4HeaderLen,
+	}
+
+	var csumField int
+	if f.protocol == unix.IPPROTO_TCP {
+		hdr.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV4
+		hdr.csumOffset = tcpChecksumOffset
+		csumField = ipv4HeaderLen + tcpChecksumOffset
+		if f.hasPSH {
+			out[ipv4HeaderLen+13] |= tcpFlagPSH
+		}
+	} else {
+		hdr.gsoType = unix.VIRTIO_NET_HDR_GSO_UDP_L4
+		hdr.csumOffset = udpChecksumOffset
+		csumField = ipv4HeaderLen + udpChecksumOffset
+		binary.BigEndian.PutUint16(out[ipv4HeaderLen+4:], uint16(len(out)-ipv4HeaderLen))
+	}
+
+	// The kernel completes the checksum from the pseudo-header sum
+	src, dst := ipAddrs(out)
+	sum := pseudoHeaderChecksumNoFold(f.protocol, src, dst, uint16(len(out)-ipv4HeaderLen))
+	binary.BigEndian.PutUint16(out[csumField:], checksumFold(sum))
+
+	return out
+}
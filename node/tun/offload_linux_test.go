@@ -0,0 +1,230 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	testSrc = []byte{100, 70, 0, 1}
+	testDst = []byte{100, 70, 0, 2}
+)
+
+func ipv4Packet(protocol uint8, transport []byte, id uint16) []byte {
+	pkt := make([]byte, ipv4HeaderLen+len(transport))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:], id)
+	pkt[6] = 0x40 // DF
+	pkt[8] = 64
+	pkt[9] = protocol
+	copy(pkt[12:], testSrc)
+	copy(pkt[16:], testDst)
+	binary.BigEndian.PutUint16(pkt[10:], ^checksum(pkt[:ipv4HeaderLen], 0))
+	copy(pkt[ipv4HeaderLen:], transport)
+
+	csumField := ipv4HeaderLen + tcpChecksumOffset
+	if protocol == unix.IPPROTO_UDP {
+		csumField = ipv4HeaderLen + udpChecksumOffset
+	}
+	sum := pseudoHeaderChecksumNoFold(protocol, testSrc, testDst, uint16(len(transport)))
+	binary.BigEndian.PutUint16(pkt[csumField:], ^checksum(pkt[ipv4HeaderLen:], sum))
+	return pkt
+}
+
+func tcpPacket(seq uint32, flags uint8, payload []byte, id uint16) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 5201)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 12345)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+	copy(tcp[20:], payload)
+	return ipv4Packet(unix.IPPROTO_TCP, tcp, id)
+}
+
+func udpPacket(payload []byte, id uint16) []byte {
+	udp := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], payload)
+	return ipv4Packet(unix.IPPROTO_UDP, udp, id)
+}
+
+func testPayload(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func verifyChecksums(t *testing.T, pkt []byte) {
+	t.Helper()
+	if checksum(pkt[:ipv4HeaderLen], 0) != 0xffff {
+		t.Fatal("invalid ip header checksum")
+	}
+	sum := pseudoHeaderChecksumNoFold(pkt[9], testSrc, testDst, uint16(len(pkt)-ipv4HeaderLen))
+	if checksum(pkt[ipv4HeaderLen:], sum) != 0xffff {
+		t.Fatal("invalid transport checksum")
+	}
+}
+
+func makeBufs(n, size int) ([][]byte, []int) {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+	return bufs, make([]int, n)
+}
+
+// superPacket coalesces pkts and completes the checksum like the kernel would
+func superPacket(t *testing.T, pkts [][]byte) ([]byte, virtioNetHdr) {
+	t.Helper()
+	protocol, hdrLen, ok := coalescible(pkts[0], true)
+	if !ok {
+		t.Fatal("first packet not coalescible")
+	}
+	flow := newCoalesceFlow(pkts[0], protocol, hdrLen)
+	for _, pkt := range pkts[1:] {
+		p, h, ok := coalescible(pkt, true)
+		if !ok || !flow.canAppend(pkt, p, h) {
+			t.Fatal("packet not appended to flow")
+		}
+		flow.append(pkt)
+	}
+
+	var hdr virtioNetHdr
+	out := coalesce(nil, pkts, &flow, &hdr)
+	return out, hdr
+}
+
+func TestOffloadTCPRoundTrip(t *testing.T) {
+	const mss = 1200
+	payload := testPayload(mss*5 + 300)
+
+	var pkts [][]byte
+	for off := 0; off < len(payload); off += mss {
+		end := min(off+mss, len(payload))
+		flags := uint8(tcpFlagACK)
+		if end == len(payload) {
+			flags |= tcpFlagPSH
+		}
+		pkts = append(pkts, tcpPacket(1000+uint32(off), flags, payload[off:end], uint16(off/mss)))
+	}
+
+	super, hdr := superPacket(t, pkts)
+	if hdr.gsoType != unix.VIRTIO_NET_HDR_GSO_TCPV4 || hdr.gsoSize != mss || hdr.hdrLen != 40 {
+		t.Fatalf("unexpected virtio header %+v", hdr)
+	}
+	if super[ipv4HeaderLen+13]&tcpFlagPSH == 0 {
+		t.Fatal("super-packet lost PSH flag")
+	}
+	if err := completeChecksum(super, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	verifyChecksums(t, super)
+
+	bufs, sizes := makeBufs(16, 1600)
+	n, err := gsoSplit(super, &hdr, bufs, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(pkts) {
+		t.Fatalf("split into %d segments, expected %d", n, len(pkts))
+	}
+	for i := range n {
+		seg := bufs[i][:sizes[i]]
+		verifyChecksums(t, seg)
+		if !bytes.Equal(seg, pkts[i]) {
+			t.Fatalf("segment %d does not match original packet", i)
+		}
+	}
+}
+
+func TestOffloadUDPRoundTrip(t *testing.T) {
+	pkts := [][]byte{
+		udpPacket(testPayload(1000), 1),
+		udpPacket(testPayload(1000), 2),
+		udpPacket(testPayload(1000), 3),
+		udpPacket(testPayload(10), 4),
+	}
+
+	super, hdr := superPacket(t, pkts)
+	if hdr.gsoType != unix.VIRTIO_NET_HDR_GSO_UDP_L4 || hdr.gsoSize != 1000 {
+		t.Fatalf("unexpected virtio header %+v", hdr)
+	}
+	if err := completeChecksum(super, &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	bufs, sizes := makeBufs(8, 1600)
+	n, err := gsoSplit(super, &hdr, bufs, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(pkts) {
+		t.Fatalf("split into %d segments, expected %d", n, len(pkts))
+	}
+	for i := range n {
+		seg := bufs[i][:sizes[i]]
+		verifyChecksums(t, seg)
+		if !bytes.Equal(seg, pkts[i]) {
+			t.Fatalf("segment %d does not match original packet", i)
+		}
+	}
+}
+
+func TestOffloadCoalesceBoundaries(t *testing.T) {
+	payload := testPayload(1000)
+	first := tcpPacket(0, tcpFlagACK, payload, 0)
+	protocol, hdrLen, ok := coalescible(first, false)
+	if !ok {
+		t.Fatal("plain ack segment should be coalescible")
+	}
+
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{"sequence gap", tcpPacket(2000, tcpFlagACK, payload, 1)},
+		{"larger segment", tcpPacket(1000, tcpFlagACK, testPayload(1100), 1)},
+		{"syn flag", tcpPacket(1000, tcpFlagACK|0x02, payload, 1)},
+		{"udp without uso", udpPacket(payload, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow := newCoalesceFlow(first, protocol, hdrLen)
+			p, h, ok := coalescible(tt.pkt, false)
+			if ok && flow.canAppend(tt.pkt, p, h) {
+				t.Fatal("packet should not be coalesced")
+			}
+		})
+	}
+
+	corrupt := tcpPacket(1000, tcpFlagACK, payload, 1)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, _, ok := coalescible(corrupt, false); ok {
+		t.Fatal("packet with a bad checksum should not be coalesced")
+	}
+
+	// A short segment ends the flow
+	flow := newCoalesceFlow(first, protocol, hdrLen)
+	short := tcpPacket(1000, tcpFlagACK, testPayload(10), 1)
+	p, h, _ := coalescible(short, false)
+	if !flow.canAppend(short, p, h) {
+		t.Fatal("short segment should be appended")
+	}
+	flow.append(short)
+	next := tcpPacket(1010, tcpFlagACK, testPayload(10), 2)
+	p, h, _ = coalescible(next, false)
+	if flow.canAppend(next, p, h) {
+		t.Fatal("flow should be closed after a short segment")
+	}
+}
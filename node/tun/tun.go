@@ -2,15 +2,51 @@ package tun
 
 import "net/netip"
 
-const MTU = 1300
+const DefaultMTU = 1300
 
 type Tun interface {
 	Read(b []byte) (int, error)
 	Write(b []byte) (int, error)
 
+	// BatchSize is the number of buffers ReadBatch should be given. A single read
+	// can return many packets when the device uses segmentation offload
+	BatchSize() int
+	// ReadBatch reads one or more packets into bufs, storing the length of each in sizes.
+	// It may return packets along with an error if not all of them fit
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+	// WriteBatch writes bufs in order, coalescing them where the device supports it
+	WriteBatch(bufs [][]byte) (int, error)
+
 	Name() string
 	Close() error
 	MTU() (int, error)
+	SetMTU(mtu int) error
 
 	ConfigureIPAddress(addr netip.Prefix) error
+	ConfigureDNS(servers []netip.Addr) error
+
+	// AddRoute and RemoveRoute manage routes through the tunnel at runtime,
+	// such as subnet routes and exit nodes
+	AddRoute(prefix netip.Prefix) error
+	RemoveRoute(prefix netip.Prefix) error
+}
+
+// readBatch implements ReadBatch for devices that return one packet per read
+func readBatch(t Tun, bufs [][]byte, sizes []int) (int, error) {
+	n, err := t.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+// writeBatch implements WriteBatch for devices without offloads
+func writeBatch(t Tun, bufs [][]byte) (int, error) {
+	for i, b := range bufs {
+		if _, err := t.Write(b); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
 }
@@ -0,0 +1,376 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tunDevice = "/dev/net/tun"
+	// Enough buffers to split a full size super-packet with a small MSS
+	offloadBatchSize = 128
+)
+
+// LinuxTun opens /dev/net/tun directly with IFF_VNET_HDR so TCP and UDP
+// segmentation offload can be enabled on the device
+type LinuxTun struct {
+	file  *os.File
+	rc    syscall.RawConn
+	name  string
+	index int
+	mtu   atomic.Int64
+
+	// Enabled offloads, TSO implies checksum offload
+	tso bool
+	uso bool
+
+	rx struct {
+		l sync.Mutex
+		// Virtio header and packet as read from the device
+		buf []byte
+		// Segments not yet returned by Read
+		bufs  [][]byte
+		sizes []int
+		n, i  int
+	}
+
+	// Addresses and routes added to the interface, removed again on Close
+	config struct {
+		l      sync.Mutex
+		addrs  []netip.Prefix
+		routes []netip.Prefix
+	}
+}
+
+var superPackets = sync.Pool{New: func() any {
+	b := make([]byte, 0, maxSuperPacketSize)
+	return &b
+}}
+
+func NewTun(mtu int) (Tun, error) {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
+	fd, err := unix.Open(tunDevice, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", tunDevice, err)
+	}
+
+	ifr, err := unix.NewIfreq("")
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("error creating tun device: %w", err)
+	}
+
+	tun := &LinuxTun{name: ifr.Name()}
+	iface, err := net.InterfaceByName(tun.name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("error looking up tun interface: %w", err)
+	}
+	tun.index = iface.Index
+	tun.setupOffload(fd)
+
+	// Non blocking so reads go through the runtime poller and are unblocked by Close
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	tun.file = os.NewFile(uintptr(fd), tunDevice)
+	tun.rc, err = tun.file.SyscallConn()
+	if err != nil {
+		tun.file.Close()
+		return nil, err
+	}
+
+	tun.rx.buf = make([]byte, virtioNetHdrLen+maxSuperPacketSize)
+	tun.mtu.Store(int64(mtu))
+	return tun, nil
+}
+
+func (t *LinuxTun) setupOffload(fd int) {
+	offloads := unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+
+	// USO needs Linux 6.2 or newer
+	err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offloads|unix.TUN_F_USO4|unix.TUN_F_USO6)
+	if err == nil {
+		t.tso, t.uso = true, true
+		return
+	}
+
+	err = unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offloads)
+	if err == nil {
+		t.tso = true
+		return
+	}
+
+	log.Printf("tun segmentation offload not supported: %s", err)
+}
+
+func (t *LinuxTun) BatchSize() int {
+	if t.tso {
+		return offloadBatchSize
+	}
+	return 1
+}
+
+func (t *LinuxTun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	t.rx.l.Lock()
+	defer t.rx.l.Unlock()
+	return t.readLocked(bufs, sizes)
+}
+
+func (t *LinuxTun) readLocked(bufs [][]byte, sizes []int) (int, error) {
+	n, err := t.file.Read(t.rx.buf)
+	if err != nil {
+		return 0, err
+	}
+
+	var hdr virtioNetHdr
+	if err = hdr.decode(t.rx.buf[:n]); err != nil {
+		return 0, err
+	}
+	pkt := t.rx.buf[virtioNetHdrLen:n]
+
+	switch hdr.gsoType {
+	case unix.VIRTIO_NET_HDR_GSO_NONE:
+		if hdr.flags&unix.VIRTIO_NET_HDR_F_NEEDS_CSUM != 0 {
+			if err = completeChecksum(pkt, &hdr); err != nil {
+				return 0, err
+			}
+		}
+		if len(pkt) > len(bufs[0]) {
+			return 0, errShortBuffer
+		}
+		sizes[0] = copy(bufs[0], pkt)
+		return 1, nil
+	case unix.VIRTIO_NET_HDR_GSO_TCPV4, unix.VIRTIO_NET_HDR_GSO_TCPV6, unix.VIRTIO_NET_HDR_GSO_UDP_L4:
+		return gsoSplit(pkt, &hdr, bufs, sizes)
+	default:
+		return 0, fmt.Errorf("unsupported virtio gso type: %d", hdr.gsoType)
+	}
+}
+
+// Read returns a single packet, queueing the rest of a split super-packet for later calls
+func (t *LinuxTun) Read(b []byte) (int, error) {
+	t.rx.l.Lock()
+	defer t.rx.l.Unlock()
+
+	if t.rx.i >= t.rx.n {
+		if len(t.rx.bufs) == 0 || len(t.rx.bufs[0]) < len(b) {
+			t.rx.bufs = make([][]byte, t.BatchSize())
+			t.rx.sizes = make([]int, t.BatchSize())
+			for i := range t.rx.bufs {
+				t.rx.bufs[i] = make([]byte, len(b))
+			}
+		}
+
+		n, err := t.readLocked(t.rx.bufs, t.rx.sizes)
+		if n == 0 {
+			return 0, err
+		}
+		t.rx.n, t.rx.i = n, 0
+	}
+
+	i := t.rx.i
+	t.rx.i++
+	return copy(b, t.rx.bufs[i][:t.rx.sizes[i]]), nil
+}
+
+func (t *LinuxTun) Write(b []byte) (int, error) {
+	return t.write(&virtioNetHdr{}, b)
+}
+
+func (t *LinuxTun) WriteBatch(bufs [][]byte) (int, error) {
+	for i := 0; i < len(bufs); {
+		j := i + 1
+
+		var flow coalesceFlow
+		if t.tso {
+			if protocol, hdrLen, ok := coalescible(bufs[i], t.uso); ok {
+				flow = newCoalesceFlow(bufs[i], protocol, hdrLen)
+				for j < len(bufs) {
+					protocol, hdrLen, ok = coalescible(bufs[j], t.uso)
+					if !ok || !flow.canAppend(bufs[j], protocol, hdrLen) {
+						break
+					}
+					flow.append(bufs[j])
+					j++
+				}
+			}
+		}
+
+		var err error
+		if j-i == 1 {
+			_, err = t.write(&virtioNetHdr{}, bufs[i])
+		} else {
+			var hdr virtioNetHdr
+			buf := superPackets.Get().(*[]byte)
+			*buf = coalesce(*buf, bufs[i:j], &flow, &hdr)
+			_, err = t.write(&hdr, *buf)
+			superPackets.Put(buf)
+		}
+		if err != nil {
+			return i, err
+		}
+
+		i = j
+	}
+
+	return len(bufs), nil
+}
+
+func (t *LinuxTun) write(hdr *virtioNetHdr, pkt []byte) (int, error) {
+	var vh [virtioNetHdrLen]byte
+	hdr.encode(vh[:])
+	iovs := [][]byte{vh[:], pkt}
+
+	var n int
+	var werr error
+	err := t.rc.Write(func(fd uintptr) bool {
+		n, werr = unix.Writev(int(fd), iovs)
+		return werr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if werr != nil {
+		return 0, werr
+	}
+	return n - virtioNetHdrLen, nil
+}
+
+func (t *LinuxTun) Name() string {
+	return t.name
+}
+
+func (t *LinuxTun) Close() error {
+	t.config.l.Lock()
+	for i := len(t.config.routes) - 1; i >= 0; i-- {
+		if err := routeDel(t.index, t.config.routes[i]); err != nil {
+			log.Printf("error cleaning up tunnel route: %s", err)
+		}
+	}
+	for _, addr := range t.config.addrs {
+		if err := addrDel(t.index, addr); err != nil {
+			log.Printf("error cleaning up tunnel address: %s", err)
+		}
+	}
+	t.config.routes = nil
+	t.config.addrs = nil
+	t.config.l.Unlock()
+
+	return t.file.Close()
+}
+
+func (t *LinuxTun) MTU() (int, error) {
+	return int(t.mtu.Load()), nil
+}
+
+func (t *LinuxTun) SetMTU(mtu int) error {
+	if mtu <= 0 {
+		return fmt.Errorf("invalid mtu: %d", mtu)
+	}
+
+	if err := linkSetMTU(t.index, mtu); err != nil {
+		return err
+	}
+
+	t.mtu.Store(int64(mtu))
+	log.Printf("set tunnel mtu successful: %v %d", t.name, mtu)
+	return nil
+}
+
+// ConfigureDNS sets the DNS servers for the tunnel interface, this requires systemd-resolved
+func (t *LinuxTun) ConfigureDNS(servers []netip.Addr) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	args := []string{"dns", t.name}
+	for _, s := range servers {
+		args = append(args, s.String())
+	}
+	if err := exec.Command("resolvectl", args...).Run(); err != nil {
+		return fmt.Errorf("resolvectl error: %w", err)
+	}
+
+	log.Printf("set tunnel dns servers successful: %v %v", t.name, servers)
+	return nil
+}
+
+func (t *LinuxTun) ConfigureIPAddress(addr netip.Prefix) error {
+	if err := linkSetMTU(t.index, int(t.mtu.Load())); err != nil {
+		return err
+	}
+
+	host := netip.PrefixFrom(addr.Addr(), addr.Addr().BitLen())
+	if err := addrAdd(t.index, host); err != nil {
+		return err
+	}
+	t.config.l.Lock()
+	if !slices.Contains(t.config.addrs, host) {
+		t.config.addrs = append(t.config.addrs, host)
+	}
+	t.config.l.Unlock()
+
+	if err := linkSetUp(t.index); err != nil {
+		return err
+	}
+	if err := t.AddRoute(addr.Masked()); err != nil {
+		return err
+	}
+
+	log.Printf("set tunnel IP successful: %v %v", t.name, addr.Addr().String())
+	return nil
+}
+
+// AddRoute routes prefix through the tunnel
+func (t *LinuxTun) AddRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if err := routeAdd(t.index, prefix); err != nil {
+		return err
+	}
+
+	t.config.l.Lock()
+	if !slices.Contains(t.config.routes, prefix) {
+		t.config.routes = append(t.config.routes, prefix)
+	}
+	t.config.l.Unlock()
+
+	log.Printf("added route %v dev %v", prefix, t.name)
+	return nil
+}
+
+// RemoveRoute removes a route previously added with AddRoute
+func (t *LinuxTun) RemoveRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if err := routeDel(t.index, prefix); err != nil {
+		return err
+	}
+
+	t.config.l.Lock()
+	t.config.routes = slices.DeleteFunc(t.config.routes, func(p netip.Prefix) bool { return p == prefix })
+	t.config.l.Unlock()
+
+	log.Printf("removed route %v dev %v", prefix, t.name)
+	return nil
+}
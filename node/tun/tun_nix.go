@@ -1,29 +1,39 @@
-//go:build darwin || linux || freebsd || netbsd
+//go:build darwin || freebsd || netbsd
 
 package tun
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/netip"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/songgao/water"
 )
 
-// Currently, this is used for Mac/Linux Tunnels
+// Currently, this is used for Mac Tunnels, Linux has its own implementation with offloads
 type NixTun struct {
 	ifce *water.Interface
+	mtu  atomic.Int64
 }
 
-func NewTun() (Tun, error) {
+func NewTun(mtu int) (Tun, error) {
 	ifce, err := water.New(water.Config{DeviceType: water.TUN})
 	if err != nil {
 		return nil, err
 	}
 
-	return &NixTun{ifce: ifce}, nil
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
+	tun := &NixTun{ifce: ifce}
+	tun.mtu.Store(int64(mtu))
+	return tun, nil
 }
 
 func (n *NixTun) Read(b []byte) (int, error) {
@@ -34,6 +44,18 @@ func (n *NixTun) Write(b []byte) (int, error) {
 	return n.ifce.Write(b)
 }
 
+func (n *NixTun) BatchSize() int {
+	return 1
+}
+
+func (n *NixTun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return readBatch(n, bufs, sizes)
+}
+
+func (n *NixTun) WriteBatch(bufs [][]byte) (int, error) {
+	return writeBatch(n, bufs)
+}
+
 func (n *NixTun) Name() string {
 	return n.ifce.Name()
 }
@@ -43,36 +65,70 @@ func (n *NixTun) Close() error {
 }
 
 func (n *NixTun) MTU() (int, error) {
-	return MTU, nil
+	return int(n.mtu.Load()), nil
 }
 
-func (n *NixTun) ConfigureIPAddress(addr netip.Prefix) error {
+func (n *NixTun) SetMTU(mtu int) error {
+	if mtu <= 0 {
+		return fmt.Errorf("invalid mtu: %d", mtu)
+	}
+
 	switch runtime.GOOS {
-	case "linux":
-		if err := exec.Command("/sbin/ip", "link", "set", "dev", n.Name(), "mtu", "1400").Run(); err != nil {
-			return fmt.Errorf("ip link error: %w", err)
-		}
-		if err := exec.Command("/sbin/ip", "addr", "add", addr.Addr().String()+"/32", "dev", n.Name()).Run(); err != nil {
-			return fmt.Errorf("ip addr error: %w", err)
-		}
-		if err := exec.Command("/sbin/ip", "link", "set", "dev", n.Name(), "up").Run(); err != nil {
-			return fmt.Errorf("ip link error: %w", err)
-		}
-		if err := exec.Command("/sbin/ip", "route", "add", addr.Masked().String(), "via", addr.Addr().String()).Run(); err != nil {
-			log.Fatalf("route add error: %v", err)
-		}
 	case "darwin":
-		if err := exec.Command("/sbin/ifconfig", n.Name(), "mtu", "1400", addr.Addr().String(), addr.Addr().String(), "up").Run(); err != nil {
+		if err := exec.Command("/sbin/ifconfig", n.Name(), "mtu", strconv.Itoa(mtu)).Run(); err != nil {
 			return fmt.Errorf("ifconfig error %v: %w", n.Name(), err)
 		}
-		if err := exec.Command("/sbin/route", "-n", "add", "-net", addr.Masked().String(), addr.Addr().String()).Run(); err != nil {
-			log.Fatalf("route add error: %v", err)
+	default:
+		return fmt.Errorf("no tun support for: %v", runtime.GOOS)
+	}
+
+	n.mtu.Store(int64(mtu))
+	log.Printf("set tunnel mtu successful: %v %d", n.Name(), mtu)
+	return nil
+}
+
+// ConfigureDNS is currently unsupported on these platforms
+func (n *NixTun) ConfigureDNS(servers []netip.Addr) error {
+	if len(servers) == 0 {
+		return nil
+	}
+	return errors.New("dns configuration not supported on " + runtime.GOOS)
+}
+
+func (n *NixTun) ConfigureIPAddress(addr netip.Prefix) error {
+	switch runtime.GOOS {
+	case "darwin":
+		if err := exec.Command("/sbin/ifconfig", n.Name(), "mtu", strconv.Itoa(int(n.mtu.Load())), addr.Addr().String(), addr.Addr().String(), "up").Run(); err != nil {
+			return fmt.Errorf("ifconfig error %v: %w", n.Name(), err)
 		}
 	default:
 		return fmt.Errorf("no tun support for: %v", runtime.GOOS)
 	}
 
 	log.Printf("set tunnel IP successful: %v %v", n.Name(), addr.Addr().String())
-	log.Printf("set route successful: %v via %v dev %v", addr.Masked().String(), addr.Addr().String(), n.Name())
+	return n.AddRoute(addr.Masked())
+}
+
+func (n *NixTun) AddRoute(prefix netip.Prefix) error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("no tun support for: %v", runtime.GOOS)
+	}
+	if err := exec.Command("/sbin/route", "-n", "add", "-net", prefix.Masked().String(), "-interface", n.Name()).Run(); err != nil {
+		return fmt.Errorf("route add error: %w", err)
+	}
+
+	log.Printf("added route %v dev %v", prefix.Masked(), n.Name())
+	return nil
+}
+
+func (n *NixTun) RemoveRoute(prefix netip.Prefix) error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("no tun support for: %v", runtime.GOOS)
+	}
+	if err := exec.Command("/sbin/route", "-n", "delete", "-net", prefix.Masked().String(), "-interface", n.Name()).Run(); err != nil {
+		return fmt.Errorf("route delete error: %w", err)
+	}
+
+	log.Printf("removed route %v dev %v", prefix.Masked(), n.Name())
 	return nil
 }
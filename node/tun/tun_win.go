@@ -40,9 +40,14 @@ type WinTun struct {
 	closeOnce sync.Once
 	running   sync.WaitGroup
 	writeLock sync.Mutex // Currently used because I am calling write from multiple goroutines
+	mtu       atomic.Int64
 }
 
-func NewTun() (Tun, error) {
+func NewTun(mtu int) (Tun, error) {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
 	wt, err := wintun.CreateAdapter(WintunAdapaterName, WuntunAdapaterType, WintunStaticRequestedGUID)
 	if err != nil {
 		return nil, fmt.Errorf("error creating wintun adapater: %w", err)
@@ -56,13 +61,15 @@ func NewTun() (Tun, error) {
 
 	rw := sess.ReadWaitEvent()
 
-	return &WinTun{
+	tun := &WinTun{
 		wt:       wt,
 		name:     WintunAdapaterName,
 		handle:   windows.InvalidHandle,
 		readWait: rw,
 		session:  sess,
-	}, nil
+	}
+	tun.mtu.Store(int64(mtu))
+	return tun, nil
 }
 
 func (tun *WinTun) Name() string {
@@ -127,6 +134,18 @@ func (tun *WinTun) Write(b []byte) (int, error) {
 
 }
 
+func (tun *WinTun) BatchSize() int {
+	return 1
+}
+
+func (tun *WinTun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return readBatch(tun, bufs, sizes)
+}
+
+func (tun *WinTun) WriteBatch(bufs [][]byte) (int, error) {
+	return writeBatch(tun, bufs)
+}
+
 func (tun *WinTun) Close() error {
 	var closeErr error
 	tun.closeOnce.Do(func() {
@@ -143,7 +162,36 @@ func (tun *WinTun) Close() error {
 }
 
 func (tun *WinTun) MTU() (int, error) {
-	return 1400, nil
+	return int(tun.mtu.Load()), nil
+}
+
+func (tun *WinTun) SetMTU(mtu int) error {
+	if mtu <= 0 {
+		return fmt.Errorf("invalid mtu: %d", mtu)
+	}
+
+	luid := winipcfg.LUID(tun.LUID())
+	iface, err := luid.IPInterface(windows.AF_INET)
+	if err != nil {
+		return err
+	}
+	iface.NLMTU = uint32(mtu)
+	err = iface.Set()
+	if err != nil {
+		return err
+	}
+
+	tun.mtu.Store(int64(mtu))
+	return nil
+}
+
+func (tun *WinTun) ConfigureDNS(servers []netip.Addr) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	luid := winipcfg.LUID(tun.LUID())
+	return luid.SetDNS(windows.AF_INET, servers, nil)
 }
 
 func (tun *WinTun) LUID() uint64 {
@@ -162,5 +210,16 @@ func (tun *WinTun) ConfigureIPAddress(addr netip.Prefix) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return tun.SetMTU(int(tun.mtu.Load()))
+}
+
+func (tun *WinTun) AddRoute(prefix netip.Prefix) error {
+	luid := winipcfg.LUID(tun.LUID())
+	return luid.AddRoute(prefix.Masked(), netip.IPv4Unspecified(), 0)
+}
+
+func (tun *WinTun) RemoveRoute(prefix netip.Prefix) error {
+	luid := winipcfg.LUID(tun.LUID())
+	return luid.DeleteRoute(prefix.Masked(), netip.IPv4Unspecified())
 }
@@ -0,0 +1,94 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/caldog20/zeronet/node/proxy"
+	"github.com/caldog20/zeronet/node/tun"
+)
+
+// newTun creates the kernel tunnel, or the userspace netstack tunnel
+// when running in userspace mode
+func (node *Node) newTun() (tun.Tun, error) {
+	if node.config.Userspace {
+		return tun.NewNetTun(node.getMTU(), node.config.Forward)
+	}
+	return tun.NewTun(node.getMTU())
+}
+
+// UserspaceTun returns the userspace tunnel of a node running in userspace mode
+func (node *Node) UserspaceTun() (*tun.NetTun, error) {
+	if !node.running.Load() {
+		return nil, errors.New("node is not running")
+	}
+	netTun, ok := node.tun.(*tun.NetTun)
+	if !ok {
+		return nil, errors.New("node is not running in userspace mode")
+	}
+	return netTun, nil
+}
+
+// startProxies starts the configured local proxies dialing through the userspace tunnel
+func (node *Node) startProxies() error {
+	netTun, ok := node.tun.(*tun.NetTun)
+	if !ok {
+		return nil
+	}
+
+	server := proxy.NewServer(netTun.DialContext, node.LookupPeerIP)
+	listen := func(addr string, serve func(net.Listener) error, name string) error {
+		if addr == "" {
+			return nil
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("error starting %s proxy: %w", name, err)
+		}
+		node.proxyListeners = append(node.proxyListeners, l)
+
+		log.Printf("%s proxy listening on %s", name, l.Addr())
+		go func() {
+			if err := serve(l); err != nil {
+				log.Printf("%s proxy stopped: %s", name, err)
+			}
+		}()
+		return nil
+	}
+
+	if err := listen(node.config.SocksProxy, server.ServeSOCKS5, "socks5"); err != nil {
+		node.stopProxies()
+		return err
+	}
+	if err := listen(node.config.HTTPProxy, server.ServeHTTPConnect, "http"); err != nil {
+		node.stopProxies()
+		return err
+	}
+	return nil
+}
+
+func (node *Node) stopProxies() {
+	for _, l := range node.proxyListeners {
+		l.Close()
+	}
+	node.proxyListeners = nil
+}
+
+// LookupPeerIP resolves a peer hostname or ID to its overlay IP
+func (node *Node) LookupPeerIP(host string) (netip.Addr, bool) {
+	peer, found := node.findPeer(host)
+	if !found {
+		return netip.Addr{}, false
+	}
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return peer.IP, true
+}
+
+// IP returns the node's overlay address
+func (node *Node) IP() netip.Addr {
+	return node.ip.Addr()
+}
@@ -1,7 +1,12 @@
 package noiseconn
 
 import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/flynn/noise"
@@ -14,18 +19,25 @@ const (
 	HandshakeComplete
 )
 
+var (
+	ErrUnexpectedPeerStatic = errors.New("handshake static key does not match expected peer key")
+	ErrNonceExhausted       = errors.New("session nonce exhausted, rekey required")
+)
+
 var (
 // CipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
 // BaseConfig  = noise.Config{CipherSuite: CipherSuite, Pattern: noise.HandshakeIK}
 )
 
 type NoiseState struct {
-	state     atomic.Uint64
-	rx        *noise.CipherState
-	tx        *noise.CipherState
-	hs        *noise.HandshakeState
-	config    noise.Config
-	nonce     atomic.Uint64
+	state atomic.Uint64
+	// Transport ciphers use explicit nonces taken from the packet header
+	rx     transportCipher
+	tx     transportCipher
+	hs     *noise.HandshakeState
+	config noise.Config
+	// Expected remote static key, used to verify the initiator when responding
+	remoteStatic []byte
 }
 
 func NewNoiseState(s noise.DHKey, rs []byte) *NoiseState {
@@ -40,19 +52,18 @@ func NewNoiseState(s noise.DHKey, rs []byte) *NoiseState {
 	// }
 
 	return &NoiseState{
-		hs:     nil,
-		rx:     nil,
-		tx:     nil,
-		config: config,
+		hs:           nil,
+		config:       config,
+		remoteStatic: rs,
 	}
 }
 
 func (ns *NoiseState) Initialize(initiator bool) error {
 	ns.config.Initiator = initiator
-  
-  if !initiator {
-    ns.config.PeerStatic = nil
-  }
+
+	if !initiator {
+		ns.config.PeerStatic = nil
+	}
 
 	hs, err := noise.NewHandshakeState(ns.config)
 	if err != nil {
@@ -60,17 +71,16 @@ func (ns *NoiseState) Initialize(initiator bool) error {
 	}
 
 	ns.hs = hs
-	ns.rx = nil
-	ns.tx = nil
+	ns.rx = transportCipher{}
+	ns.tx = transportCipher{}
 
 	return nil
 }
 
 func (ns *NoiseState) Reset() {
 	ns.hs = nil
-	ns.rx = nil
-	ns.tx = nil
-	ns.nonce.Store(0)
+	ns.rx = transportCipher{}
+	ns.tx = transportCipher{}
 	ns.state.Store(None)
 }
 
@@ -91,6 +101,12 @@ func (ns *NoiseState) ConsumeHandshakeP1(in []byte) error {
 	if err != nil {
 		return fmt.Errorf("error reading handshake p1 message: %v", err)
 	}
+
+	// Responder doesn't know the initiator static up front with IK, so verify it
+	// here to reject handshakes using a stale or foreign key
+	if ns.remoteStatic != nil && subtle.ConstantTimeCompare(ns.hs.PeerStatic(), ns.remoteStatic) != 1 {
+		return ErrUnexpectedPeerStatic
+	}
 	ns.state.Store(HandshakeReceived)
 	return nil
 }
@@ -101,8 +117,8 @@ func (ns *NoiseState) GenerateHandshakeP2(out []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error writing handshake p2 message: %v", err)
 	}
-	ns.rx = rx
-	ns.tx = tx
+	ns.rx = newTransportCipher(rx.Cipher())
+	ns.tx = newTransportCipher(tx.Cipher())
 
 	ns.state.Store(HandshakeComplete)
 	return msg, nil
@@ -115,31 +131,69 @@ func (ns *NoiseState) ConsumeHandshakeP2(in []byte) error {
 		return fmt.Errorf("error reading handshake p2 message: %v", err)
 	}
 
-	ns.rx = rx
-	ns.tx = tx
+	ns.rx = newTransportCipher(rx.Cipher())
+	ns.tx = newTransportCipher(tx.Cipher())
 
 	ns.state.Store(HandshakeComplete)
 	return nil
 }
 
+// Decrypt decrypts ciphertext using nonce n from the packet header
 func (ns *NoiseState) Decrypt(ciphertext, decrypted []byte, n uint64) ([]byte, error) {
-	data, err := ns.rx.Decrypt(decrypted, nil, ciphertext)
+	data, err := ns.rx.decrypt(decrypted, n, ciphertext)
 	if err != nil {
 		return nil, fmt.Errorf("error decrypting message: %v", err)
 	}
-	ns.nonce.Add(1)
 	return data, nil
 }
 
+// Encrypt encrypts plaintext with nonce n, appending the result to encrypted.
+// The caller is responsible for never reusing a nonce
 func (ns *NoiseState) Encrypt(plaintext, encrypted []byte, n uint64) ([]byte, error) {
-	data, err := ns.tx.Encrypt(encrypted, nil, plaintext)
-	if err != nil {
-		return nil, fmt.Errorf("error encrypting message: %v", err)
+	if n >= RejectAfterMessages {
+		return nil, ErrNonceExhausted
 	}
-	ns.nonce.Add(1)
-	return data, nil
+	return ns.tx.encrypt(encrypted, n, plaintext), nil
+}
+
+// transportCipher uses the underlying AEAD directly when the noise cipher exposes it,
+// since the noise package builds each nonce on the heap
+type transportCipher struct {
+	c    noise.Cipher
+	aead cipher.AEAD
+}
+
+func newTransportCipher(c noise.Cipher) transportCipher {
+	aead, _ := c.(cipher.AEAD)
+	return transportCipher{c: c, aead: aead}
+}
+
+// Nonces escape through the AEAD interface, so they are pooled to keep the data path allocation free
+var noncePool = sync.Pool{New: func() any { return new([12]byte) }}
+
+// ChaChaPoly nonce encoding from the noise spec, 32 zero bits followed by little-endian n
+func getNonce(n uint64) *[12]byte {
+	nonce := noncePool.Get().(*[12]byte)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce
 }
 
-func (ns *NoiseState) Nonce() uint64 {
-	return ns.nonce.Load()
+func (tc transportCipher) encrypt(out []byte, n uint64, plaintext []byte) []byte {
+	if tc.aead == nil {
+		return tc.c.Encrypt(out, n, nil, plaintext)
+	}
+	nonce := getNonce(n)
+	out = tc.aead.Seal(out, nonce[:], plaintext, nil)
+	noncePool.Put(nonce)
+	return out
+}
+
+func (tc transportCipher) decrypt(out []byte, n uint64, ciphertext []byte) ([]byte, error) {
+	if tc.aead == nil {
+		return tc.c.Decrypt(out, n, nil, ciphertext)
+	}
+	nonce := getNonce(n)
+	out, err := tc.aead.Open(out, nonce[:], ciphertext, nil)
+	noncePool.Put(nonce)
+	return out, err
 }
@@ -41,37 +41,71 @@ type Conn struct {
 	ns           *NoiseState
 	state        atomic.Uint64
 	mu           sync.RWMutex
+	writeMu      sync.Mutex // Serializes encryption and writes from multiple routines
 	initiator    bool
 	keypair      noise.DHKey
 	remoteStatic []byte
 	cs           noise.CipherSuite
+
+	// Transport sessions, the previous session is kept for RekeyOverlap after a
+	// rekey so in-flight messages encrypted with the old keys still decrypt
+	keys struct {
+		l               sync.RWMutex
+		current         *session
+		previous        *session
+		previousExpires time.Time
+		// Outstanding rekey handshake started by this side
+		pending      *NoiseState
+		pendingEpoch uint32
+		pendingSent  time.Time
+	}
+	rekeyAfterTime     time.Duration
+	rekeyAfterMessages uint64
+	rekeyTimeout       time.Duration
 }
 
 func NewNoiseConn(keypair noise.DHKey, remoteStatic []byte) *Conn {
 	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
 
 	return &Conn{
-		conn:         nil,
-		state:        atomic.Uint64{},
-		mu:           sync.RWMutex{},
-		initiator:    false,
-		cs:           cs,
-		keypair:      keypair,
-		remoteStatic: remoteStatic,
+		conn:               nil,
+		state:              atomic.Uint64{},
+		mu:                 sync.RWMutex{},
+		initiator:          false,
+		cs:                 cs,
+		keypair:            keypair,
+		remoteStatic:       remoteStatic,
+		rekeyAfterTime:     RekeyAfterTime,
+		rekeyAfterMessages: RekeyAfterMessages,
+		rekeyTimeout:       RekeyTimeout,
 	}
 }
 
+// SetRekeyLimits overrides the time and message count after which the
+// initiating side rekeys the session
+func (nc *Conn) SetRekeyLimits(afterTime time.Duration, afterMessages uint64) {
+	nc.keys.l.Lock()
+	defer nc.keys.l.Unlock()
+	nc.rekeyAfterTime = afterTime
+	nc.rekeyAfterMessages = afterMessages
+}
+
 func (nc *Conn) Reset() {
 	nc.mu.Lock()
 	defer nc.mu.Unlock()
 
-	nc.ns.Reset()
-	nc.initiator = false
-	nc.state.Store(StateIdle)
+	nc.resetLocked()
 }
 
 func (nc *Conn) resetLocked() {
-	nc.ns.Reset()
+	if nc.ns != nil {
+		nc.ns.Reset()
+	}
+	nc.keys.l.Lock()
+	nc.keys.current = nil
+	nc.keys.previous = nil
+	nc.keys.pending = nil
+	nc.keys.l.Unlock()
 	nc.initiator = false
 	nc.state.Store(StateIdle)
 }
@@ -91,10 +125,10 @@ func (nc *Conn) Dial() error {
 			getStateAsString(state),
 		)
 	}
-  nc.state.Store(StateDialing)
+	nc.state.Store(StateDialing)
 
-  nc.mu.Lock()
-  defer nc.mu.Unlock()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 
 	err := nc.connect(true)
 	if err != nil {
@@ -116,8 +150,8 @@ func (nc *Conn) Accept() error {
 
 	nc.state.Store(StateAccepting)
 
-  nc.mu.Lock()
-  defer nc.mu.Unlock()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 
 	err := nc.connect(false)
 	if err != nil {
@@ -151,6 +185,12 @@ func (nc *Conn) connect(initiator bool) error {
 		return err
 	}
 
+	nc.keys.l.Lock()
+	nc.keys.current = newSession(nc.ns, 0)
+	nc.keys.previous = nil
+	nc.keys.pending = nil
+	nc.keys.l.Unlock()
+
 	log.Printf("noise connection established")
 	nc.state.Store(StateComplete)
 	return nil
@@ -296,79 +336,365 @@ RETRY:
 	return nil
 }
 
-// TODO: Handle receiving handshake packets during active session
-// TODO: Handle rekeys during active session
+// Read reads and decrypts the next data message into p
 func (nc *Conn) Read(p []byte) (int, error) {
-	if nc.ns == nil {
-		return 0, errors.New("noise state not initialized")
+	t, n, err := nc.ReadMessage(p)
+	if err != nil {
+		return n, err
 	}
-	if nc.conn == nil {
-		return 0, errors.New("noise underlying conn is nil")
+
+	if t != header.Data {
+		return 0, errors.New("packet is not a data packet")
 	}
-	if nc.ns.state.Load() != HandshakeComplete {
-		return 0, errors.New("noise state not ready: handshake is not complete")
+
+	return n, nil
+}
+
+// ReadMessage reads and decrypts the next transport message into p, returning
+// the message type so callers can handle control messages like probes.
+// Rekey handshake messages are handled internally and never returned
+func (nc *Conn) ReadMessage(p []byte) (uint8, int, error) {
+	buf := make([]byte, 1400)
+	o, err := nc.ReadPacket(buf)
+	if err != nil {
+		return o.Type(), 0, err
 	}
 
-	nc.mu.RLock()
-	defer nc.mu.RUnlock()
+	plaintext, err := o.Open(p[:0])
+	if err != nil {
+		return o.Type(), 0, err
+	}
 
-	h := header.NewHeader()
-	data := make([]byte, 1400)
-	n, err := nc.conn.Read(data)
+	return o.Type(), len(plaintext), nil
+}
+
+// Write encrypts and writes p as a data message
+func (nc *Conn) Write(p []byte) (int, error) {
+	return nc.WriteMessage(header.Data, p)
+}
+
+// WriteMessage encrypts and writes p as a transport message of type t
+func (nc *Conn) WriteMessage(t uint8, p []byte) (int, error) {
+	s, err := nc.NewSealer(t)
 	if err != nil {
-		return n, err
+		return 0, err
 	}
 
-	err = h.Parse(data)
+	packet, err := s.Seal(make([]byte, 0, header.HeaderLen+len(p)+16), p)
 	if err != nil {
-		return n, err
+		return 0, err
 	}
 
-	if h.Type != header.Data {
-		return n, errors.New("packet is not a data packet")
+	if err = nc.WritePacket(packet); err != nil {
+		return 0, err
 	}
 
-	p, err = nc.ns.Decrypt(data[header.HeaderLen:n], p[:0], h.Counter)
+	return len(p), nil
+}
+
+// Sealer encrypts a single outbound message with a nonce reserved by NewSealer.
+// Sealing can happen on any goroutine, which lets callers encrypt in parallel
+// as long as the sealed packets are written in the order the sealers were created
+type Sealer struct {
+	s     *session
+	t     uint8
+	nonce uint64
+}
+
+// NewSealer reserves the next nonce of the current session for a message of type t
+func (nc *Conn) NewSealer(t uint8) (Sealer, error) {
+	if nc.state.Load() != StateComplete {
+		return Sealer{}, errors.New("noise state not ready: handshake is not complete")
+	}
+
+	nc.keys.l.RLock()
+	s := nc.keys.current
+	nc.keys.l.RUnlock()
+	if s == nil {
+		return Sealer{}, errors.New("noise session not established")
+	}
+
+	nonce, err := s.nextNonce()
 	if err != nil {
-		return n, err
+		return Sealer{}, err
 	}
 
-	return n, nil
+	return Sealer{s: s, t: t, nonce: nonce}, nil
 }
 
-func (nc *Conn) Write(p []byte) (int, error) {
-	if nc.ns == nil {
-		return 0, errors.New("noise state not initialized")
+// Seal encodes the header and encrypts plaintext into out, which must have
+// capacity for the header, plaintext and authentication tag to avoid allocating
+func (sl Sealer) Seal(out, plaintext []byte) ([]byte, error) {
+	var h header.Header
+	packet, err := h.Encode(out, sl.t, sl.s.epoch, sl.nonce)
+	if err != nil {
+		return nil, err
 	}
+
+	return sl.s.encrypt(plaintext, packet, sl.nonce)
+}
+
+// WritePacket writes a sealed packet to the underlying conn
+func (nc *Conn) WritePacket(packet []byte) error {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+
 	if nc.conn == nil {
-		return 0, errors.New("noise underlying conn is nil")
+		return errors.New("noise underlying conn is nil")
 	}
-	if nc.ns.state.Load() != HandshakeComplete {
-		return 0, errors.New("noise state not ready: handshake is not complete")
+
+	if err := nc.writeRaw(packet); err != nil {
+		return err
+	}
+
+	nc.maybeRekey()
+	return nil
+}
+
+// Opener decrypts a single inbound message read by ReadPacket. Opening can
+// happen on any goroutine, the replay filter tolerates messages being opened
+// out of order
+type Opener struct {
+	s          *session
+	t          uint8
+	nonce      uint64
+	ciphertext []byte
+}
+
+// Type returns the message type from the packet header
+func (o Opener) Type() uint8 {
+	return o.t
+}
+
+// Open authenticates and decrypts the message into out
+func (o Opener) Open(out []byte) ([]byte, error) {
+	if o.s == nil {
+		return nil, errors.New("no session for message")
+	}
+	return o.s.decrypt(o.ciphertext, out, o.nonce)
+}
+
+// ReadPacket reads the next transport packet into buf and returns an Opener for
+// it. buf must stay untouched until the message is opened. Rekey handshake
+// messages are handled internally and never returned
+// TODO: Handle receiving handshake packets during active session
+func (nc *Conn) ReadPacket(buf []byte) (Opener, error) {
+	if nc.state.Load() != StateComplete {
+		return Opener{}, errors.New("noise state not ready: handshake is not complete")
 	}
 
 	nc.mu.RLock()
 	defer nc.mu.RUnlock()
 
-	h := header.NewHeader()
-	data := make([]byte, 1400)
+	if nc.conn == nil {
+		return Opener{}, errors.New("noise underlying conn is nil")
+	}
 
-	packet, err := h.Encode(data, header.Data, 100, nc.ns.Nonce())
-	if err != nil {
-		return 0, err
+	var h header.Header
+	for {
+		n, err := nc.conn.Read(buf)
+		if err != nil {
+			return Opener{}, err
+		}
+
+		err = h.Parse(buf[:n])
+		if err != nil {
+			return Opener{}, err
+		}
+
+		switch h.Type {
+		case header.Rekey:
+			if err = nc.handleRekey(&h, buf[header.HeaderLen:n]); err != nil {
+				log.Printf("error handling rekey message: %s", err)
+			}
+			continue
+		case header.Data, header.Probe, header.ProbeReply:
+		default:
+			return Opener{t: h.Type}, fmt.Errorf("unexpected message type for transport: %d", h.Type)
+		}
+
+		s := nc.sessionForEpoch(h.SenderIndex)
+		if s == nil {
+			return Opener{t: h.Type}, fmt.Errorf("no session for key epoch %d", h.SenderIndex)
+		}
+
+		nc.maybeRekey()
+		return Opener{
+			s:          s,
+			t:          h.Type,
+			nonce:      h.Counter,
+			ciphertext: buf[header.HeaderLen:n],
+		}, nil
 	}
+}
 
-	packet, err = nc.ns.Encrypt(p, packet, 0)
-	if err != nil {
-		return 0, err
+// sessionForEpoch returns the session matching the key epoch from a packet header.
+// The previous session is only returned until its overlap period expires
+func (nc *Conn) sessionForEpoch(epoch uint32) *session {
+	nc.keys.l.RLock()
+	defer nc.keys.l.RUnlock()
+
+	if s := nc.keys.current; s != nil && s.epoch == epoch {
+		return s
 	}
+	if s := nc.keys.previous; s != nil && s.epoch == epoch && time.Now().Before(nc.keys.previousExpires) {
+		return s
+	}
+	return nil
+}
+
+// rotateLocked installs s as the current session, keeping the old current
+// session around to decrypt in-flight messages
+func (nc *Conn) rotateLocked(s *session) {
+	nc.keys.previous = nc.keys.current
+	nc.keys.previousExpires = time.Now().Add(RekeyOverlap)
+	nc.keys.current = s
+}
+
+// maybeRekey starts a rekey handshake if the current session has reached its
+// time or message limit. Only the side that initiated the connection rekeys, so
+// both sides never start a rekey at the same time. The request is sent again if
+// no response is received within RekeyTimeout. nc.mu must be held
+func (nc *Conn) maybeRekey() {
+	if !nc.initiator {
+		return
+	}
+
+	packet, err := func() ([]byte, error) {
+		nc.keys.l.Lock()
+		defer nc.keys.l.Unlock()
+
+		current := nc.keys.current
+		if current == nil || !current.needsRekey(nc.rekeyAfterTime, nc.rekeyAfterMessages) {
+			return nil, nil
+		}
+		if nc.keys.pending != nil && time.Since(nc.keys.pendingSent) < nc.rekeyTimeout {
+			return nil, nil
+		}
+
+		ns := NewNoiseState(nc.keypair, nc.remoteStatic)
+		if err := ns.Initialize(true); err != nil {
+			return nil, err
+		}
 
-	n, err := nc.conn.Write(packet)
+		epoch := current.epoch + 1
+		h := header.NewHeader()
+		packet, err := h.Encode(make([]byte, header.HeaderLen, 1400), header.Rekey, epoch, 0)
+		if err != nil {
+			return nil, err
+		}
+		packet, err = ns.GenerateHandshakeP1(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		nc.keys.pending = ns
+		nc.keys.pendingEpoch = epoch
+		nc.keys.pendingSent = time.Now()
+		return packet, nil
+	}()
 	if err != nil {
-		return n, err
+		log.Printf("error creating rekey request: %s", err)
+		return
+	}
+	if packet == nil {
+		return
 	}
 
-	return n, nil
+	if err = nc.writeRaw(packet); err != nil {
+		log.Printf("error sending rekey request: %s", err)
+	}
+}
+
+// handleRekey processes rekey handshake messages. A counter of 0 is a request
+// from the initiating side, a counter of 1 is the response to our request.
+// nc.mu must be held
+func (nc *Conn) handleRekey(h *header.Header, payload []byte) error {
+	epoch := h.SenderIndex
+
+	switch h.Counter {
+	case 0:
+		if nc.initiator {
+			return errors.New("unexpected rekey request from responder")
+		}
+
+		nc.keys.l.RLock()
+		current := nc.keys.current
+		nc.keys.l.RUnlock()
+		if current == nil {
+			return errors.New("no current session to rekey")
+		}
+
+		// A retried request for the session we just created means our response
+		// was lost, replace it as long as the initiator hasn't started using it
+		replace := false
+		switch {
+		case epoch == current.epoch+1:
+		case epoch == current.epoch && epoch != 0 && !current.received.Load():
+			replace = true
+		default:
+			return fmt.Errorf("unexpected rekey epoch %d, current epoch %d", epoch, current.epoch)
+		}
+
+		ns := NewNoiseState(nc.keypair, nc.remoteStatic)
+		if err := ns.Initialize(false); err != nil {
+			return err
+		}
+		if err := ns.ConsumeHandshakeP1(payload); err != nil {
+			return err
+		}
+
+		rh := header.NewHeader()
+		packet, err := rh.Encode(make([]byte, header.HeaderLen, 1400), header.Rekey, epoch, 1)
+		if err != nil {
+			return err
+		}
+		packet, err = ns.GenerateHandshakeP2(packet)
+		if err != nil {
+			return err
+		}
+
+		// Send the response before switching keys, so nothing encrypted with the
+		// new keys can reach the initiator ahead of it
+		if err = nc.writeRaw(packet); err != nil {
+			return err
+		}
+
+		nc.keys.l.Lock()
+		if replace {
+			nc.keys.current = newSession(ns, epoch)
+		} else {
+			nc.rotateLocked(newSession(ns, epoch))
+		}
+		nc.keys.l.Unlock()
+		return nil
+	case 1:
+		nc.keys.l.Lock()
+		defer nc.keys.l.Unlock()
+
+		ns := nc.keys.pending
+		if ns == nil || epoch != nc.keys.pendingEpoch {
+			return fmt.Errorf("unexpected rekey response for epoch %d", epoch)
+		}
+		if err := ns.ConsumeHandshakeP2(payload); err != nil {
+			return err
+		}
+
+		nc.keys.pending = nil
+		nc.rotateLocked(newSession(ns, epoch))
+		return nil
+	default:
+		return fmt.Errorf("invalid rekey message counter %d", h.Counter)
+	}
+}
+
+// writeRaw writes an already encoded packet to the underlying conn. nc.mu must be held
+func (nc *Conn) writeRaw(packet []byte) error {
+	nc.writeMu.Lock()
+	defer nc.writeMu.Unlock()
+
+	_, err := nc.conn.Write(packet)
+	return err
 }
 
 // Close closes the noise connection, resetting the state, and
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/caldog20/zeronet/pkg/header"
 	"github.com/flynn/noise"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sync/errgroup"
@@ -16,7 +17,7 @@ import (
 
 var (
 	kp1, kp2     noise.DHKey
-	nc1, nc2     *NoiseConn
+	nc1, nc2     *Conn
 	conn1, conn2 net.Conn
 )
 
@@ -91,6 +92,30 @@ func TestNoiseConnReadWrite(t *testing.T) {
 	wg.Wait()
 }
 
+func TestNoiseConnMessageTypes(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := nc1.WriteMessage(header.Probe, []byte("probe"))
+		assert.NoError(t, err)
+		_, err = nc1.Write([]byte("data"))
+		assert.NoError(t, err)
+	}()
+
+	p := make([]byte, 1400)
+	typ, n, err := nc2.ReadMessage(p)
+	assert.NoError(t, err)
+	assert.Equal(t, header.Probe, typ)
+	assert.Equal(t, "probe", string(p[:n]))
+
+	typ, n, err = nc2.ReadMessage(p)
+	assert.NoError(t, err)
+	assert.Equal(t, header.Data, typ)
+	assert.Equal(t, "data", string(p[:n]))
+
+	<-done
+}
+
 func TestNoiseConnDialAcceptError(t *testing.T) {
 	uc, _ := net.Pipe()
 	conn := NewNoiseConn(kp1, kp2.Public)
@@ -116,3 +141,47 @@ func TestNoiseConnDialAcceptError(t *testing.T) {
 		"unexpected state returned in error when calling dial after accept",
 	)
 }
+
+func TestNoiseConnConcurrentSealers(t *testing.T) {
+	const (
+		goroutines = 8
+		perRoutine = 1000
+	)
+
+	initiator, _, c1, c2 := newConnectedPair(t, 0)
+	defer c1.Close()
+	defer c2.Close()
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool, goroutines*perRoutine)
+
+	var eg errgroup.Group
+	for i := 0; i < goroutines; i++ {
+		eg.Go(func() error {
+			nonces := make([]uint64, 0, perRoutine)
+			out := make([]byte, 0, 64)
+			for j := 0; j < perRoutine; j++ {
+				sl, err := initiator.NewSealer(header.Data)
+				if err != nil {
+					return err
+				}
+				if _, err = sl.Seal(out, []byte("hello")); err != nil {
+					return err
+				}
+				nonces = append(nonces, sl.nonce)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, n := range nonces {
+				if seen[n] {
+					t.Errorf("nonce %d was reserved twice", n)
+				}
+				seen[n] = true
+			}
+			return nil
+		})
+	}
+	assert.NoError(t, eg.Wait())
+	assert.Len(t, seen, goroutines*perRoutine)
+}
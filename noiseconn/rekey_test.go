@@ -0,0 +1,236 @@
+package noiseconn
+
+import (
+	"crypto/rand"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+// lossyConn is an in-memory datagram conn that drops a share of written
+// packets once loss is enabled, and never blocks writers like UDP
+type lossyConn struct {
+	in       chan []byte
+	out      chan []byte
+	lossRate float64
+	lossy    atomic.Bool
+	dropped  atomic.Uint64
+
+	rngMu sync.Mutex
+	rng   *mrand.Rand
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+}
+
+func newLossyConnPair(lossRate float64) (*lossyConn, *lossyConn) {
+	ab := make(chan []byte, 4096)
+	ba := make(chan []byte, 4096)
+	a := &lossyConn{in: ba, out: ab, lossRate: lossRate, rng: mrand.New(mrand.NewSource(1)), closed: make(chan struct{})}
+	b := &lossyConn{in: ab, out: ba, lossRate: lossRate, rng: mrand.New(mrand.NewSource(2)), closed: make(chan struct{})}
+	return a, b
+}
+
+func (c *lossyConn) Read(p []byte) (int, error) {
+	c.deadlineMu.Lock()
+	deadline := c.readDeadline
+	c.deadlineMu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case b := <-c.in:
+		return copy(p, b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	if c.lossy.Load() {
+		c.rngMu.Lock()
+		drop := c.rng.Float64() < c.lossRate
+		c.rngMu.Unlock()
+		if drop {
+			c.dropped.Add(1)
+			return len(p), nil
+		}
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case c.out <- b:
+	default:
+		c.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+func (c *lossyConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *lossyConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *lossyConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+func (c *lossyConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *lossyConn) LocalAddr() net.Addr                { return nil }
+func (c *lossyConn) RemoteAddr() net.Addr               { return nil }
+
+func newConnectedPair(t *testing.T, lossRate float64) (*Conn, *Conn, *lossyConn, *lossyConn) {
+	t.Helper()
+
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	k1, err := cs.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+	k2, err := cs.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+
+	c1, c2 := newLossyConnPair(lossRate)
+	initiator := NewNoiseConn(k1, k2.Public)
+	responder := NewNoiseConn(k2, k1.Public)
+	initiator.SetConn(c1)
+	responder.SetConn(c2)
+
+	var eg errgroup.Group
+	eg.Go(responder.Accept)
+	eg.Go(initiator.Dial)
+	require.NoError(t, eg.Wait())
+
+	return initiator, responder, c1, c2
+}
+
+func currentEpoch(nc *Conn) uint32 {
+	nc.keys.l.RLock()
+	defer nc.keys.l.RUnlock()
+	return nc.keys.current.epoch
+}
+
+func TestNoiseConnRekeyMessageLimit(t *testing.T) {
+	initiator, responder, c1, c2 := newConnectedPair(t, 0)
+	initiator.SetRekeyLimits(time.Hour, 10)
+
+	go func() {
+		p := make([]byte, 1400)
+		for {
+			if _, err := responder.Read(p); errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		_, err := initiator.Write([]byte("hello"))
+		require.NoError(t, err)
+		// Rekey responses are processed by the initiator's read loop
+		if i%10 == 9 {
+			go initiator.Read(make([]byte, 1400))
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+
+	assert.Greater(t, currentEpoch(initiator), uint32(0), "initiator never rekeyed")
+	assert.Equal(t, currentEpoch(initiator), currentEpoch(responder))
+
+	c1.Close()
+	c2.Close()
+}
+
+func TestNoiseConnRekeyLossy(t *testing.T) {
+	const messages = 2000
+
+	initiator, responder, c1, c2 := newConnectedPair(t, 0.1)
+	initiator.SetRekeyLimits(time.Hour, 50)
+	initiator.rekeyTimeout = time.Millisecond * 20
+	c1.lossy.Store(true)
+	c2.lossy.Store(true)
+
+	var received [2]atomic.Uint64
+	var decryptErrors atomic.Uint64
+
+	read := func(nc *Conn, i int) {
+		p := make([]byte, 1400)
+		for {
+			n, err := nc.Read(p)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// Losing a rekey response leaves the responder briefly ahead of the
+				// initiator, anything else means keys got out of sync
+				if !strings.HasPrefix(err.Error(), "no session for key epoch") {
+					decryptErrors.Add(1)
+				}
+				continue
+			}
+			if string(p[:n]) == "ping" {
+				received[i].Add(1)
+			}
+		}
+	}
+	go read(initiator, 0)
+	go read(responder, 1)
+
+	var wg sync.WaitGroup
+	write := func(nc *Conn) {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			_, err := nc.Write([]byte("ping"))
+			assert.NoError(t, err)
+			time.Sleep(time.Microsecond * 100)
+		}
+	}
+	wg.Add(2)
+	go write(initiator)
+	go write(responder)
+	wg.Wait()
+
+	// Let in-flight packets drain
+	time.Sleep(time.Millisecond * 100)
+	c1.Close()
+	c2.Close()
+
+	assert.Greater(t, currentEpoch(initiator), uint32(5), "expected multiple rekeys")
+	assert.Zero(t, decryptErrors.Load(), "messages failed to decrypt")
+	assert.Greater(t, c1.dropped.Load()+c2.dropped.Load(), uint64(0), "no packets were dropped")
+	// Roughly 10% loss plus messages sent while the responder is ahead
+	assert.Greater(t, received[0].Load(), uint64(messages/2))
+	assert.Greater(t, received[1].Load(), uint64(messages/2))
+}
@@ -0,0 +1,60 @@
+package noiseconn
+
+import "errors"
+
+// Sliding window replay protection based on WireGuard's, see RFC 6479.
+// The window is a ring of 64 bit blocks, one block is always kept clear so the
+// window can advance a block at a time without losing track of recent counters
+const (
+	replayBlockBitLog = 6
+	replayBlockBits   = 1 << replayBlockBitLog
+	replayRingBlocks  = 1 << 7
+	replayWindowSize  = (replayRingBlocks - 1) * replayBlockBits
+	replayBlockMask   = replayRingBlocks - 1
+	replayBitMask     = replayBlockBits - 1
+)
+
+var ErrReplayedMessage = errors.New("message counter replayed or too old")
+
+type replayFilter struct {
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+func (f *replayFilter) reset() {
+	f.last = 0
+	f.ring = [replayRingBlocks]uint64{}
+}
+
+// validateCounter reports whether counter has not been seen before and is
+// inside the window, marking it as seen. Counters at or above limit are rejected.
+// It must only be called for messages that have been authenticated
+func (f *replayFilter) validateCounter(counter, limit uint64) bool {
+	if counter >= limit {
+		return false
+	}
+
+	indexBlock := counter >> replayBlockBitLog
+	if counter > f.last {
+		// Move the window forward, clearing the blocks it moved over
+		current := f.last >> replayBlockBitLog
+		diff := indexBlock - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i&replayBlockMask] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > replayWindowSize {
+		// Too far behind the window
+		return false
+	}
+
+	indexBlock &= replayBlockMask
+	indexBit := counter & replayBitMask
+	old := f.ring[indexBlock]
+	updated := old | 1<<indexBit
+	f.ring[indexBlock] = updated
+	return old != updated
+}
@@ -0,0 +1,111 @@
+package noiseconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Cases adapted from the WireGuard kernel replay tests
+func TestReplayFilter(t *testing.T) {
+	var f replayFilter
+	const limit = RejectAfterMessages
+	const tLim = replayWindowSize + 1
+
+	tests := []struct {
+		counter uint64
+		valid   bool
+	}{
+		{0, true},
+		{1, true},
+		{1, false},
+		{9, true},
+		{8, true},
+		{7, true},
+		{7, false},
+		{tLim, true},
+		{tLim - 1, true},
+		{tLim - 1, false},
+		{tLim - 2, true},
+		{2, true},
+		{2, false},
+		{tLim + 16, true},
+		{3, false},
+		{tLim + 16, false},
+		{tLim * 4, true},
+		{tLim*4 - (tLim - 1), true},
+		{10, false},
+		{tLim*4 - tLim, false},
+		{tLim*4 - (tLim + 1), false},
+		{tLim*4 - (tLim - 2), true},
+		{tLim*4 + 1 - tLim, false},
+		{0, false},
+		{limit, false},
+		{limit - 1, true},
+		{limit, false},
+		{limit - 2, true},
+		{limit + 1, false},
+		{limit + 2, false},
+		{limit - 2, false},
+		{limit - 3, true},
+		{0, false},
+	}
+
+	for i, tt := range tests {
+		assert.Equal(t, tt.valid, f.validateCounter(tt.counter, limit), "case %d: counter %d", i, tt.counter)
+	}
+
+	f.reset()
+	for i := uint64(1); i <= replayWindowSize; i++ {
+		assert.True(t, f.validateCounter(i, limit), "counter %d", i)
+	}
+	assert.True(t, f.validateCounter(0, limit))
+	assert.False(t, f.validateCounter(0, limit))
+
+	f.reset()
+	for i := uint64(replayWindowSize + 1); i > 0; i-- {
+		assert.True(t, f.validateCounter(i, limit), "counter %d", i)
+	}
+	assert.False(t, f.validateCounter(0, limit))
+}
+
+func TestNoiseConnReorderAndReplay(t *testing.T) {
+	initiator, responder, c1, c2 := newConnectedPair(t, 0)
+	defer c1.Close()
+	defer c2.Close()
+
+	for _, msg := range []string{"zero", "one", "two"} {
+		_, err := initiator.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+
+	// Pull the packets off the wire and deliver them reordered, with a replay
+	var packets [][]byte
+	for range 3 {
+		select {
+		case p := <-c2.in:
+			packets = append(packets, p)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for packets")
+		}
+	}
+	for _, i := range []int{2, 0, 0, 1} {
+		c2.in <- packets[i]
+	}
+
+	p := make([]byte, 1400)
+	for _, want := range []string{"two", "zero"} {
+		n, err := responder.Read(p)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(p[:n]))
+	}
+
+	_, err := responder.Read(p)
+	assert.ErrorIs(t, err, ErrReplayedMessage)
+
+	n, err := responder.Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(p[:n]))
+}
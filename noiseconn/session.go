@@ -0,0 +1,96 @@
+package noiseconn
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The side that initiated the connection starts a new handshake once the
+	// current session reaches either limit
+	RekeyAfterTime     = time.Minute * 2
+	RekeyAfterMessages = uint64(1) << 60
+	// Hard limit where a session refuses to encrypt any more messages
+	RejectAfterMessages = math.MaxUint64 - (1 << 13)
+	// Time to wait for a rekey response before sending a new rekey request
+	RekeyTimeout = time.Second * 5
+	// Time the previous session can still decrypt in-flight messages after a rekey
+	RekeyOverlap = time.Second * 10
+)
+
+// session holds the transport keys from a single completed handshake.
+// Sessions are identified on the wire by their epoch, carried in the
+// header SenderIndex, which is incremented for every rekey
+type session struct {
+	ns       *NoiseState
+	epoch    uint32
+	created  time.Time
+	txNonce  atomic.Uint64
+	rxMax    atomic.Uint64
+	received atomic.Bool
+
+	replayMu sync.Mutex
+	replay   replayFilter
+}
+
+func newSession(ns *NoiseState, epoch uint32) *session {
+	return &session{
+		ns:      ns,
+		epoch:   epoch,
+		created: time.Now(),
+	}
+}
+
+func (s *session) encrypt(plaintext, out []byte, nonce uint64) ([]byte, error) {
+	return s.ns.Encrypt(plaintext, out, nonce)
+}
+
+// decrypt authenticates and decrypts a message using the nonce from its header.
+// Messages may arrive lost or reordered, the replay filter rejects any nonce
+// that was already received or has fallen behind the window
+func (s *session) decrypt(ciphertext, out []byte, nonce uint64) ([]byte, error) {
+	plaintext, err := s.ns.Decrypt(ciphertext, out, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	s.replayMu.Lock()
+	valid := s.replay.validateCounter(nonce, RejectAfterMessages)
+	s.replayMu.Unlock()
+	if !valid {
+		return nil, ErrReplayedMessage
+	}
+
+	s.received.Store(true)
+	for {
+		current := s.rxMax.Load()
+		if nonce <= current || s.rxMax.CompareAndSwap(current, nonce) {
+			break
+		}
+	}
+
+	return plaintext, nil
+}
+
+// nextNonce reserves the next transmit nonce. Sealers are created from several
+// goroutines at once, so the nonce is reserved atomically and never passes the
+// reject limit
+func (s *session) nextNonce() (uint64, error) {
+	for {
+		n := s.txNonce.Load()
+		if n >= RejectAfterMessages {
+			return 0, ErrNonceExhausted
+		}
+		if s.txNonce.CompareAndSwap(n, n+1) {
+			return n, nil
+		}
+	}
+}
+
+func (s *session) needsRekey(afterTime time.Duration, afterMessages uint64) bool {
+	return time.Since(s.created) >= afterTime ||
+		s.txNonce.Load() >= afterMessages ||
+		s.rxMax.Load() >= afterMessages
+}
@@ -14,14 +14,16 @@ const (
 
 // Message Types
 const (
-	None      uint8 = 0
-	Handshake uint8 = 1
-	Data      uint8 = 2
-	Reset     uint8 = 3 // Redundant?
-	Rekey     uint8 = 4
-	Close     uint8 = 5
-	Discovery uint8 = 6
-	Punch     uint8 = 0xff
+	None       uint8 = 0
+	Handshake  uint8 = 1
+	Data       uint8 = 2
+	Reset      uint8 = 3 // Redundant?
+	Rekey      uint8 = 4
+	Close      uint8 = 5
+	Discovery  uint8 = 6
+	Probe      uint8 = 7 // In-band ping, answered by the remote node without touching its tunnel
+	ProbeReply uint8 = 8
+	Punch      uint8 = 0xff
 )
 
 type Header struct {
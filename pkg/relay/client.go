@@ -0,0 +1,385 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	dialTimeout    = time.Second * 10
+	minRetryDelay  = time.Second
+	maxRetryDelay  = time.Minute
+	peerQueueSize  = 256
+	receiveBufSize = 0xffff
+)
+
+var ErrNotConnected = errors.New("relay is not connected")
+
+// Client keeps a connection to a relay server, reconnecting when it drops,
+// and demultiplexes received packets to a Conn per peer
+type Client struct {
+	url       string
+	machineID string
+
+	mu    sync.Mutex
+	conn  net.Conn
+	id    uint32
+	peers map[uint32]*Conn
+
+	writeMu   sync.Mutex
+	connected atomic.Bool
+}
+
+func NewClient(url, machineID string) *Client {
+	return &Client{
+		url:       url,
+		machineID: machineID,
+		peers:     make(map[uint32]*Conn),
+	}
+}
+
+// Connected reports whether the client currently has a relay connection
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+// Run connects to the relay and keeps reconnecting with backoff until ctx is done
+func (c *Client) Run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		conn, err := c.connect(ctx)
+		if err == nil {
+			delay = minRetryDelay
+			log.Printf("connected to relay %s", c.url)
+			err = c.receive(ctx, conn)
+			c.disconnect(conn)
+		}
+		if ctx.Err() != nil {
+			c.closePeers()
+			return
+		}
+		log.Printf("relay connection error: %s", err)
+
+		// Jitter so nodes don't reconnect in lockstep after a relay restart
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			c.closePeers()
+			return
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// connect dials the relay and completes the hello exchange
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := dial(dialCtx, c.url)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := appendFrame(nil, frameHello, []byte(c.machineID))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err = conn.Write(hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, receiveBufSize)
+	t, payload, err := readFrame(conn, buf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch {
+	case t == frameError:
+		conn.Close()
+		return nil, fmt.Errorf("relay rejected connection: %s", payload)
+	case t != frameWelcome || len(payload) != peerIDLen:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected relay frame type %d", t)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.conn = conn
+	c.id = binary.BigEndian.Uint32(payload)
+	c.mu.Unlock()
+	c.connected.Store(true)
+	return conn, nil
+}
+
+// dial opens the underlying stream, tcp://host:port or a ws:// or wss:// URL
+func dial(ctx context.Context, rawURL string) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", u.Host)
+	case "ws", "wss":
+		ws, _, err := websocket.Dial(ctx, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		ws.SetReadLimit(receiveBufSize + frameHeaderLen)
+		// The conn outlives the dial context
+		return websocket.NetConn(context.Background(), ws, websocket.MessageBinary), nil
+	default:
+		return nil, fmt.Errorf("unsupported relay url scheme: %s", u.Scheme)
+	}
+}
+
+func (c *Client) disconnect(conn net.Conn) {
+	c.connected.Store(false)
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
+
+// receive reads frames until the connection fails, sending keepalives in the background
+func (c *Client) receive(ctx context.Context, conn net.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(KeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				frame, _ := appendFrame(nil, frameKeepalive)
+				c.write(frame)
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, receiveBufSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+		t, payload, err := readFrame(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		switch t {
+		case frameData:
+			src, packet, err := parseData(payload)
+			if err != nil {
+				return err
+			}
+			c.deliver(src, packet)
+		case frameKeepalive:
+		case frameError:
+			return fmt.Errorf("relay error: %s", payload)
+		default:
+			return fmt.Errorf("unexpected relay frame type %d", t)
+		}
+	}
+}
+
+// deliver queues packet on the conn for src, dropping it if there is none
+func (c *Client) deliver(src uint32, packet []byte) {
+	c.mu.Lock()
+	pc := c.peers[src]
+	c.mu.Unlock()
+	if pc == nil {
+		return
+	}
+
+	select {
+	case pc.queue <- append([]byte(nil), packet...):
+	default:
+	}
+}
+
+func (c *Client) write(frame []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write(frame)
+	return err
+}
+
+// Conn returns a packet conn to peer through the relay. Any previous conn for
+// the peer is closed
+func (c *Client) Conn(peer uint32) *Conn {
+	pc := &Conn{
+		client: c,
+		peer:   peer,
+		queue:  make(chan []byte, peerQueueSize),
+		closed: make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	old := c.peers[peer]
+	c.peers[peer] = pc
+	c.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return pc
+}
+
+func (c *Client) removePeer(pc *Conn) {
+	c.mu.Lock()
+	if c.peers[pc.peer] == pc {
+		delete(c.peers, pc.peer)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) closePeers() {
+	c.mu.Lock()
+	peers := make([]*Conn, 0, len(c.peers))
+	for _, pc := range c.peers {
+		peers = append(peers, pc)
+	}
+	c.mu.Unlock()
+
+	for _, pc := range peers {
+		pc.Close()
+	}
+}
+
+// Addr identifies a peer reached through the relay
+type Addr struct {
+	Peer uint32
+}
+
+func (a Addr) Network() string { return "relay" }
+func (a Addr) String() string  { return fmt.Sprintf("relay:%d", a.Peer) }
+
+// Conn is a packet oriented net.Conn to a single peer through the relay.
+// Each Write sends one packet and each Read returns one packet
+type Conn struct {
+	client *Client
+	peer   uint32
+	queue  chan []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+}
+
+func (pc *Conn) Read(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	if d := pc.readDeadline.Load(); d != 0 {
+		wait := time.Until(time.Unix(0, d))
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case packet := <-pc.queue:
+		return copy(b, packet), nil
+	case <-pc.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (pc *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-pc.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if d := pc.writeDeadline.Load(); d != 0 && time.Now().After(time.Unix(0, d)) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	frame, err := dataFrame(pc.peer, b)
+	if err != nil {
+		return 0, err
+	}
+	if err = pc.client.write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *Conn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		pc.client.removePeer(pc)
+	})
+	return nil
+}
+
+func (pc *Conn) LocalAddr() net.Addr {
+	pc.client.mu.Lock()
+	defer pc.client.mu.Unlock()
+	return Addr{Peer: pc.client.id}
+}
+
+func (pc *Conn) RemoteAddr() net.Addr {
+	return Addr{Peer: pc.peer}
+}
+
+func (pc *Conn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+
+func (pc *Conn) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.Store(deadlineNanos(t))
+	return nil
+}
+
+func (pc *Conn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.Store(deadlineNanos(t))
+	return nil
+}
+
+func deadlineNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,87 @@
+// Package relay forwards packets between nodes that can't establish a direct
+// path. Nodes keep a single TCP or WebSocket connection to the relay and the
+// existing header packets are framed and addressed by peer ID over it
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame types
+const (
+	// Client hello carrying the node machine ID
+	frameHello uint8 = 1
+	// Server reply to a successful hello carrying the node's peer ID
+	frameWelcome uint8 = 2
+	// Packet for a peer. From the client it is addressed to the destination
+	// peer, from the server it carries the source peer
+	frameData      uint8 = 3
+	frameKeepalive uint8 = 4
+	// Server error before closing the connection
+	frameError uint8 = 5
+)
+
+const (
+	frameHeaderLen = 3
+	peerIDLen      = 4
+	// Largest payload that fits the 16 bit frame length
+	MaxPacketSize = 0xffff - peerIDLen
+)
+
+var errFrameTooLarge = errors.New("relay frame too large")
+
+// appendFrame appends a frame of type t with payload made of the parts to b
+func appendFrame(b []byte, t uint8, parts ...[]byte) ([]byte, error) {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	if n > 0xffff {
+		return b, errFrameTooLarge
+	}
+
+	b = append(b, t, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b, nil
+}
+
+// dataFrame encodes a data frame for peer
+func dataFrame(peer uint32, packet []byte) ([]byte, error) {
+	if len(packet) > MaxPacketSize {
+		return nil, errFrameTooLarge
+	}
+	var id [peerIDLen]byte
+	binary.BigEndian.PutUint32(id[:], peer)
+	return appendFrame(make([]byte, 0, frameHeaderLen+peerIDLen+len(packet)), frameData, id[:], packet)
+}
+
+// readFrame reads the next frame into buf, which must be large enough for any frame payload
+func readFrame(r io.Reader, buf []byte) (uint8, []byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[1:]))
+	if n > len(buf) {
+		return 0, nil, errFrameTooLarge
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], buf[:n], nil
+}
+
+// parseData splits a data frame payload into the peer ID and packet
+func parseData(payload []byte) (uint32, []byte, error) {
+	if len(payload) < peerIDLen {
+		return 0, nil, fmt.Errorf("short relay data frame: %d bytes", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), payload[peerIDLen:], nil
+}
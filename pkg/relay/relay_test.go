@@ -0,0 +1,217 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuth(machineID string) (uint32, error) {
+	switch machineID {
+	case "node1":
+		return 1, nil
+	case "node2":
+		return 2, nil
+	default:
+		return 0, errors.New("unknown machine id")
+	}
+}
+
+// newTestServer creates a server that is closed after the test's clients,
+// as cleanups run in reverse order
+func newTestServer(t *testing.T, allow AllowFunc) *Server {
+	server := NewServer(testAuth, allow)
+	server.Logf = t.Logf
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func startClient(t *testing.T, url, machineID string) *Client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	c := NewClient(url, machineID)
+	go c.Run(ctx)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !c.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatalf("client %s did not connect to relay", machineID)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return c
+}
+
+func exchange(t *testing.T, url string) {
+	t.Helper()
+	c1 := startClient(t, url, "node1")
+	c2 := startClient(t, url, "node2")
+
+	conn1 := c1.Conn(2)
+	defer conn1.Close()
+	conn2 := c2.Conn(1)
+	defer conn2.Close()
+
+	for i := range 10 {
+		msg := []byte(strings.Repeat("x", i*100+1))
+		if _, err := conn1.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		conn2.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 2048)
+		n, err := conn2.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(msg) {
+			t.Fatalf("received %d bytes, expected %d", n, len(msg))
+		}
+	}
+
+	if _, err := conn2.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	conn1.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 64)
+	n, err := conn1.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "reply" {
+		t.Fatalf("unexpected reply %q", buf[:n])
+	}
+	if addr := conn1.RemoteAddr().String(); addr != "relay:2" {
+		t.Fatalf("unexpected remote address %s", addr)
+	}
+}
+
+func TestRelayTCP(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+
+	exchange(t, "tcp://"+l.Addr().String())
+}
+
+func TestRelayWebSocket(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	hs := httptest.NewServer(server)
+	t.Cleanup(hs.Close)
+
+	exchange(t, "ws"+strings.TrimPrefix(hs.URL, "http"))
+}
+
+func TestRelayRejectsUnknownClient(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+
+	c := NewClient("tcp://"+l.Addr().String(), "unknown")
+	_, err = c.connect(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unknown machine id") {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	c := NewClient("tcp://127.0.0.1:0", "node1")
+	conn := c.Conn(2)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected not connected error, got %v", err)
+	}
+}
+
+func TestRelayDeniedByPolicy(t *testing.T) {
+	server := newTestServer(t, func(src, dst uint32) bool {
+		return src == 2
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+
+	url := "tcp://" + l.Addr().String()
+	c1 := startClient(t, url, "node1")
+	c2 := startClient(t, url, "node2")
+	conn1 := c1.Conn(2)
+	defer conn1.Close()
+	conn2 := c2.Conn(1)
+	defer conn2.Close()
+
+	if _, err = conn1.Write([]byte("denied")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn2.Write([]byte("allowed")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn1.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err := conn1.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "allowed" {
+		t.Fatalf("unexpected packet %q", buf[:n])
+	}
+
+	conn2.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if n, err = conn2.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("packet denied by policy was forwarded: %q %v", buf[:n], err)
+	}
+}
+
+func TestRelayCloseWaitsForHandlers(t *testing.T) {
+	server := NewServer(testAuth, nil)
+	server.Logf = t.Logf
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+
+	startClient(t, "tcp://"+l.Addr().String(), "node1")
+	// Connected but never sends its hello
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(time.Millisecond * 50)
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(helloTimeout / 2):
+		t.Fatal("close did not return before the hello timeout")
+	}
+}
@@ -0,0 +1,349 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	// Clients send a keepalive at KeepaliveInterval, the server drops clients
+	// that have been silent for ReadTimeout
+	KeepaliveInterval = time.Second * 25
+	ReadTimeout       = time.Second * 90
+
+	helloTimeout = time.Second * 10
+	writeTimeout = time.Second * 10
+	// Frames queued per client before new frames are dropped
+	clientQueueSize = 256
+	// How long a client remembers whether it may send to a peer, so the
+	// policy isn't checked for every packet
+	allowCacheTTL = time.Second * 10
+)
+
+// AuthFunc authenticates a client by its machine ID and returns its peer ID
+type AuthFunc func(machineID string) (uint32, error)
+
+// AllowFunc reports whether peer src may send packets to peer dst
+type AllowFunc func(src, dst uint32) bool
+
+// Server forwards packets between authenticated clients
+type Server struct {
+	auth  AuthFunc
+	allow AllowFunc
+	// Logf logs client connections and errors, defaults to log.Printf
+	Logf func(format string, args ...any)
+
+	mu      sync.Mutex
+	clients map[uint32]*serverClient
+	closed  bool
+	lns     []net.Listener
+	// Open connections, including those still sending their hello
+	conns map[net.Conn]struct{}
+	// Connection handlers, Close waits for them to return
+	handlers sync.WaitGroup
+}
+
+type serverClient struct {
+	id    uint32
+	conn  net.Conn
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+
+	// Cached allow decisions for destination peers, only used by the
+	// client's read routine
+	allowed map[uint32]allowEntry
+}
+
+type allowEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+// NewServer creates a relay server. Packets are only forwarded between peers
+// allow permits, a nil allow forwards between any authenticated clients
+func NewServer(auth AuthFunc, allow AllowFunc) *Server {
+	return &Server{
+		auth:    auth,
+		allow:   allow,
+		Logf:    log.Printf,
+		clients: make(map[uint32]*serverClient),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts relay clients over plain TCP on l until l or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.lns = append(s.lns, l)
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.addHandler() {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.handlers.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// addHandler registers a connection handler, reporting false once the
+// server is closed
+func (s *Server) addHandler() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+// ServeHTTP accepts relay clients over WebSocket, for networks that only allow HTTP
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.addHandler() {
+		http.Error(w, "relay server closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.handlers.Done()
+
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		s.Logf("relay websocket accept error: %s", err)
+		return
+	}
+	// The handler must not return until the connection is done
+	s.handle(websocket.NetConn(context.Background(), c, websocket.MessageBinary))
+}
+
+// Close disconnects all clients, closes the listeners passed to Serve and
+// waits for the connection handlers to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	lns := s.lns
+	clients := make([]*serverClient, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.lns = nil
+	s.mu.Unlock()
+
+	for _, l := range lns {
+		l.Close()
+	}
+	for _, c := range clients {
+		c.close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	s.handlers.Wait()
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	buf := make([]byte, 0xffff)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	t, payload, err := readFrame(conn, buf)
+	if err != nil {
+		return
+	}
+	if t != frameHello {
+		s.reject(conn, "expected hello")
+		return
+	}
+
+	id, err := s.auth(string(payload))
+	if err != nil {
+		s.reject(conn, err.Error())
+		return
+	}
+
+	welcome, _ := appendFrame(nil, frameWelcome, binary.BigEndian.AppendUint32(nil, id))
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err = conn.Write(welcome); err != nil {
+		return
+	}
+
+	c := &serverClient{
+		id:      id,
+		conn:    conn,
+		queue:   make(chan []byte, clientQueueSize),
+		done:    make(chan struct{}),
+		allowed: make(map[uint32]allowEntry),
+	}
+	if !s.register(c) {
+		return
+	}
+	defer s.unregister(c)
+
+	s.Logf("relay client %d connected from %s", id, conn.RemoteAddr())
+	go c.writeRoutine()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+		t, payload, err = readFrame(conn, buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.Logf("relay client %d read error: %s", id, err)
+			}
+			return
+		}
+
+		switch t {
+		case frameData:
+			dst, packet, err := parseData(payload)
+			if err != nil {
+				s.Logf("relay client %d: %s", id, err)
+				return
+			}
+			s.forward(c, dst, packet)
+		case frameKeepalive:
+		default:
+			s.Logf("relay client %d sent unexpected frame type %d", id, t)
+			return
+		}
+	}
+}
+
+func (s *Server) reject(conn net.Conn, reason string) {
+	if len(reason) > 0xffff {
+		reason = reason[:0xffff]
+	}
+	frame, _ := appendFrame(nil, frameError, []byte(reason))
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Write(frame)
+}
+
+// register adds the client, replacing an older connection from the same peer
+func (s *Server) register(c *serverClient) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	old := s.clients[c.id]
+	s.clients[c.id] = c
+	s.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	return true
+}
+
+func (s *Server) unregister(c *serverClient) {
+	s.mu.Lock()
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+	}
+	s.mu.Unlock()
+
+	c.close()
+	s.Logf("relay client %d disconnected", c.id)
+}
+
+// forward queues packet from src to dst. Packets for peers that aren't
+// connected, aren't allowed, or whose queue is full, are dropped
+func (s *Server) forward(src *serverClient, dst uint32, packet []byte) {
+	s.mu.Lock()
+	c := s.clients[dst]
+	s.mu.Unlock()
+	if c == nil || dst == src.id || !s.allowed(src, dst) {
+		return
+	}
+
+	frame, err := dataFrame(src.id, packet)
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.queue <- frame:
+	default:
+	}
+}
+
+// allowed checks the policy for packets from src to dst, caching the result
+func (s *Server) allowed(src *serverClient, dst uint32) bool {
+	if s.allow == nil {
+		return true
+	}
+
+	now := time.Now()
+	if e, ok := src.allowed[dst]; ok && now.Before(e.expires) {
+		return e.ok
+	}
+
+	ok := s.allow(src.id, dst)
+	if !ok {
+		s.Logf("relay client %d is not allowed to send to peer %d", src.id, dst)
+	}
+	src.allowed[dst] = allowEntry{ok: ok, expires: now.Add(allowCacheTTL)}
+	return ok
+}
+
+func (c *serverClient) writeRoutine() {
+	for {
+		select {
+		case frame := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.conn.Write(frame); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *serverClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}